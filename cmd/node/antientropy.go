@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"mini-dynamo/internal/merkle"
+	"mini-dynamo/internal/store"
+	"mini-dynamo/internal/transport"
+	"mini-dynamo/internal/types"
+)
+
+type aeStats struct {
+	mu             sync.Mutex
+	enabled        bool
+	interval       time.Duration
+	maxPerTick     int
+	treeDepth      int
+	lastPeer       string
+	lastRun        time.Time
+	lastDur        time.Duration
+	lastCompared   int
+	lastPulled     int
+	lastRanges     int
+	lastDivergent  int
+	totalPulled    int
+	totalRanges    int
+	totalDivergent int
+	totalErrors    int
+	lastErr        string
+}
+
+// aeResult summarises one anti-entropy exchange with a peer.
+type aeResult struct {
+	ranges    int // shared ranges whose roots were compared
+	divergent int // ranges whose roots differed
+	compared  int // keys compared after descending to differing leaves
+	pulled    int
+}
+
+func (s *aeStats) setRun(peer string, dur time.Duration, res aeResult, err error) {
+	aeRuns.Inc(result(err))
+	aeCompared.Add(float64(res.compared))
+	aePulled.Add(float64(res.pulled))
+	aeDivergent.Add(float64(res.divergent))
+	aeDuration.Observe(dur.Seconds())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastPeer = peer
+	s.lastRun = time.Now()
+	s.lastDur = dur
+	s.lastCompared = res.compared
+	s.lastPulled = res.pulled
+	s.lastRanges = res.ranges
+	s.lastDivergent = res.divergent
+	s.totalPulled += res.pulled
+	s.totalRanges += res.ranges
+	s.totalDivergent += res.divergent
+	if err != nil {
+		s.totalErrors++
+		s.lastErr = err.Error()
+	} else {
+		s.lastErr = ""
+	}
+}
+
+func (s *aeStats) snapshot() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastUnix := int64(0)
+	if !s.lastRun.IsZero() {
+		lastUnix = s.lastRun.Unix()
+	}
+
+	return map[string]any{
+		"enabled":               s.enabled,
+		"interval_ms":           int64(s.interval / time.Millisecond),
+		"max_per_tick":          s.maxPerTick,
+		"tree_depth":            s.treeDepth,
+		"last_peer":             s.lastPeer,
+		"last_run_unix":         lastUnix,
+		"last_dur_ms":           int64(s.lastDur / time.Millisecond),
+		"last_ranges_compared":  s.lastRanges,
+		"last_ranges_divergent": s.lastDivergent,
+		"last_compared":         s.lastCompared,
+		"last_pulled":           s.lastPulled,
+		"total_ranges_compared": s.totalRanges,
+		"total_ranges_diverged": s.totalDivergent,
+		"total_pulled":          s.totalPulled,
+		"total_errors":          s.totalErrors,
+		"last_error":            s.lastErr,
+	}
+}
+
+// runAntiEntropyOnce compares the Merkle trees of every range shared with peer,
+// in every keyspace, descends level by level only into differing subtrees, and
+// then pulls the keys under differing leaves in batches. One round trip per
+// tree level covers all ranges.
+// Keys matching skip (tombstones about to be purged) are not pulled.
+func runAntiEntropyOnce(tc *transport.Client, st store.Engine, idx *merkle.Index, peer types.NodeInfo, maxPull int, skip func(string, []store.Meta) bool) (res aeResult, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1200*time.Millisecond)
+	defer cancel()
+
+	if maxPull <= 0 {
+		maxPull = 200
+	}
+
+	var pending []transport.TreeQuery
+	for _, ks := range idx.Keyspaces() {
+		for _, rg := range idx.SharedRanges(ks, peer.ID) {
+			pending = append(pending, transport.TreeQuery{Keyspace: ks, Range: rg, Nodes: []int{0}})
+		}
+	}
+	res.ranges = len(pending)
+
+	var leaves []transport.TreeQuery
+	for level := 0; level <= idx.Depth() && len(pending) > 0; level++ {
+		var tres transport.TreeResponse
+		if e := tc.PostJSON(ctx, baseURL(peer.Addr)+"/internal/tree", transport.TreeRequest{Level: level, Queries: pending}, &tres); e != nil {
+			return res, e
+		}
+		if tres.Depth != idx.Depth() || len(tres.Hashes) != len(pending) {
+			return res, fmt.Errorf("peer %s tree mismatch: depth=%d want %d", peer.ID, tres.Depth, idx.Depth())
+		}
+
+		next := make([]transport.TreeQuery, 0, len(pending))
+		for i, q := range pending {
+			local := idx.Hashes(q.Keyspace, q.Range.End, level, q.Nodes)
+			var diff []int
+			for j, n := range q.Nodes {
+				if j < len(tres.Hashes[i]) && tres.Hashes[i][j] == local[j] {
+					continue
+				}
+				if level == idx.Depth() {
+					diff = append(diff, n)
+				} else {
+					diff = append(diff, 2*n, 2*n+1)
+				}
+			}
+			if len(diff) == 0 {
+				continue
+			}
+			if level == 0 {
+				res.divergent++
+			}
+			if level == idx.Depth() {
+				leaves = append(leaves, transport.TreeQuery{Keyspace: q.Keyspace, Range: q.Range, Nodes: diff})
+			} else {
+				next = append(next, transport.TreeQuery{Keyspace: q.Keyspace, Range: q.Range, Nodes: diff})
+			}
+		}
+		pending = next
+	}
+
+	if len(leaves) == 0 {
+		return res, nil
+	}
+
+	var kres transport.KeysResponse
+	if e := tc.Post(ctx, baseURL(peer.Addr)+"/internal/keys", &transport.KeysRequest{Leaves: leaves}, &kres); e != nil {
+		return res, e
+	}
+
+	var pull []string
+	for key, pms := range kres.Keys {
+		if len(pull) >= maxPull {
+			break
+		}
+		res.compared++
+		if skip != nil && skip(key, pms) {
+			continue
+		}
+
+		// Pull if the peer holds any sibling our local set does not already cover.
+		mine, _ := st.Get(key)
+		lsibs := metaRecords(store.MetaOf(mine))
+		for _, pr := range metaRecords(pms) {
+			if _, changed := store.MergeSiblings(lsibs, pr); changed {
+				pull = append(pull, key)
+				break
+			}
+		}
+	}
+	if len(pull) == 0 {
+		return res, nil
+	}
+
+	// Fetch the divergent keys in batches rather than one request each.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel2()
+	gres, err := tc.GetBatch(ctx2, baseURL(peer.Addr), pull)
+	if err != nil {
+		return res, err
+	}
+	for _, g := range gres {
+		if !g.Found {
+			continue
+		}
+		for _, rec := range g.Siblings {
+			// Keys of a keyspace the catalog has not caught up with yet
+			// come again on a later round.
+			if _, err := st.PutMerge(rec); err != nil && !errors.Is(err, store.ErrPartitionNotOpen) {
+				return res, err
+			}
+		}
+		res.pulled++
+	}
+
+	return res, nil
+}
+
+// leafMeta returns the metadata of the keys under the requested Merkle
+// leaves, looking up only those keys.
+func leafMeta(idx *merkle.Index, st store.Engine, leaves []transport.TreeQuery) map[string][]store.Meta {
+	out := make(map[string][]store.Meta)
+	for _, q := range leaves {
+		for _, key := range idx.LeafKeys(q.Keyspace, q.Range.End, q.Nodes) {
+			if sibs, ok := st.Get(key); ok {
+				out[key] = store.MetaOf(sibs)
+			}
+		}
+	}
+	return out
+}
+
+func metaRecords(ms []store.Meta) []store.Record {
+	out := make([]store.Record, 0, len(ms))
+	for _, m := range ms {
+		out = append(out, store.Record{Ts: m.Ts, WriterID: m.WriterID, Deleted: m.Deleted, Clock: m.Clock, ExpiresAt: m.ExpiresAt})
+	}
+	return out
+}
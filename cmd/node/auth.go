@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"mini-dynamo/internal/auth"
+	"mini-dynamo/internal/keyspace"
+)
+
+// guard authenticates client API requests against an ACL. /health is open,
+// /admin/, /debug/ and /metrics need an admin principal, and the /kv and /ks handlers
+// check each key with authorize. A nil guard lets everything through.
+type guard struct {
+	acl *auth.ACL
+}
+
+func (g *guard) wrap(next http.Handler) http.Handler {
+	if g == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := g.acl.Authenticate(r)
+		if err != nil {
+			deny(w, r, "", http.StatusUnauthorized, err)
+			return
+		}
+		if (strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/debug/") || r.URL.Path == "/metrics") && !p.Admin {
+			deny(w, r, p.Name, http.StatusForbidden, errors.New("admin only"))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), p)))
+	})
+}
+
+// authorize checks that the request's principal may perform perm on every
+// key (or key prefix, for scans). Otherwise it answers 403 and returns
+// false. Requests that went through no guard are allowed.
+func authorize(w http.ResponseWriter, r *http.Request, perm auth.Perm, keys ...string) bool {
+	p, ok := auth.FromContext(r.Context())
+	if !ok {
+		return true
+	}
+	for _, k := range keys {
+		if !p.Can(perm, k) {
+			err := fmt.Errorf("no %s permission on %q", perm, k)
+			if ks, key := keyspace.Split(k); ks != "" {
+				err = fmt.Errorf("no %s permission on %q in keyspace %q", perm, key, ks)
+			}
+			deny(w, r, p.Name, http.StatusForbidden, err)
+			return false
+		}
+	}
+	return true
+}
+
+// deny answers a refused request and writes it to the audit log.
+func deny(w http.ResponseWriter, r *http.Request, principal string, status int, err error) {
+	log.Printf("audit: denied %s %s from %s principal=%q: %v", r.Method, r.URL.Path, r.RemoteAddr, principal, err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mini-dynamo"`)
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"mini-dynamo/internal/auth"
+	"mini-dynamo/internal/coordinator"
+	"mini-dynamo/internal/store"
+)
+
+// maxBatchOps bounds the operations in one POST /kv/_batch.
+const maxBatchOps = 1000
+
+// batchOp is one operation of a POST /kv/_batch body.
+type batchOp struct {
+	Op      string `json:"op"` // get, put or delete
+	Key     string `json:"key"`
+	Value   []byte `json:"value,omitempty"`   // put; base64 in JSON
+	TTL     string `json:"ttl,omitempty"`     // put; as X-TTL
+	Context string `json:"context,omitempty"` // put, delete; as X-Context
+}
+
+// batchResult answers one batchOp with the status, headers and body the
+// single-key request would have had.
+type batchResult struct {
+	Key       string        `json:"key"`
+	Status    int           `json:"status"`
+	Value     []byte        `json:"value,omitempty"`
+	Siblings  []siblingView `json:"siblings,omitempty"` // status 300
+	Context   string        `json:"context,omitempty"`
+	ETag      string        `json:"etag,omitempty"`
+	ExpiresAt int64         `json:"expires_at,omitempty"`
+	Acks      int           `json:"acks"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// serveBatch answers POST /kv/_batch: {"ops":[...]} in, {"results":[...]}
+// out, aligned. The batch's gets run before its writes, so they see the
+// state before the batch; a key may be written at most once per batch.
+// Consistency headers apply to every operation; preconditions are refused.
+func serveBatch(w http.ResponseWriter, r *http.Request, coord *coordinator.Coordinator, s kvSpace) {
+	var req struct {
+		Ops []batchOp `json:"ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	if len(req.Ops) > maxBatchOps {
+		http.Error(w, fmt.Sprintf("too many ops: %d (max %d)", len(req.Ops), maxBatchOps), http.StatusBadRequest)
+		return
+	}
+	cl, err := parseConsistency(r, "", nil, s.n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+		http.Error(w, "batches do not support If-Match or If-None-Match", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		keys     []string
+		getIdx   []int
+		writes   []coordinator.BatchWrite
+		writeIdx []int
+		written  = make(map[string]bool)
+	)
+	for i, op := range req.Ops {
+		if op.Key == "" {
+			http.Error(w, fmt.Sprintf("op %d: missing key", i), http.StatusBadRequest)
+			return
+		}
+		if s.name == "" && strings.HasPrefix(op.Key, "\x00") {
+			http.Error(w, fmt.Sprintf("op %d: bad key (must not start with a NUL byte)", i), http.StatusBadRequest)
+			return
+		}
+		for _, p := range s.serial {
+			if strings.HasPrefix(op.Key, p) {
+				http.Error(w, fmt.Sprintf("op %d: key %q is under serial prefix %q; batches do not support serial consistency", i, op.Key, p), http.StatusBadRequest)
+				return
+			}
+		}
+		switch op.Op {
+		case "get":
+			if !authorize(w, r, auth.Read, s.key(op.Key)) {
+				return
+			}
+			keys = append(keys, s.key(op.Key))
+			getIdx = append(getIdx, i)
+		case "put", "delete":
+			perm := auth.Write
+			if op.Op == "delete" {
+				perm = auth.Delete
+			}
+			if !authorize(w, r, perm, s.key(op.Key)) {
+				return
+			}
+			if written[op.Key] {
+				http.Error(w, fmt.Sprintf("op %d: key %q written twice", i, op.Key), http.StatusBadRequest)
+				return
+			}
+			written[op.Key] = true
+			causal, err := store.DecodeContext(op.Context)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("op %d: bad context", i), http.StatusBadRequest)
+				return
+			}
+			bw := coordinator.BatchWrite{Key: s.key(op.Key), Delete: op.Op == "delete", Context: causal}
+			if !bw.Delete {
+				bw.Value = op.Value
+				if bw.TTL, err = ttlValue(op.TTL); err != nil {
+					http.Error(w, fmt.Sprintf("op %d: %v", i, err), http.StatusBadRequest)
+					return
+				}
+				if bw.TTL == 0 {
+					bw.TTL = s.ttl
+				}
+			}
+			writes = append(writes, bw)
+			writeIdx = append(writeIdx, i)
+		default:
+			http.Error(w, fmt.Sprintf("op %d: bad op %q (want get, put or delete)", i, op.Op), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := make([]batchResult, len(req.Ops))
+	if len(keys) > 0 {
+		reads, err := coord.GetBatch(r.Context(), keys, coordinator.ReadOptions{R: cl.r, Serial: cl.serial, DC: cl.dc})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		for j, rd := range reads {
+			results[getIdx[j]] = readResult(s.clientKey(keys[j]), rd)
+		}
+	}
+	if len(writes) > 0 {
+		done, err := coord.PutBatch(r.Context(), writes, coordinator.WriteOptions{W: cl.w, Quorum: cl.quorum, Serial: cl.serial, DC: cl.dc})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		for j, wr := range done {
+			res := batchResult{Key: s.clientKey(writes[j].Key), Status: http.StatusNoContent, Acks: wr.Acks}
+			if wr.Err != nil {
+				res.Status, res.Error = errorStatus(wr.Err), wr.Err.Error()
+			} else if !writes[j].Delete {
+				res.ETag = etag(store.VersionTag([]store.Record{wr.Record}))
+			}
+			results[writeIdx[j]] = res
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
+
+// readResult renders one key of a batch get like GET /kv/<key>.
+func readResult(key string, rd coordinator.BatchRead) batchResult {
+	res := batchResult{Key: key, Acks: rd.Acks}
+	if rd.Err != nil {
+		res.Status, res.Error = errorStatus(rd.Err), rd.Err.Error()
+		return res
+	}
+	res.Context = store.EncodeContext(store.ContextOf(rd.Siblings))
+	if !rd.Found {
+		res.Status = http.StatusNotFound
+		return res
+	}
+	res.ETag = etag(store.VersionTag(rd.Siblings))
+	live := store.Live(rd.Siblings)
+	if len(live) == 1 {
+		res.Status, res.Value, res.ExpiresAt = http.StatusOK, live[0].Value, live[0].ExpiresAt
+		return res
+	}
+	res.Status = http.StatusMultipleChoices
+	for _, rec := range live {
+		res.Siblings = append(res.Siblings, siblingView{Value: rec.Value, Ts: rec.Ts, WriterID: rec.WriterID, ExpiresAt: rec.ExpiresAt})
+	}
+	return res
+}
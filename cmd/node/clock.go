@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"mini-dynamo/internal/hlc"
+	"mini-dynamo/internal/store"
+)
+
+// skewGuard sits in front of the storage engine so every record that reaches
+// it (replica writes, hints, read repair, anti-entropy, streaming) advances
+// the node's clock. Records stamped further in the future than
+// --max_clock_skew are dropped in reject mode; otherwise they are only
+// counted by the clock. Anti-entropy keeps offering a dropped record, so it
+// is accepted once it is no longer too far ahead.
+type skewGuard struct {
+	store.Engine
+	clk    *hlc.Clock
+	logged *atomic.Int64 // unix ns of the last logged rejection
+}
+
+func newSkewGuard(st store.Engine, clk *hlc.Clock) skewGuard {
+	return skewGuard{Engine: st, clk: clk, logged: new(atomic.Int64)}
+}
+
+// admit observes rec's timestamp and fails if the guard rejects it.
+func (g skewGuard) admit(rec store.Record) error {
+	err := g.clk.Observe(rec.Ts)
+	if err == nil {
+		return nil
+	}
+	if now := time.Now().UnixNano(); now-g.logged.Load() > int64(10*time.Second) {
+		g.logged.Store(now)
+		log.Printf("clock: rejected %q written by %s: %v", rec.Key, rec.WriterID, err)
+	}
+	return err
+}
+
+func (g skewGuard) PutMerge(rec store.Record) ([]store.Record, error) {
+	if err := g.admit(rec); err != nil {
+		sibs, _ := g.Engine.Get(rec.Key)
+		return sibs, err
+	}
+	return g.Engine.PutMerge(rec)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mini-dynamo/internal/coordinator"
+)
+
+// consistencyHeader selects the consistency of a /kv/ request: one, quorum,
+// all, local_quorum, each_quorum (per datacenter) or serial (Paxos). rHeader and wHeader (or ?r= / ?w=) set an explicit
+// replica count instead. Without any of them the cluster's R and W apply.
+// Keys under --serial_prefixes are always serial. quorumHeader (or
+// ?quorum=) picks the write quorum policy: sloppy, strict or preferred=K.
+const (
+	consistencyHeader = "X-Consistency"
+	rHeader           = "X-R"
+	wHeader           = "X-W"
+	quorumHeader      = "X-Quorum"
+	acksHeader        = "X-Acks" // replicas that acknowledged the request
+)
+
+// consistency is what a /kv/ request asked for. Zero r/w and an empty quorum
+// mean the default; the coordinator validates them against N.
+type consistency struct {
+	serial bool
+	r, w   int
+	quorum string
+	dc     string // coordinator.DCLocal or DCEach
+}
+
+func splitPrefixes(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// param reads a request option from its header or, failing that, the query.
+func param(r *http.Request, header, query string) string {
+	if v := r.Header.Get(header); v != "" {
+		return v
+	}
+	return r.URL.Query().Get(query)
+}
+
+// level names the consistency level for error messages.
+func (c consistency) level() string {
+	if c.serial {
+		return "serial"
+	}
+	return c.dc
+}
+
+func parseConsistency(r *http.Request, key string, prefixes []string, n int) (consistency, error) {
+	var c consistency
+	switch lvl := strings.ToLower(param(r, consistencyHeader, "consistency")); lvl {
+	case "":
+	case "one":
+		c.r, c.w = 1, 1
+	case "quorum":
+		c.r, c.w = n/2+1, n/2+1
+	case "all":
+		c.r, c.w = n, n
+	case coordinator.DCLocal, coordinator.DCEach:
+		c.dc = lvl
+	case "serial":
+		c.serial = true
+	default:
+		return c, fmt.Errorf("bad consistency %q (want one, quorum, all, local_quorum, each_quorum or serial)", lvl)
+	}
+
+	for _, p := range []struct {
+		header, query string
+		dst           *int
+	}{{rHeader, "r", &c.r}, {wHeader, "w", &c.w}} {
+		v := param(r, p.header, p.query)
+		if v == "" {
+			continue
+		}
+		if c.serial || c.dc != "" {
+			return c, fmt.Errorf("%s=%s cannot be combined with %s consistency", p.query, v, c.level())
+		}
+		x, err := strconv.Atoi(v)
+		if err != nil || x < 1 {
+			return c, fmt.Errorf("bad %s=%q (want a replica count)", p.query, v)
+		}
+		*p.dst = x
+	}
+
+	if c.quorum = strings.ToLower(param(r, quorumHeader, "quorum")); c.quorum != "" && (c.serial || c.dc != "") {
+		return c, fmt.Errorf("quorum=%s cannot be combined with %s consistency", c.quorum, c.level())
+	}
+
+	for _, p := range prefixes {
+		if !strings.HasPrefix(key, p) {
+			continue
+		}
+		if !c.serial && (c.r != 0 || c.w != 0 || c.quorum != "" || c.dc != "") {
+			return c, fmt.Errorf("key %q is under serial prefix %q; only serial consistency is allowed", key, p)
+		}
+		c.serial = true
+	}
+	return c, nil
+}
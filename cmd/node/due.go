@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// dueIndex tracks, per key, the time (unix ns) at which background work falls
+// due for it: a tombstone passing its grace horizon, or a value expiring. It
+// is fed from the engine's Observe hook, so finding due keys never scans the
+// engine (whose Scan blocks writes).
+type dueIndex struct {
+	mu sync.Mutex
+	at map[string]int64
+	h  dueHeap // may hold superseded entries; at is authoritative
+}
+
+func newDueIndex() *dueIndex {
+	return &dueIndex{at: make(map[string]int64)}
+}
+
+// set records when key falls due; 0 means it has nothing due.
+func (x *dueIndex) set(key string, at int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if at == 0 {
+		delete(x.at, key)
+		return
+	}
+	if x.at[key] == at {
+		return
+	}
+	x.at[key] = at
+	heap.Push(&x.h, dueEntry{key: key, at: at})
+	if len(x.h) > 2*len(x.at)+1024 {
+		// Rebuild without the superseded entries.
+		x.h = x.h[:0]
+		for k, t := range x.at {
+			x.h = append(x.h, dueEntry{key: k, at: t})
+		}
+		heap.Init(&x.h)
+	}
+}
+
+// popDue removes and returns the keys due at or before now. A caller that
+// leaves one of them with work still to do must set it again.
+func (x *dueIndex) popDue(now int64) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var keys []string
+	for len(x.h) > 0 && x.h[0].at <= now {
+		e := heap.Pop(&x.h).(dueEntry)
+		if at, ok := x.at[e.key]; ok && at == e.at {
+			delete(x.at, e.key)
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+func (x *dueIndex) len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.at)
+}
+
+type dueEntry struct {
+	key string
+	at  int64
+}
+
+type dueHeap []dueEntry
+
+func (h dueHeap) Len() int           { return len(h) }
+func (h dueHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h dueHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *dueHeap) Push(v any)        { *h = append(*h, v.(dueEntry)) }
+func (h *dueHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"mini-dynamo/internal/coordinator"
+	"mini-dynamo/internal/store"
+)
+
+// etag quotes a store.VersionTag for the ETag header.
+func etag(tag string) string { return `"` + tag + `"` }
+
+// parseETags splits an If-Match / If-None-Match header into bare version
+// tags. Weak validators are treated like strong ones.
+func parseETags(h string) []string {
+	var out []string
+	for _, part := range strings.Split(h, ",") {
+		t := strings.TrimSpace(part)
+		t = strings.TrimPrefix(t, "W/")
+		t = strings.Trim(t, `"`)
+		if t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// writeOptions collects the causal context, TTL and preconditions of a
+// client PUT or DELETE.
+func writeOptions(r *http.Request) (coordinator.WriteOptions, error) {
+	causal, err := store.DecodeContext(r.Header.Get(contextHeader))
+	if err != nil {
+		return coordinator.WriteOptions{}, errors.New("bad " + contextHeader)
+	}
+	opts := coordinator.WriteOptions{
+		Context: causal,
+		If: coordinator.Precondition{
+			IfMatch:     parseETags(r.Header.Get("If-Match")),
+			IfNoneMatch: parseETags(r.Header.Get("If-None-Match")),
+		},
+	}
+	if r.Method == http.MethodPut {
+		if opts.TTL, err = parseTTL(r); err != nil {
+			return coordinator.WriteOptions{}, err
+		}
+	}
+	return opts, nil
+}
+
+// writeError maps a coordinator error to an HTTP status.
+func writeError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), errorStatus(err))
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, coordinator.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, coordinator.ErrBadConsistency):
+		return http.StatusBadRequest
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
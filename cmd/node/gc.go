@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mini-dynamo/internal/hints"
+	"mini-dynamo/internal/membership"
+	"mini-dynamo/internal/ring"
+	"mini-dynamo/internal/store"
+	"mini-dynamo/internal/transport"
+	"mini-dynamo/internal/types"
+)
+
+// gcState purges tombstones (and hints) older than gc_grace, and keeps a node
+// that was down for longer than that from resurrecting deleted data.
+//
+// A peer may have purged a tombstone while this node was away, so any record
+// here older than the grace horizon might be a value that was deleted. Such a
+// node starts out stale: it withholds old records from peers and clients
+// until a full repair has checked each of them against the other replicas.
+// Keys of a keyspace with its own gc_grace are judged by that grace, so the
+// node is stale once it was down longer than the shortest one.
+type gcState struct {
+	grace     time.Duration
+	keyGrace  func(key string) time.Duration // a keyspace's own gc_grace; 0 uses grace
+	interval  time.Duration
+	alivePath string    // last time this node was up, to detect long outages
+	due       *dueIndex // keys of all-tombstone siblings, by when they may be purged
+
+	mu           sync.Mutex
+	stale        bool
+	lastRun      time.Time
+	lastPurged   int
+	totalPurged  int
+	hintsDropped int
+	lastErr      string
+	lastRepair   time.Time
+	repairKept   int
+	repairPurged int
+	repairErr    string
+}
+
+// newGC returns the GC state of a node whose shortest gc_grace, over the
+// node's and its keyspaces', is shortest.
+func newGC(grace, shortest, interval time.Duration, alivePath string) *gcState {
+	g := &gcState{grace: grace, interval: interval, alivePath: alivePath, due: newDueIndex()}
+	if grace <= 0 {
+		return g
+	}
+	if shortest <= 0 || shortest > grace {
+		shortest = grace
+	}
+	if last, ok := readAlive(alivePath); ok && time.Since(last) > shortest {
+		log.Printf("gc: node was down since %s (longer than gc_grace %s); withholding old records until repair",
+			last.Format(time.RFC3339), shortest)
+		g.stale = true
+	}
+	return g
+}
+
+func readAlive(path string) (time.Time, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+func (g *gcState) enabled() bool { return g.grace > 0 }
+
+// horizon is the oldest timestamp (unix ns) still inside the grace period.
+func (g *gcState) horizon() int64 {
+	return time.Now().Add(-g.grace).UnixNano()
+}
+
+// horizonOf is the horizon of key: its keyspace's own gc_grace, if any,
+// replaces the node's.
+func (g *gcState) horizonOf(key string) int64 {
+	if g.keyGrace != nil {
+		if d := g.keyGrace(key); d > 0 {
+			return time.Now().Add(-d).UnixNano()
+		}
+	}
+	return g.horizon()
+}
+
+// purgeable matches keys whose siblings are all tombstones older than their
+// horizon.
+func (g *gcState) purgeable(key string, meta []store.Meta) bool {
+	return store.TombstonesBefore(g.horizonOf(key))(key, meta)
+}
+
+// purgeAt is when key, with siblings sibs, may be purged: the newest of
+// them plus its grace if all are tombstones, otherwise 0.
+func (g *gcState) purgeAt(key string, sibs []store.Record) int64 {
+	if !g.enabled() || len(sibs) == 0 {
+		return 0
+	}
+	for _, r := range sibs {
+		if !r.Deleted {
+			return 0
+		}
+	}
+	grace := g.grace
+	if g.keyGrace != nil {
+		if d := g.keyGrace(key); d > 0 {
+			grace = d
+		}
+	}
+	return newest(sibs) + int64(grace)
+}
+
+// observe keeps the purge index current; register it with the engine.
+func (g *gcState) observe(key string, _, after []store.Record) {
+	if g.enabled() {
+		g.due.set(key, g.purgeAt(key, after))
+	}
+}
+
+func (g *gcState) isStale() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stale
+}
+
+// withhold drops siblings of key older than its horizon while the node is
+// stale.
+func (g *gcState) withhold(key string, sibs []store.Record) []store.Record {
+	if !g.isStale() {
+		return sibs
+	}
+	h := g.horizonOf(key)
+	out := make([]store.Record, 0, len(sibs))
+	for _, r := range sibs {
+		if r.Ts >= h {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// markAlive records that the node is up.
+func (g *gcState) markAlive() {
+	if err := os.WriteFile(g.alivePath, []byte(strconv.FormatInt(time.Now().UnixNano(), 10)), 0o644); err != nil {
+		log.Printf("gc: write %s: %v", g.alivePath, err)
+	}
+}
+
+// runOnce purges tombstones and hints past the horizon and records that the
+// node is up.
+func (g *gcState) runOnce(st store.Engine, hm *hints.Manager) {
+	g.markAlive()
+
+	n, err := g.purgeDue(st)
+	dropped := hm.PurgeIf(func(rec store.Record) bool { return rec.Ts < g.horizonOf(rec.Key) })
+	gcPurged.Add(float64(n))
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lastRun = time.Now()
+	g.lastPurged = n
+	g.totalPurged += n
+	g.hintsDropped += dropped
+	g.lastErr = ""
+	if err != nil {
+		g.lastErr = err.Error()
+	}
+}
+
+// purgeDue purges the keys the index has past their horizon. The engine's
+// Purge, a full pass (a full compaction on lsm), only runs when there are
+// some, and drops only those.
+func (g *gcState) purgeDue(st store.Engine) (int, error) {
+	keys := g.due.popDue(time.Now().UnixNano())
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	due := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		due[k] = true
+	}
+	n, err := st.Purge(func(key string, meta []store.Meta) bool {
+		return due[key] && g.purgeable(key, meta)
+	})
+	// Keys still held (written again, or their grace grew) go back in.
+	for _, k := range keys {
+		if sibs, ok := st.Get(k); ok {
+			g.due.set(k, g.purgeAt(k, sibs))
+		}
+	}
+	return n, err
+}
+
+// repair checks every local key whose siblings are all older than its horizon
+// against the key's other replicas: their versions are merged in, and keys no
+// replica holds any more (purged while we were away) are dropped. Reachable
+// replicas must answer for every key, and every key with other replicas must
+// reach at least one of them, otherwise the repair fails and the node stays
+// stale.
+func (g *gcState) repair(ctx context.Context, self types.NodeInfo, st store.Engine, topo *ring.Topology, gm *membership.List, tc *transport.Client, n func(key string) int) error {
+	_, rg := topo.Current()
+
+	var old []string
+	if err := st.Scan("", func(key string, sibs []store.Record) bool {
+		if newest(sibs) < g.horizonOf(key) {
+			old = append(old, key)
+		}
+		return true
+	}); err != nil {
+		return g.repaired(0, 0, err)
+	}
+
+	gone := make(map[string]bool)
+	kept, unchecked := 0, 0
+	for _, key := range old {
+		others, asked, held := 0, 0, false
+		for _, peer := range rg.GetReplicas(key, n(key)) {
+			if peer.ID == self.ID {
+				continue
+			}
+			others++
+			if gm.Dead(peer.ID) {
+				continue
+			}
+			var resp transport.GetResponse
+			if err := tc.PostJSON(ctx, baseURL(peer.Addr)+"/internal/get", transport.GetRequest{Key: key}, &resp); err != nil {
+				return g.repaired(kept, 0, fmt.Errorf("check %q on %s: %w", key, peer.ID, err))
+			}
+			asked++
+			for _, rec := range resp.Siblings {
+				if _, err := st.PutMerge(rec); err != nil && !errors.Is(err, store.ErrPartitionNotOpen) {
+					return g.repaired(kept, 0, fmt.Errorf("merge %q: %w", key, err))
+				}
+				held = true
+			}
+		}
+		switch {
+		case others > 0 && asked == 0:
+			// Every other replica is down: nobody can say whether the key
+			// was deleted, so it stays withheld.
+			unchecked++
+		case asked > 0 && !held:
+			gone[key] = true
+		default:
+			kept++
+		}
+	}
+
+	purged, err := st.Purge(func(key string, meta []store.Meta) bool {
+		return gone[key] && newestMeta(meta) < g.horizonOf(key)
+	})
+	if err == nil && unchecked > 0 {
+		err = fmt.Errorf("%d old keys have no live replica to check against", unchecked)
+	}
+	return g.repaired(kept, purged, err)
+}
+
+func (g *gcState) repaired(kept, purged int, err error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.lastRepair = time.Now()
+	g.repairKept = kept
+	g.repairPurged = purged
+	if err != nil {
+		g.repairErr = err.Error()
+		return err
+	}
+	g.repairErr = ""
+	if g.stale {
+		log.Printf("gc: repair done (kept %d, purged %d old keys); serving all records again", kept, purged)
+	}
+	g.stale = false
+	return nil
+}
+
+func newest(sibs []store.Record) int64 {
+	var ts int64
+	for _, r := range sibs {
+		if r.Ts > ts {
+			ts = r.Ts
+		}
+	}
+	return ts
+}
+
+func newestMeta(meta []store.Meta) int64 {
+	var ts int64
+	for _, m := range meta {
+		if m.Ts > ts {
+			ts = m.Ts
+		}
+	}
+	return ts
+}
+
+func (g *gcState) snapshot() map[string]any {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	unix := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.Unix()
+	}
+	return map[string]any{
+		"enabled":           g.enabled(),
+		"grace_ms":          int64(g.grace / time.Millisecond),
+		"interval_ms":       int64(g.interval / time.Millisecond),
+		"stale":             g.stale,
+		"last_run_unix":     unix(g.lastRun),
+		"last_purged":       g.lastPurged,
+		"total_purged":      g.totalPurged,
+		"hints_dropped":     g.hintsDropped,
+		"tombstones_queued": g.due.len(),
+		"last_error":        g.lastErr,
+		"last_repair_unix":  unix(g.lastRepair),
+		"last_repair_kept":  g.repairKept,
+		"last_repair_purge": g.repairPurged,
+		"last_repair_error": g.repairErr,
+	}
+}
+
+var errRepairDisabled = errors.New("gc_grace is disabled; nothing to repair")
+
+// guardedEngine is what the node serves reads from: while the node is stale
+// it hides records older than their grace horizon, so neither peers (anti-
+// entropy, read repair, streaming) nor clients can pick them up.
+type guardedEngine struct {
+	store.Engine
+	gc *gcState
+}
+
+func (e guardedEngine) Get(key string) ([]store.Record, bool) {
+	sibs, ok := e.Engine.Get(key)
+	if !ok {
+		return nil, false
+	}
+	sibs = e.gc.withhold(key, sibs)
+	return sibs, len(sibs) > 0
+}
+
+func (e guardedEngine) KeysMeta() map[string][]store.Meta {
+	all := e.Engine.KeysMeta()
+	if !e.gc.isStale() {
+		return all
+	}
+	for k, meta := range all {
+		h := e.gc.horizonOf(k)
+		kept := meta[:0]
+		for _, m := range meta {
+			if m.Ts >= h {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) == 0 {
+			delete(all, k)
+		} else {
+			all[k] = kept
+		}
+	}
+	return all
+}
+
+func (e guardedEngine) Scan(start string, fn func(key string, sibs []store.Record) bool) error {
+	return e.Engine.Scan(start, func(key string, sibs []store.Record) bool {
+		sibs = e.gc.withhold(key, sibs)
+		if len(sibs) == 0 {
+			return true
+		}
+		return fn(key, sibs)
+	})
+}
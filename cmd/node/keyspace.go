@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"mini-dynamo/internal/hints"
+	"mini-dynamo/internal/keyspace"
+	"mini-dynamo/internal/merkle"
+	"mini-dynamo/internal/ring"
+	"mini-dynamo/internal/store"
+	"mini-dynamo/internal/transport"
+)
+
+// keyspaces applies the keyspace catalog to this node. Every keyspace keeps
+// its records in an engine of its own under dir/<name>, with its own WAL,
+// so dropping one closes that engine, deletes its directory and drops its
+// Merkle trees and hints, without touching any other key.
+type keyspaces struct {
+	reg   *keyspace.Registry
+	parts *store.Partitioned
+	dir   string
+	open  func(dir string) (store.Engine, error)
+
+	// Set once the node has built them; see main.
+	mt   *merkle.Index
+	hm   *hints.Manager
+	topo *ring.Topology
+	tc   *transport.Client
+
+	// fixedN is the cluster's N when per-datacenter replication places
+	// replicas regardless of a keyspace's n, 0 otherwise.
+	fixedN int
+
+	mu sync.Mutex // serializes catalog changes
+}
+
+// openAll opens the engine of every keyspace in the catalog.
+func (k *keyspaces) openAll() error {
+	for _, ks := range k.reg.Catalog().Keyspaces {
+		if err := k.add(ks); err != nil {
+			return fmt.Errorf("keyspace %s: %w", ks.Name, err)
+		}
+	}
+	return nil
+}
+
+// add opens the engine of ks and starts tracking its ranges. mt is nil
+// while the node starts; the index is then rebuilt with every keyspace.
+func (k *keyspaces) add(ks keyspace.Keyspace) error {
+	dir := filepath.Join(k.dir, ks.Name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	e, err := k.open(dir)
+	if err != nil {
+		return err
+	}
+	if err := k.parts.Add(ks.Name, e); err != nil {
+		_ = e.Close()
+		return err
+	}
+	if k.mt != nil {
+		k.mt.AddKeyspace(ks.Name, ks.N)
+	}
+	return nil
+}
+
+// drop closes the engine of ks and deletes everything the node holds for it.
+func (k *keyspaces) drop(ks keyspace.Keyspace) error {
+	if e, ok := k.parts.Remove(ks.Name); ok {
+		if err := e.Close(); err != nil {
+			log.Printf("keyspace %s: close: %v", ks.Name, err)
+		}
+	}
+	k.mt.DropKeyspace(ks.Name)
+	n := k.hm.PurgeIf(func(rec store.Record) bool { return keyspace.Of(rec.Key) == ks.Name })
+	if n > 0 {
+		log.Printf("keyspace %s: dropped %d hints", ks.Name, n)
+	}
+	return os.RemoveAll(filepath.Join(k.dir, ks.Name))
+}
+
+// adopt installs cat if it supersedes the node's catalog, dropping and
+// creating keyspaces to match.
+func (k *keyspaces) adopt(cat keyspace.Catalog) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	dropped, created, ok, err := k.reg.Adopt(cat)
+	if err != nil {
+		log.Printf("keyspaces v%d: %v", cat.Version, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	for _, ks := range dropped {
+		if err := k.drop(ks); err != nil {
+			log.Printf("keyspace %s: drop: %v", ks.Name, err)
+		}
+	}
+	for _, ks := range created {
+		if err := k.add(ks); err != nil {
+			log.Printf("keyspace %s: open: %v", ks.Name, err)
+		}
+	}
+	log.Printf("keyspaces v%d adopted (%d dropped, %d created)", cat.Version, len(dropped), len(created))
+}
+
+// replication is the coordinator's per-key N, R and W.
+func (k *keyspaces) replication(key string) (n, r, w int, ok bool) {
+	ks, ok := k.reg.For(key)
+	return ks.N, ks.R, ks.W, ok
+}
+
+// replicas returns the replication factor of each key, def for the default
+// keyspace.
+func (k *keyspaces) replicas(def int) func(key string) int {
+	return func(key string) int {
+		if ks, ok := k.reg.For(key); ok {
+			return ks.N
+		}
+		return def
+	}
+}
+
+// grace is the keyspace's own gc_grace of key, 0 if it has none.
+func (k *keyspaces) grace(key string) time.Duration {
+	ks, _ := k.reg.For(key)
+	return time.Duration(ks.GCGrace)
+}
+
+// shortestGrace is the shortest gc_grace on the node: def, or a keyspace's
+// own if it is shorter.
+func (k *keyspaces) shortestGrace(def time.Duration) time.Duration {
+	shortest := def
+	for _, ks := range k.reg.Catalog().Keyspaces {
+		if d := time.Duration(ks.GCGrace); d > 0 && d < shortest {
+			shortest = d
+		}
+	}
+	return shortest
+}
+
+// errCatalogConflict means another node changed the catalog concurrently and
+// its change won: this one is undone on every node.
+var errCatalogConflict = errors.New("concurrent keyspace change")
+
+// publish adopts cat and sends it to every node of the committed ring.
+// Nodes that miss it catch up through gossip.
+func (k *keyspaces) publish(ctx context.Context, cat keyspace.Catalog) error {
+	k.adopt(cat)
+	if mine := k.reg.Catalog(); !sameCatalog(mine, cat) {
+		return fmt.Errorf("%w: this node has keyspaces v%d", errCatalogConflict, mine.Version)
+	}
+	cur, _ := k.topo.Current()
+	var missed []string
+	for _, n := range cur.Nodes {
+		var resp transport.KeyspacesResponse
+		err := k.tc.PostJSON(ctx, baseURL(n.Addr)+"/internal/keyspaces", transport.KeyspacesRequest{Catalog: cat}, &resp)
+		if err != nil {
+			missed = append(missed, n.ID)
+			continue
+		}
+		if resp.Current.Supersedes(cat) {
+			k.adopt(resp.Current) // rather than wait for gossip
+			return fmt.Errorf("%w: %s has keyspaces v%d", errCatalogConflict, n.ID, resp.Current.Version)
+		}
+	}
+	if len(missed) > 0 {
+		return fmt.Errorf("keyspaces v%d published but %v missed it (gossip will catch them up)", cat.Version, missed)
+	}
+	return nil
+}
+
+func sameCatalog(a, b keyspace.Catalog) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+// serveInternal answers POST /internal/keyspaces with the node's catalog
+// after adopting the caller's.
+func (k *keyspaces) serveInternal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req transport.KeyspacesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	k.adopt(req.Catalog)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(transport.KeyspacesResponse{Current: k.reg.Catalog()})
+}
+
+// serveAdmin answers the keyspace admin API:
+//
+//	GET    /admin/keyspaces         the catalog
+//	POST   /admin/keyspaces         create {"name","n","r","w","ttl","gc_grace"}
+//	DELETE /admin/keyspaces/<name>  drop a keyspace and all its data
+//
+// Changes are applied here and pushed to every node; make them through one
+// node at a time.
+func (k *keyspaces) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/keyspaces"), "/")
+	cat := k.reg.Catalog()
+
+	var next keyspace.Catalog
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(cat)
+		return
+
+	case r.Method == http.MethodPost && name == "":
+		var ks keyspace.Keyspace
+		if err := json.NewDecoder(r.Body).Decode(&ks); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		cur, _ := k.topo.Current()
+		if err := ks.Check(len(cur.Nodes), k.fixedN); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := cat.Find(ks.Name); ok {
+			http.Error(w, fmt.Sprintf("keyspace %q exists", ks.Name), http.StatusConflict)
+			return
+		}
+		next = cat.With(ks)
+
+	case r.Method == http.MethodDelete && name != "":
+		if _, ok := cat.Find(name); !ok {
+			http.Error(w, fmt.Sprintf("no keyspace %q", name), http.StatusNotFound)
+			return
+		}
+		next = cat.Without(name)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := k.publish(r.Context(), next); err != nil {
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, errCatalogConflict) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(next)
+}
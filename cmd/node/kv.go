@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mini-dynamo/internal/auth"
+	"mini-dynamo/internal/coordinator"
+	"mini-dynamo/internal/keyspace"
+	"mini-dynamo/internal/store"
+)
+
+// kvSpace is the keyspace a client request addresses: /kv/ is the default
+// one, /ks/<name>/kv/ a named one. Clients use their own keys; the node
+// stores, replicates and authorizes the internal ones.
+type kvSpace struct {
+	name   string        // "" for the default keyspace
+	n      int           // replication factor
+	ttl    time.Duration // expiry of writes that set none
+	serial []string      // --serial_prefixes, matched against client keys
+}
+
+// key is the internal key of the client key k.
+func (s kvSpace) key(k string) string { return keyspace.Key(s.name, k) }
+
+// clientKey is the client key of the internal key k.
+func (s kvSpace) clientKey(k string) string {
+	_, rest := keyspace.Split(k)
+	return rest
+}
+
+// route serves a /kv or /kv/<key> path (rest) of the keyspace.
+func (s kvSpace) route(w http.ResponseWriter, r *http.Request, coord *coordinator.Coordinator, rest string) {
+	if rest == "" {
+		serveScan(w, r, coord, s)
+		return
+	}
+	key, ok := strings.CutPrefix(rest, "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	if key == "_batch" && r.Method == http.MethodPost {
+		serveBatch(w, r, coord, s)
+		return
+	}
+	if s.name == "" && strings.HasPrefix(key, "\x00") {
+		http.Error(w, "bad key (must not start with a NUL byte)", http.StatusBadRequest)
+		return
+	}
+	serveKey(w, r, coord, s, key)
+}
+
+// serveKey answers GET, PUT and DELETE on one key.
+func serveKey(w http.ResponseWriter, r *http.Request, coord *coordinator.Coordinator, s kvSpace, key string) {
+	perm := auth.Read
+	switch r.Method {
+	case http.MethodPut:
+		perm = auth.Write
+	case http.MethodDelete:
+		perm = auth.Delete
+	}
+	if !authorize(w, r, perm, s.key(key)) {
+		return
+	}
+
+	cl, err := parseConsistency(r, key, s.serial, s.n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		opts, err := writeOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if opts.TTL == 0 {
+			opts.TTL = s.ttl
+		}
+		opts.Serial, opts.R, opts.W, opts.Quorum, opts.DC = cl.serial, cl.r, cl.w, cl.quorum, cl.dc
+		val, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		rec, acks, err := coord.Put(r.Context(), s.key(key), val, opts)
+		w.Header().Set(acksHeader, strconv.Itoa(acks))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("ETag", etag(store.VersionTag([]store.Record{rec})))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		opts, err := writeOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Serial, opts.R, opts.W, opts.Quorum, opts.DC = cl.serial, cl.r, cl.w, cl.quorum, cl.dc
+		acks, err := coord.Delete(r.Context(), s.key(key), opts)
+		w.Header().Set(acksHeader, strconv.Itoa(acks))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodGet:
+		sibs, ok, acks, err := coord.Get(r.Context(), s.key(key), coordinator.ReadOptions{R: cl.r, Serial: cl.serial, DC: cl.dc})
+		w.Header().Set(acksHeader, strconv.Itoa(acks))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if tok := store.EncodeContext(store.ContextOf(sibs)); tok != "" {
+			w.Header().Set(contextHeader, tok)
+		}
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag(store.VersionTag(sibs)))
+
+		live := store.Live(sibs)
+		if len(live) == 1 {
+			if exp := live[0].ExpiresAt; exp != 0 {
+				w.Header().Set("X-Expires-At", time.Unix(0, exp).UTC().Format(time.RFC3339Nano))
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(live[0].Value)
+			return
+		}
+
+		// Concurrent writes: hand every sibling to the client, who resolves
+		// them and PUTs the result back with the context header.
+		out := make([]siblingView, 0, len(live))
+		for _, rec := range live {
+			out = append(out, siblingView{Value: rec.Value, Ts: rec.Ts, WriterID: rec.WriterID, ExpiresAt: rec.ExpiresAt})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultipleChoices)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"siblings": out,
+			"context":  w.Header().Get(contextHeader),
+		})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
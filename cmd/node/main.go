@@ -10,14 +10,22 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"mini-dynamo/internal/auth"
 	"mini-dynamo/internal/coordinator"
 	"mini-dynamo/internal/hints"
+	"mini-dynamo/internal/hlc"
+	"mini-dynamo/internal/keyspace"
+	"mini-dynamo/internal/membership"
+	"mini-dynamo/internal/merkle"
+	"mini-dynamo/internal/metrics"
+	"mini-dynamo/internal/paxos"
 	"mini-dynamo/internal/ring"
 	"mini-dynamo/internal/store"
+	"mini-dynamo/internal/tracing"
 	"mini-dynamo/internal/transport"
 	"mini-dynamo/internal/types"
 )
@@ -28,6 +36,24 @@ type ClusterConfig struct {
 	N      int              `json:"n"`
 	R      int              `json:"r"`
 	W      int              `json:"w"`
+
+	// Quorum is the write quorum policy: sloppy (default), strict or
+	// preferred=K. See coordinator.ParseQuorum.
+	Quorum string `json:"quorum,omitempty"`
+
+	// Replication sets a replica count per datacenter (node "dc" labels),
+	// e.g. {"dc1": 3, "dc2": 2}. N is then their sum and may be omitted.
+	Replication map[string]int `json:"replication,omitempty"`
+
+	// Allocation picks how vnode tokens are chosen: hash (default) or
+	// balanced. See ring.AllocBalanced.
+	Allocation string `json:"allocation,omitempty"`
+
+	// Partitioner maps keys to replicas: fnv (default), murmur3, rendezvous
+	// or jump. Partitions is the range count of rendezvous and jump. A node
+	// refuses to start if these differ from what its data was written with.
+	Partitioner string `json:"partitioner,omitempty"`
+	Partitions  int    `json:"partitions,omitempty"`
 }
 
 func loadConfig(path string) (ClusterConfig, error) {
@@ -39,68 +65,54 @@ func loadConfig(path string) (ClusterConfig, error) {
 	return cfg, json.Unmarshal(b, &cfg)
 }
 
-func baseURL(addr string) string {
-	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
-		return addr
+// checkReplication validates per-DC replication and derives N from it.
+func checkReplication(cfg *ClusterConfig) error {
+	total := 0
+	for dc, rf := range cfg.Replication {
+		if dc == "" || rf <= 0 {
+			return fmt.Errorf("replication %q: %d (want a dc label and a count > 0)", dc, rf)
+		}
+		total += rf
 	}
-	return "http://" + addr
+	if cfg.N == 0 {
+		cfg.N = total
+	}
+	if cfg.N != total {
+		return fmt.Errorf("n=%d does not match replication total %d", cfg.N, total)
+	}
+	return dcCapacity(cfg.Nodes, cfg.Replication)
 }
 
-type aeStats struct {
-	mu           sync.Mutex
-	enabled      bool
-	interval     time.Duration
-	maxPerTick   int
-	lastPeer     string
-	lastRun      time.Time
-	lastDur      time.Duration
-	lastCompared int
-	lastPulled   int
-	totalPulled  int
-	totalErrors  int
-	lastErr      string
+// dcCapacity checks every datacenter has at least as many nodes as replicas.
+func dcCapacity(nodes []types.NodeInfo, replication map[string]int) error {
+	have := make(map[string]int)
+	for _, n := range nodes {
+		have[n.DC]++
+	}
+	for dc, rf := range replication {
+		if have[dc] < rf {
+			return fmt.Errorf("datacenter %q has %d nodes for %d replicas", dc, have[dc], rf)
+		}
+	}
+	return nil
 }
 
-func (s *aeStats) setRun(peer string, dur time.Duration, compared, pulled int, err error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.lastPeer = peer
-	s.lastRun = time.Now()
-	s.lastDur = dur
-	s.lastCompared = compared
-	s.lastPulled = pulled
-	s.totalPulled += pulled
-	if err != nil {
-		s.totalErrors++
-		s.lastErr = err.Error()
-	} else {
-		s.lastErr = ""
+func baseURL(addr string) string {
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return addr
 	}
+	return "http://" + addr
 }
 
-func (s *aeStats) snapshot() map[string]any {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// contextHeader carries the opaque causal context between GET and PUT/DELETE on /kv/.
+const contextHeader = "X-Context"
 
-	lastUnix := int64(0)
-	if !s.lastRun.IsZero() {
-		lastUnix = s.lastRun.Unix()
-	}
-
-	return map[string]any{
-		"enabled":       s.enabled,
-		"interval_ms":   int64(s.interval / time.Millisecond),
-		"max_per_tick":  s.maxPerTick,
-		"last_peer":     s.lastPeer,
-		"last_run_unix": lastUnix,
-		"last_dur_ms":   int64(s.lastDur / time.Millisecond),
-		"last_compared": s.lastCompared,
-		"last_pulled":   s.lastPulled,
-		"total_pulled":  s.totalPulled,
-		"total_errors":  s.totalErrors,
-		"last_error":    s.lastErr,
-	}
+// siblingView is one concurrent value in a 300 Multiple Choices response.
+type siblingView struct {
+	Value     []byte `json:"value"`
+	Ts        int64  `json:"ts"`
+	WriterID  string `json:"writer_id"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
 }
 
 func main() {
@@ -108,16 +120,53 @@ func main() {
 		id      = flag.String("id", "n1", "node id (n1/n2/n3)")
 		cfgp    = flag.String("config", "nodes.json", "path to cluster config")
 		listen  = flag.String("listen", "", "listen address override (e.g. :9001). if empty, uses config addr")
+		addr    = flag.String("addr", "", "advertise address for a node not yet in the ring (joins via POST /admin/join)")
+		dc      = flag.String("dc", "", "datacenter label for a node not yet in the ring")
+		rack    = flag.String("rack", "", "rack label for a node not yet in the ring")
 		dataDir = flag.String("data_dir", "data", "data directory for WAL/snapshots/hints")
 		hintwal = flag.String("hintwal", "", "path to hint WAL (default <data_dir>/hints_<id>.wal)")
 
-		kvwal  = flag.String("kvwal", "", "path to kv WAL (default <data_dir>/kv_<id>.wal)")
-		kvsnap = flag.String("kvsnap", "", "path to kv snapshot (default <data_dir>/kv_<id>.snap.json)")
-		snapI  = flag.Duration("snap_interval", 0, "snapshot interval (0 disables). snapshot blocks writes briefly")
+		engine     = flag.String("engine", "mem", "storage engine: mem (in-memory + WAL/snapshot), disk (append-only data log, keys in memory) or lsm (memtable + SSTables)")
+		kvwal      = flag.String("kvwal", "", "mem engine: path to kv WAL (default <data_dir>/kv_<id>.wal)")
+		kvsnap     = flag.String("kvsnap", "", "mem engine: path to kv snapshot (default <data_dir>/kv_<id>.snap.json)")
+		kvdir      = flag.String("kvdir", "", "disk/lsm engine: data directory (default <data_dir>/kv_<id>.<engine>)")
+		memtableB  = flag.Int("lsm_memtable_bytes", 4<<20, "lsm engine: flush the memtable to an SSTable past this size")
+		compactMin = flag.Int("lsm_compact_min", 4, "lsm engine: merge this many similarly sized tables at once")
+		snapI      = flag.Duration("snap_interval", 0, "snapshot/compaction interval (0 disables). blocks writes briefly (lsm: full compaction)")
+
+		gcGrace    = flag.Duration("gc_grace", 0, "purge tombstones and hints older than this (0 disables). must exceed the longest outage repaired by anti-entropy")
+		gcInterval = flag.Duration("gc_interval", time.Hour, "how often tombstone GC purges (only when some tombstones are past gc_grace)")
+		ttlSweep   = flag.Duration("ttl_sweep_interval", 30*time.Second, "how often expired TTL records are turned into tombstones (0 disables)")
+
+		maxSkew    = flag.Duration("max_clock_skew", 0, "records and peers whose clock is further ahead of ours than this are flagged or rejected (0 disables)")
+		skewAction = flag.String("clock_skew_action", "reject", "what to do with timestamps beyond --max_clock_skew: reject or flag")
+
+		serialPfx   = flag.String("serial_prefixes", "", "comma-separated key prefixes whose reads and writes always use serial (Paxos) consistency")
+		paxosRetain = flag.Duration("paxos_retain", time.Hour, "drop the Paxos state of keys with no serial operation for this long (0 keeps it forever)")
 
 		aeEnable   = flag.Bool("ae", true, "enable anti-entropy background sync")
 		aeInterval = flag.Duration("ae_interval", 1500*time.Millisecond, "anti-entropy interval")
 		aeMax      = flag.Int("ae_max", 200, "max keys repaired per anti-entropy tick")
+		aeDepth    = flag.Int("ae_tree_depth", 8, "merkle tree depth per ring range (2^depth leaves; must match across nodes)")
+
+		batchRecords = flag.Int("batch_records", transport.DefaultBatchRecords, "max records per batched internal request (hint delivery, anti-entropy, /kv/_batch)")
+		batchBytes   = flag.Int("batch_bytes", transport.DefaultBatchBytes, "max encoded bytes per batched internal request; larger batches are split")
+		binaryProto  = flag.Bool("binary_proto", true, "use the binary internal protocol with peers that advertise it (JSON otherwise)")
+
+		tlsCert = flag.String("tls_cert", "", "PEM certificate of this node, naming its node id as CN or DNS name; enables TLS with --tls_key and --tls_ca")
+		tlsKey  = flag.String("tls_key", "", "PEM private key for --tls_cert")
+		tlsCA   = flag.String("tls_ca", "", "PEM CA bundle that signs node certificates; /internal/ requires a client certificate from it")
+
+		aclFile    = flag.String("acl_file", "", "JSON file of API principals, their tokens and per-prefix grants; enables authentication on the client API")
+		secretFile = flag.String("internal_secret_file", "", "file holding a secret shared by all nodes; /internal/ requires it")
+
+		traceFile   = flag.String("trace_file", "", "append finished trace spans to this file as JSON lines")
+		traceOTLP   = flag.String("trace_otlp", "", "export trace spans to this OTLP/HTTP collector (e.g. http://localhost:4318)")
+		traceSample = flag.Float64("trace_sample", 1, "fraction of client requests to trace (0..1) when exporting spans")
+
+		gossipI      = flag.Duration("gossip_interval", 500*time.Millisecond, "gossip interval")
+		suspectAfter = flag.Duration("suspect_after", 2*time.Second, "mark a peer suspect after this long without heartbeat progress")
+		deadAfter    = flag.Duration("dead_after", 5*time.Second, "mark a peer dead after this long without heartbeat progress")
 	)
 	flag.Parse()
 
@@ -132,16 +181,116 @@ func main() {
 	if cfg.VNodes <= 0 {
 		log.Fatalf("vnodes must be > 0")
 	}
+	if len(cfg.Replication) > 0 {
+		if err := checkReplication(&cfg); err != nil {
+			log.Fatalf("bad config: %v", err)
+		}
+	}
 	if cfg.N <= 0 || cfg.N > len(cfg.Nodes) {
 		log.Fatalf("bad N=%d (nodes=%d)", cfg.N, len(cfg.Nodes))
 	}
 	if cfg.R <= 0 || cfg.R > cfg.N || cfg.W <= 0 || cfg.W > cfg.N {
 		log.Fatalf("bad quorum R=%d W=%d for N=%d", cfg.R, cfg.W, cfg.N)
 	}
+	if cfg.Quorum == "" {
+		cfg.Quorum = coordinator.QuorumSloppy
+	}
+	minPreferred, err := coordinator.ParseQuorum(cfg.Quorum, cfg.N)
+	if err != nil {
+		log.Fatalf("bad config: %v", err)
+	}
+	if cfg.Allocation != "" && cfg.Allocation != ring.AllocHash && cfg.Allocation != ring.AllocBalanced {
+		log.Fatalf("bad allocation=%q (want hash or balanced)", cfg.Allocation)
+	}
+	part, err := ring.NewPartitioner(cfg.Partitioner, cfg.Partitions)
+	if err != nil {
+		log.Fatalf("bad config: %v", err)
+	}
+	if cfg.Allocation == ring.AllocBalanced && !ring.IsTokenRing(part) {
+		log.Fatalf("bad config: allocation=balanced needs a token-ring partitioner (fnv or murmur3), not %s", part.Name())
+	}
+	if *aeDepth < 0 || *aeDepth > 16 {
+		log.Fatalf("bad ae_tree_depth=%d (want 0..16)", *aeDepth)
+	}
+	if *batchRecords < 1 || *batchBytes < 1 {
+		log.Fatalf("bad batch_records=%d batch_bytes=%d (want > 0)", *batchRecords, *batchBytes)
+	}
+	if *skewAction != "reject" && *skewAction != "flag" {
+		log.Fatalf("bad clock_skew_action=%q (want reject or flag)", *skewAction)
+	}
+	var certs *transport.Certs
+	if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		if *tlsCert == "" || *tlsKey == "" || *tlsCA == "" {
+			log.Fatalf("TLS needs all of --tls_cert, --tls_key and --tls_ca")
+		}
+		if certs, err = transport.LoadCerts(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			log.Fatalf("load TLS certificates: %v", err)
+		}
+	}
+
+	var g *guard
+	if *aclFile != "" {
+		acl, err := auth.Load(*aclFile)
+		if err != nil {
+			log.Fatalf("load ACL: %v", err)
+		}
+		g = &guard{acl: acl}
+	}
+	var secret string
+	if *secretFile != "" {
+		b, err := os.ReadFile(*secretFile)
+		if err != nil {
+			log.Fatalf("read internal secret: %v", err)
+		}
+		if secret = strings.TrimSpace(string(b)); secret == "" {
+			log.Fatalf("internal secret file %s is empty", *secretFile)
+		}
+	}
+	if *traceSample < 0 || *traceSample > 1 {
+		log.Fatalf("bad trace_sample=%v (want 0..1)", *traceSample)
+	}
+	exp, err := newExporter(*traceFile, *traceOTLP)
+	if err != nil {
+		log.Fatalf("tracing: %v", err)
+	}
+	if exp != nil {
+		tracing.SetDefault(tracing.New(*id, *traceSample, exp))
+	}
+
+	_ = os.MkdirAll(*dataDir, 0o755)
+
+	// The committed ring layout survives restarts; nodes.json only seeds it.
+	layoutPath := filepath.Join(*dataDir, fmt.Sprintf("ring_%s.json", *id))
+	layout := ring.Layout{
+		Version:     1,
+		Nodes:       cfg.Nodes,
+		VNodes:      cfg.VNodes,
+		Replication: cfg.Replication,
+		Allocation:  cfg.Allocation,
+		Partitioner: part.Name(),
+		Partitions:  cfg.Partitions,
+	}
+	saved, ok, err := ring.LoadLayout(layoutPath)
+	if err != nil {
+		log.Fatalf("load ring layout: %v", err)
+	}
+	var prior ring.Partitioner
+	if ok {
+		prior = priorPartitioner(*dataDir, *id, &saved)
+		layout = saved
+	} else {
+		prior = priorPartitioner(*dataDir, *id, nil)
+		layout = layout.Allocate(cfg.N)
+	}
+	// Keys are only found where they were placed: refuse a changed partitioner.
+	partPath := filepath.Join(*dataDir, fmt.Sprintf("partitioner_%s.json", *id))
+	if err := checkPartitioner(partPath, part, prior); err != nil {
+		log.Fatalf("partitioner: %v", err)
+	}
 
 	var self types.NodeInfo
 	found := false
-	for _, n := range cfg.Nodes {
+	for _, n := range layout.Nodes {
 		if n.ID == *id {
 			self = n
 			found = true
@@ -149,65 +298,152 @@ func main() {
 		}
 	}
 	if !found {
-		log.Fatalf("node id %q not found in config", *id)
-	}
-
-	nodesByID := make(map[string]types.NodeInfo, len(cfg.Nodes))
-	for _, n := range cfg.Nodes {
-		nodesByID[n.ID] = n
+		if *addr == "" {
+			log.Fatalf("node id %q not found in ring layout (pass --addr to start it for a join)", *id)
+		}
+		self = types.NodeInfo{ID: *id, Addr: *addr, DC: *dc, Rack: *rack}
 	}
 
-	_ = os.MkdirAll(*dataDir, 0o755)
-
 	// Ring + transport.
-	rg := ring.New(cfg.Nodes, cfg.VNodes)
-	tc := transport.NewClient(800 * time.Millisecond)
-
-	// === Step 5: KV durability (snapshot + WAL replay) ===
-	st := store.NewMem()
-
-	kvWalPath := *kvwal
-	if kvWalPath == "" {
-		kvWalPath = filepath.Join(*dataDir, fmt.Sprintf("kv_%s.wal", self.ID))
+	topo := ring.NewTopology(layout)
+	_, rg := topo.Current()
+	// Hybrid logical clock: record timestamps, advanced by all internal traffic.
+	clk := hlc.New(*maxSkew, *skewAction == "reject")
+	// A peer's certificate must name the node the ring places at its address.
+	peerAt := func(addr string) (string, bool) {
+		for _, a := range []string{addr, "http://" + addr, "https://" + addr} {
+			if n, ok := topo.NodeAt(a); ok {
+				return n.ID, true
+			}
+		}
+		return "", false
 	}
-	kvSnapPath := *kvsnap
-	if kvSnapPath == "" {
-		kvSnapPath = filepath.Join(*dataDir, fmt.Sprintf("kv_%s.snap.json", self.ID))
+	newClient := func(timeout time.Duration) *transport.Client {
+		c := transport.NewClient(timeout)
+		c.Clock = clk
+		c.BatchRecords, c.BatchBytes = *batchRecords, *batchBytes
+		c.JSONOnly = !*binaryProto
+		c.Secret = secret
+		if certs != nil {
+			c.UseTLS(certs, peerAt)
+		}
+		return c
 	}
-
-	if snap, err := store.LoadSnapshot(kvSnapPath); err != nil {
-		log.Fatalf("load snapshot: %v", err)
-	} else if snap != nil {
-		st.LoadAll(snap)
+	tc := newClient(800 * time.Millisecond)
+
+	// === Step 5: KV storage engine ===
+	var st store.Engine
+	switch *engine {
+	case "mem":
+		kvWalPath := *kvwal
+		if kvWalPath == "" {
+			kvWalPath = filepath.Join(*dataDir, fmt.Sprintf("kv_%s.wal", self.ID))
+		}
+		kvSnapPath := *kvsnap
+		if kvSnapPath == "" {
+			kvSnapPath = filepath.Join(*dataDir, fmt.Sprintf("kv_%s.snap.json", self.ID))
+		}
+		ms, err := store.OpenMem(kvWalPath, kvSnapPath)
+		if err != nil {
+			log.Fatalf("open mem engine: %v", err)
+		}
+		st = ms
+	case "disk", "lsm":
+		dir := *kvdir
+		if dir == "" {
+			dir = filepath.Join(*dataDir, fmt.Sprintf("kv_%s.%s", self.ID, *engine))
+		}
+		var err error
+		if *engine == "disk" {
+			st, err = store.OpenDisk(dir)
+		} else {
+			st, err = store.OpenLSM(dir, store.LSMConfig{MemtableBytes: *memtableB, CompactMin: *compactMin})
+		}
+		if err != nil {
+			log.Fatalf("open %s engine: %v", *engine, err)
+		}
+	default:
+		log.Fatalf("unknown --engine %q (want mem, disk or lsm)", *engine)
 	}
+	defer func() { _ = st.Close() }()
 
-	kvWAL, err := store.OpenWAL(kvWalPath)
+	// Named keyspaces keep their records in engines of their own, under
+	// <data_dir>/ks_<id>/<name>, so dropping one only deletes its files.
+	ksReg, err := keyspace.Open(filepath.Join(*dataDir, fmt.Sprintf("keyspaces_%s.json", self.ID)))
 	if err != nil {
-		log.Fatalf("open kv wal: %v", err)
+		log.Fatalf("load keyspaces: %v", err)
 	}
-	defer func() { _ = kvWAL.Close() }()
-
-	// Replay WAL into store (no WAL writes during replay).
-	if err := kvWAL.Replay(func(rec store.Record) { st.ApplyLWW(rec) }); err != nil {
-		log.Fatalf("replay kv wal: %v", err)
+	parts := store.NewPartitioned(st, keyspace.Of)
+	ksm := &keyspaces{
+		reg:   ksReg,
+		parts: parts,
+		dir:   filepath.Join(*dataDir, fmt.Sprintf("ks_%s", self.ID)),
+		open: func(dir string) (store.Engine, error) {
+			var (
+				e   store.Engine
+				err error
+			)
+			switch *engine {
+			case "mem":
+				e, err = store.OpenMem(filepath.Join(dir, "kv.wal"), filepath.Join(dir, "kv.snap.json"))
+			case "disk":
+				e, err = store.OpenDisk(dir)
+			default:
+				e, err = store.OpenLSM(dir, store.LSMConfig{MemtableBytes: *memtableB, CompactMin: *compactMin})
+			}
+			return e, err
+		},
+		topo: topo,
+		tc:   newClient(2 * time.Second),
+	}
+	if len(cfg.Replication) > 0 {
+		ksm.fixedN = cfg.N
+	}
+	if err := ksm.openAll(); err != nil {
+		log.Fatalf("open keyspaces: %v", err)
+	}
+	st = parts
+	sg := newSkewGuard(st, clk)
+	st = sg
+
+	// Merkle trees per replicated range, kept current by the store.
+	mt := merkle.NewIndex(rg, self.ID, cfg.N, *aeDepth)
+	for _, ks := range ksReg.Catalog().Keyspaces {
+		mt.AddKeyspace(ks.Name, ks.N)
+	}
+	ksm.mt = mt
+	if err := mt.Rebuild(rg, st); err != nil {
+		log.Fatalf("build merkle trees: %v", err)
 	}
 
-	// Attach WAL so future writes are durable.
-	st.AttachWAL(kvWAL)
-
-	// Optional periodic snapshot + WAL truncate.
+	// Optional periodic snapshot (mem: snapshot + WAL truncate; disk: log compaction).
 	if *snapI > 0 {
 		go func() {
 			t := time.NewTicker(*snapI)
 			defer t.Stop()
 			for range t.C {
-				if err := st.SnapshotAndResetWAL(kvSnapPath); err != nil {
+				if err := st.Snapshot(); err != nil {
 					log.Printf("snapshot: %v", err)
 				}
 			}
 		}()
 	}
 
+	// Gossip membership + failure detection. The committed layout rides along
+	// so nodes that missed a join/decommission commit catch up.
+	var rb *rebalancer
+	gm := membership.New(self, layout.Nodes, tc, membership.Config{
+		Interval:     *gossipI,
+		SuspectAfter: *suspectAfter,
+		DeadAfter:    *deadAfter,
+		Timeout:      800 * time.Millisecond,
+		Layout:       func() ring.Layout { l, _ := topo.Current(); return l },
+		Adopt:        func(l ring.Layout) { rb.adopt(l) },
+
+		Keyspaces:      ksReg.Catalog,
+		AdoptKeyspaces: ksm.adopt,
+	})
+
 	// === Step 3: durable hints + handoff loop ===
 	hwal := *hintwal
 	if hwal == "" {
@@ -218,7 +454,138 @@ func main() {
 		log.Fatalf("hint wal: %v", err)
 	}
 	defer func() { _ = hm.Close() }()
+	ksm.hm = hm
+	metrics.NewGaugeFunc("minidynamo_hints_queued", "Hints queued for delivery, by target node.", "target", func() map[string]float64 {
+		out := make(map[string]float64)
+		for t, n := range hm.CountByTarget() {
+			out[t] = float64(n)
+		}
+		return out
+	})
+
+	// Tombstone GC. Reads are served through a guard that hides old records
+	// while the node is stale (down longer than gc_grace, not yet repaired).
+	gcs := newGC(*gcGrace, ksm.shortestGrace(*gcGrace), *gcInterval, filepath.Join(*dataDir, fmt.Sprintf("alive_%s", self.ID)))
+	gcs.keyGrace = ksm.grace
+
+	// The store keeps the Merkle trees, the GC index and the expiry index
+	// current from here on; one scan fills the indexes.
+	expiries := newDueIndex()
+	st.Observe(func(key string, before, after []store.Record) {
+		mt.Update(key, before, after)
+		gcs.observe(key, before, after)
+		expiries.set(key, expiresAt(after))
+	})
+	if err := st.Scan("", func(key string, sibs []store.Record) bool {
+		gcs.observe(key, nil, sibs)
+		expiries.set(key, expiresAt(sibs))
+		return true
+	}); err != nil {
+		log.Fatalf("index tombstones and expiries: %v", err)
+	}
+
+	served := st
+	if gcs.enabled() {
+		served = guardedEngine{Engine: st, gc: gcs}
+		gcs.runOnce(st, hm)
+	}
+
+	// Coordinator.
+	coord := coordinator.New(self, topo, served, tc, hm, gm, coordinator.Config{
+		N:       cfg.N,
+		R:       cfg.R,
+		W:       cfg.W,
+		Timeout: 800 * time.Millisecond,
+
+		MinPreferred: minPreferred,
+		Replication:  ksm.replication,
+	})
+
+	// Paxos acceptor state for serial operations. It has its own log rather
+	// than living in the store: it is not a record that replicates, merges or
+	// expires, and the disk and LSM engines only hold records. Committed
+	// instances are pruned once idle for --paxos_retain.
+	paxosWal := filepath.Join(*dataDir, fmt.Sprintf("paxos_%s.wal", self.ID))
+	acc, err := paxos.Open(paxosWal)
+	if err != nil {
+		log.Fatalf("paxos wal: %v", err)
+	}
+	defer func() { _ = acc.Close() }()
+	coord.Paxos = acc
+	coord.Clock = clk
+	if *paxosRetain > 0 {
+		go func() {
+			t := time.NewTicker(min(*paxosRetain, time.Minute))
+			defer t.Stop()
+			for range t.C {
+				// Ballots count HLC time, which never runs behind the wall clock.
+				if _, err := acc.Prune(time.Now().Add(-*paxosRetain).UnixNano()); err != nil {
+					log.Printf("paxos prune: %v", err)
+				}
+			}
+		}()
+	}
+	serialPrefixes := splitPrefixes(*serialPfx)
+	defaultSpace := kvSpace{n: cfg.N, serial: serialPrefixes}
+
+	rb = &rebalancer{
+		self:       self,
+		n:          ksm.replicas(cfg.N),
+		topo:       topo,
+		st:         served,
+		hm:         hm,
+		gm:         gm,
+		mt:         mt,
+		tc:         newClient(5 * time.Minute),
+		layoutPath: layoutPath,
+		pageSize:   500,
+	}
+	go gm.Run(context.Background())
 
+	repair := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		return gcs.repair(ctx, self, st, topo, gm, newClient(5*time.Second), ksm.replicas(cfg.N))
+	}
+	if *ttlSweep > 0 {
+		go func() {
+			t := time.NewTicker(*ttlSweep)
+			defer t.Stop()
+			for range t.C {
+				if _, err := sweepExpired(st, expiries, time.Now().UnixNano()); err != nil {
+					log.Printf("ttl sweep: %v", err)
+				}
+			}
+		}()
+	}
+	if gcs.enabled() {
+		go func() {
+			// The alive mark and a stale node's repair retries keep a short
+			// period; purges wait for gc_interval.
+			every := min(gcs.interval, time.Minute)
+			t := time.NewTicker(every)
+			defer t.Stop()
+			last := time.Now()
+			for now := range t.C {
+				if now.Sub(last) >= gcs.interval {
+					gcs.runOnce(st, hm)
+					last = now
+				} else {
+					gcs.markAlive()
+				}
+				if gcs.isStale() {
+					if err := repair(); err != nil {
+						log.Printf("gc: repair: %v (retrying in %s)", err, every)
+					}
+				}
+			}
+		}()
+	}
+
+	// Hint batches can be large, so they do not share tc's 800ms timeout.
+	// Each tick sends a target at most hintBatches requests; the rest waits.
+	const hintBatches = 8
+	hc := newClient(5 * time.Second)
 	go func() {
 		t := time.NewTicker(400 * time.Millisecond)
 		defer t.Stop()
@@ -226,16 +593,42 @@ func main() {
 		for range t.C {
 			targets := hm.Targets()
 			for _, tid := range targets {
-				target, ok := nodesByID[tid]
-				if !ok {
+				target, ok := topo.Node(tid)
+				if ok && !gm.Alive(tid) {
 					continue
 				}
 				recs := hm.RecordsFor(tid)
+				if ok {
+					// Deliver in batches; a batch that fails whole leaves the rest for the next tick.
+					for n := 0; n < hintBatches && len(recs) > 0; n++ {
+						batch := recs[:min(len(recs), *batchRecords)]
+						recs = recs[len(batch):]
+						puts := make([]transport.PutRequest, len(batch))
+						for i, rec := range batch {
+							puts[i].Record = rec
+						}
+						ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+						delivered := 0
+						for i, err := range hc.PutBatch(ctx, baseURL(target.Addr), puts) {
+							hintDeliveries.Inc(result(err))
+							if err == nil {
+								hm.DeleteIfSame(tid, batch[i].Key, batch[i])
+								delivered++
+							}
+						}
+						cancel()
+						if delivered == 0 {
+							break
+						}
+					}
+					continue
+				}
 				for _, rec := range recs {
+					// Target left the ring: hand the record to the key's current owners.
 					ctx, cancel := context.WithTimeout(context.Background(), 800*time.Millisecond)
-					var resp transport.PutResponse
-					err := tc.PostJSON(ctx, baseURL(target.Addr)+"/internal/put", transport.PutRequest{Record: rec}, &resp)
+					_, err := coord.PutRecord(ctx, rec.Key, rec, coordinator.WriteOptions{})
 					cancel()
+					hintDeliveries.Inc(result(err))
 					if err == nil {
 						hm.DeleteIfSame(tid, rec.Key, rec)
 					}
@@ -247,46 +640,45 @@ func main() {
 		}
 	}()
 
-	// Coordinator.
-	coord := coordinator.New(self, rg, st, tc, hm, coordinator.Config{
-		N:        cfg.N,
-		R:        cfg.R,
-		W:        cfg.W,
-		NumNodes: len(cfg.Nodes),
-		Timeout:  800 * time.Millisecond,
-	})
-
 	// === Step 4: anti-entropy ===
 	ae := &aeStats{
 		enabled:    *aeEnable,
 		interval:   *aeInterval,
 		maxPerTick: *aeMax,
+		treeDepth:  *aeDepth,
 	}
 
 	if ae.enabled {
-		peers := make([]types.NodeInfo, 0, len(cfg.Nodes)-1)
-		for _, n := range cfg.Nodes {
-			if n.ID != self.ID {
-				peers = append(peers, n)
-			}
-		}
+		go func() {
+			t := time.NewTicker(ae.interval)
+			defer t.Stop()
 
-		if len(peers) > 0 {
-			go func() {
-				t := time.NewTicker(ae.interval)
-				defer t.Stop()
+			next := 0
+			for range t.C {
+				// Peers follow the committed layout, which can change at runtime.
+				cur, _ := topo.Current()
+				peers := make([]types.NodeInfo, 0, len(cur.Nodes))
+				for _, n := range cur.Nodes {
+					if n.ID != self.ID {
+						peers = append(peers, n)
+					}
+				}
+				if len(peers) == 0 {
+					continue
+				}
 
-				next := 0
-				for range t.C {
-					peer := peers[next%len(peers)]
-					next++
+				peer := peers[next%len(peers)]
+				next++
 
-					start := time.Now()
-					compared, pulled, runErr := runAntiEntropyOnce(tc, st, peer, ae.maxPerTick)
-					ae.setRun(peer.ID, time.Since(start), compared, pulled, runErr)
+				start := time.Now()
+				var skip func(string, []store.Meta) bool
+				if gcs.enabled() {
+					skip = gcs.purgeable
 				}
-			}()
-		}
+				res, runErr := runAntiEntropyOnce(tc, st, mt, peer, ae.maxPerTick, skip)
+				ae.setRun(peer.ID, time.Since(start), res, runErr)
+			}
+		}()
 	}
 
 	mux := http.NewServeMux()
@@ -296,50 +688,28 @@ func main() {
 	})
 
 	// Distributed KV
+	mux.HandleFunc("/kv", func(w http.ResponseWriter, r *http.Request) {
+		defaultSpace.route(w, r, coord, "")
+	})
+
 	mux.HandleFunc("/kv/", func(w http.ResponseWriter, r *http.Request) {
-		key := strings.TrimPrefix(r.URL.Path, "/kv/")
-		if key == "" {
-			http.Error(w, "missing key", http.StatusBadRequest)
+		defaultSpace.route(w, r, coord, strings.TrimPrefix(r.URL.Path, "/kv"))
+	})
+
+	// Named keyspaces: /ks/<name>/kv, /ks/<name>/kv/<key>
+	mux.HandleFunc("/ks/", func(w http.ResponseWriter, r *http.Request) {
+		name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/ks/"), "/")
+		rest, ok := strings.CutPrefix(rest, "kv")
+		if !ok {
+			http.NotFound(w, r)
 			return
 		}
-
-		switch r.Method {
-		case http.MethodPut:
-			val, err := io.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, "read body failed", http.StatusBadRequest)
-				return
-			}
-			if err := coord.Put(r.Context(), key, val); err != nil {
-				http.Error(w, err.Error(), http.StatusServiceUnavailable)
-				return
-			}
-			w.WriteHeader(http.StatusNoContent)
-
-		case http.MethodDelete:
-			if err := coord.Delete(r.Context(), key); err != nil {
-				http.Error(w, err.Error(), http.StatusServiceUnavailable)
-				return
-			}
-			w.WriteHeader(http.StatusNoContent)
-
-		case http.MethodGet:
-			rec, ok, err := coord.Get(r.Context(), key)
-			_ = rec
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusServiceUnavailable)
-				return
-			}
-			if !ok {
-				http.Error(w, "not found", http.StatusNotFound)
-				return
-			}
-			w.Header().Set("Content-Type", "application/octet-stream")
-			_, _ = w.Write(rec.Value)
-
-		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		ks, found := ksm.reg.Lookup(name)
+		if !found {
+			http.Error(w, fmt.Sprintf("no keyspace %q", name), http.StatusNotFound)
+			return
 		}
+		kvSpace{name: ks.Name, n: ks.N, ttl: time.Duration(ks.TTL), serial: serialPrefixes}.route(w, r, coord, rest)
 	})
 
 	// Internal replica APIs
@@ -350,8 +720,8 @@ func main() {
 		}
 
 		var req transport.PutRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "bad json", http.StatusBadRequest)
+		if err := transport.Decode(r, &req); err != nil {
+			http.Error(w, "bad body", http.StatusBadRequest)
 			return
 		}
 		if req.Record.Key == "" {
@@ -359,14 +729,20 @@ func main() {
 			return
 		}
 
-		st.PutLWW(req.Record)
+		if err := sg.admit(req.Record); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if _, err := sg.Engine.PutMerge(req.Record); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		if req.HintFor != "" {
 			hm.Add(req.HintFor, req.Record)
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(transport.PutResponse{OK: true})
+		transport.Encode(w, r, &transport.PutResponse{OK: true})
 	})
 
 	mux.HandleFunc("/internal/get", func(w http.ResponseWriter, r *http.Request) {
@@ -376,19 +752,111 @@ func main() {
 		}
 
 		var req transport.GetRequest
+		if err := transport.Decode(r, &req); err != nil || req.Key == "" {
+			http.Error(w, "bad body or missing key", http.StatusBadRequest)
+			return
+		}
+
+		sibs, ok := served.Get(req.Key)
+		if !ok {
+			transport.Encode(w, r, &transport.GetResponse{Found: false})
+			return
+		}
+		transport.Encode(w, r, &transport.GetResponse{Found: true, Siblings: sibs})
+	})
+
+	mux.HandleFunc("/internal/put_batch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req transport.PutBatchRequest
+		if err := transport.Decode(r, &req); err != nil {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+
+		resp := transport.PutBatchResponse{Errors: make([]string, len(req.Puts))}
+		for i, p := range req.Puts {
+			if p.Record.Key == "" {
+				resp.Errors[i] = "missing record.key"
+				continue
+			}
+			if err := sg.admit(p.Record); err != nil {
+				resp.Errors[i] = err.Error()
+				continue
+			}
+			if _, err := sg.Engine.PutMerge(p.Record); err != nil {
+				resp.Errors[i] = err.Error()
+				continue
+			}
+			if p.HintFor != "" {
+				hm.Add(p.HintFor, p.Record)
+			}
+		}
+		transport.Encode(w, r, &resp)
+	})
+
+	mux.HandleFunc("/internal/get_batch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req transport.GetBatchRequest
+		if err := transport.Decode(r, &req); err != nil {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+
+		resp := transport.GetBatchResponse{Results: make([]transport.GetResponse, len(req.Keys))}
+		for i, k := range req.Keys {
+			resp.Results[i].Siblings, resp.Results[i].Found = served.Get(k)
+		}
+		transport.Encode(w, r, &resp)
+	})
+
+	mux.HandleFunc("/internal/paxos", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req transport.PaxosRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
 			http.Error(w, "bad json or missing key", http.StatusBadRequest)
 			return
 		}
 
-		rec, ok := st.Get(req.Key)
-
+		resp, err := coord.HandlePaxos(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		if !ok {
-			_ = json.NewEncoder(w).Encode(transport.GetResponse{Found: false})
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	mux.HandleFunc("/internal/scan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		_ = json.NewEncoder(w).Encode(transport.GetResponse{Found: true, Record: rec})
+
+		var req transport.ScanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+
+		resp, err := coord.HandleScan(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
 	})
 
 	// Anti-entropy metadata endpoint
@@ -397,104 +865,369 @@ func main() {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		meta := st.KeysMeta()
+
+		var req transport.KeysRequest
+		if err := transport.Decode(r, &req); err != nil && err != io.EOF {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+
+		var meta map[string][]store.Meta
+		if len(req.Leaves) > 0 {
+			meta = leafMeta(mt, served, req.Leaves)
+		} else {
+			meta = served.KeysMeta()
+		}
+		transport.Encode(w, r, &transport.KeysResponse{Keys: meta})
+	})
+
+	// Merkle tree levels for anti-entropy descent
+	mux.HandleFunc("/internal/tree", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req transport.TreeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+
+		resp := transport.TreeResponse{Depth: mt.Depth(), Hashes: make([][]uint64, len(req.Queries))}
+		for i, q := range req.Queries {
+			resp.Hashes[i] = mt.Hashes(q.Keyspace, q.Range.End, req.Level, q.Nodes)
+		}
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(transport.KeysResponse{Keys: meta})
+		_ = json.NewEncoder(w).Encode(resp)
 	})
 
-	// Debug endpoints
-	mux.HandleFunc("/debug/hints", func(w http.ResponseWriter, r *http.Request) {
+	// Keyspace catalog pushed by the node that changed it
+	mux.HandleFunc("/internal/keyspaces", ksm.serveInternal)
+
+	// Gossip exchange: merge the caller's view, answer with ours
+	mux.HandleFunc("/internal/gossip", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req transport.GossipRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{
-			"count":   hm.Count(),
-			"targets": hm.Targets(),
-			"wal":     hwal,
-		})
+		_ = json.NewEncoder(w).Encode(gm.HandleGossip(req))
 	})
 
-	mux.HandleFunc("/debug/ae", func(w http.ResponseWriter, r *http.Request) {
+	// Layout changes: prepare / commit / abort a pending ring
+	mux.HandleFunc("/internal/ring", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req transport.RingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+
+		switch req.Op {
+		case "prepare":
+			if err := rb.prepare(req.Current, req.Next); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		case "commit":
+			if !rb.commit(req.Next.Version) {
+				http.Error(w, "layout version not pending", http.StatusConflict)
+				return
+			}
+		case "abort":
+			rb.abort(req.Next.Version)
+		default:
+			http.Error(w, "unknown op", http.StatusBadRequest)
+			return
+		}
+
+		cur, _ := topo.Current()
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(ae.snapshot())
+		_ = json.NewEncoder(w).Encode(transport.RingResponse{OK: true, Current: cur})
 	})
 
-	mux.HandleFunc("/debug/persist", func(w http.ResponseWriter, r *http.Request) {
-		ops, bytes := kvWAL.Stats()
+	// Serve one page of the keys a gaining node pulls from us
+	mux.HandleFunc("/internal/stream", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req transport.StreamRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.For == "" {
+			http.Error(w, "bad json or missing for", http.StatusBadRequest)
+			return
+		}
+		resp, err := rb.streamPage(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{
-			"kv_wal":        kvWalPath,
-			"kv_snapshot":   kvSnapPath,
-			"wal_ops":       ops,
-			"wal_bytes":     bytes,
-			"snapshot_tick": int64(*snapI / time.Millisecond),
-		})
+		_ = json.NewEncoder(w).Encode(resp)
 	})
 
-	listenAddr := self.Addr
-	if *listen != "" {
-		listenAddr = *listen
-	}
+	// Pull the ranges this node gains under the pending layout
+	mux.HandleFunc("/internal/rebalance", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	log.Printf("node %s listening on %s (advertise %s)", self.ID, listenAddr, self.Addr)
-	log.Fatal(http.ListenAndServe(listenAddr, mux))
-}
+		var req transport.TransitionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		moved, err := rb.pull(r.Context(), req.Version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(transport.TransitionResponse{Moved: moved})
+	})
 
-func runAntiEntropyOnce(tc *transport.Client, st *store.MemStore, peer types.NodeInfo, maxPull int) (compared int, pulled int, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1200*time.Millisecond)
-	defer cancel()
+	// Leaving node: push data and hints to the new owners
+	mux.HandleFunc("/internal/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	var kres transport.KeysResponse
-	if e := tc.PostJSON(ctx, baseURL(peer.Addr)+"/internal/keys", transport.KeysRequest{}, &kres); e != nil {
-		return 0, 0, e
-	}
+		var req transport.TransitionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		moved, err := rb.drain(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(transport.TransitionResponse{Moved: moved})
+	})
 
-	if maxPull <= 0 {
-		maxPull = 200
-	}
+	// Admin: join / decommission at runtime
+	mux.HandleFunc("/admin/join", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	local := st.KeysMeta()
+		var n types.NodeInfo
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil || n.ID == "" || n.Addr == "" {
+			http.Error(w, "bad json or missing id/addr", http.StatusBadRequest)
+			return
+		}
+		cur, _ := topo.Current()
+		if cur.Has(n.ID) {
+			http.Error(w, "node already in ring", http.StatusConflict)
+			return
+		}
 
-	for key, pm := range kres.Keys {
-		compared++
+		next := cur
+		next.Version++
+		next.Nodes = append(append([]types.NodeInfo(nil), cur.Nodes...), n)
+		next = next.Allocate(cfg.N)
+		if err := rb.change(r.Context(), next, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(next)
+	})
 
-		lm, ok := local[key]
-		needPull := false
+	mux.HandleFunc("/admin/decommission", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-		if !ok {
-			needPull = true
-		} else {
-			lr := store.Record{Ts: lm.Ts, WriterID: lm.WriterID}
-			pr := store.Record{Ts: pm.Ts, WriterID: pm.WriterID}
-			w := store.Newer(lr, pr)
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			http.Error(w, "bad json or missing id", http.StatusBadRequest)
+			return
+		}
+		cur, _ := topo.Current()
+		if !cur.Has(req.ID) {
+			http.Error(w, "node not in ring", http.StatusNotFound)
+			return
+		}
+		if len(cur.Nodes)-1 < cfg.N {
+			http.Error(w, fmt.Sprintf("cannot go below N=%d nodes", cfg.N), http.StatusConflict)
+			return
+		}
 
-			if !(lr.Ts == pr.Ts && lr.WriterID == pr.WriterID) &&
-				w.Ts == pr.Ts && w.WriterID == pr.WriterID {
-				needPull = true
+		next := cur
+		next.Version++
+		next.Nodes = nil
+		for _, n := range cur.Nodes {
+			if n.ID != req.ID {
+				next.Nodes = append(next.Nodes, n)
 			}
 		}
-
-		if !needPull {
-			continue
+		next = next.Allocate(cfg.N)
+		if err := dcCapacity(next.Nodes, next.Replication); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
 		}
+		if err := rb.change(r.Context(), next, req.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(next)
+	})
 
-		ctx2, cancel2 := context.WithTimeout(context.Background(), 1200*time.Millisecond)
-		var gres transport.GetResponse
-		e := tc.PostJSON(ctx2, baseURL(peer.Addr)+"/internal/get", transport.GetRequest{Key: key}, &gres)
-		cancel2()
-		if e != nil {
-			err = e
-			continue
+	// Admin: keyspaces
+	mux.HandleFunc("/admin/keyspaces", ksm.serveAdmin)
+	mux.HandleFunc("/admin/keyspaces/", ksm.serveAdmin)
+
+	// Full repair: reconcile records older than gc_grace with the other
+	// replicas. Runs automatically while the node is stale.
+	mux.HandleFunc("/admin/repair", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !gcs.enabled() {
+			http.Error(w, errRepairDisabled.Error(), http.StatusConflict)
+			return
 		}
-		if !gres.Found {
-			continue
+		if err := repair(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(gcs.snapshot())
+	})
 
-		st.PutLWW(gres.Record)
-		pulled++
+	// Prometheus metrics of the coordinator, hints, store and background loops
+	mux.Handle("/metrics", metrics.Default.Handler())
 
-		if pulled >= maxPull {
-			break
+	// Debug endpoints
+	mux.HandleFunc("/debug/ring", func(w http.ResponseWriter, r *http.Request) {
+		cur, _ := topo.Current()
+		out := map[string]any{"current": cur}
+		if next, _, ok := topo.Pending(); ok {
+			out["pending"] = next
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+
+	// Ring ownership: share of the keyspace each node replicates (?n=, default N).
+	mux.HandleFunc("/debug/ownership", func(w http.ResponseWriter, r *http.Request) {
+		n := cfg.N
+		if v := r.URL.Query().Get("n"); v != "" {
+			x, err := strconv.Atoi(v)
+			if err != nil || x < 1 {
+				http.Error(w, "bad n", http.StatusBadRequest)
+				return
+			}
+			n = x
+		}
+		cur, rg := topo.Current()
+		allocation := cur.Allocation
+		if allocation == "" {
+			allocation = ring.AllocHash
 		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"version":     cur.Version,
+			"n":           n,
+			"partitioner": rg.Partitioner().Config(),
+			"allocation":  allocation,
+			"nodes":       rg.Ownership(n),
+		})
+	})
+
+	mux.HandleFunc("/debug/members", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"self":    self.ID,
+			"members": gm.Members(),
+		})
+	})
+
+	mux.HandleFunc("/debug/hints", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"count":   hm.Count(),
+			"targets": hm.Targets(),
+			"wal":     hwal,
+		})
+	})
+
+	mux.HandleFunc("/debug/ae", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ae.snapshot())
+	})
+
+	mux.HandleFunc("/debug/gc", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(gcs.snapshot())
+	})
+
+	mux.HandleFunc("/debug/paxos", func(w http.ResponseWriter, r *http.Request) {
+		out := acc.Stats()
+		out["serial_prefixes"] = serialPrefixes
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+
+	mux.HandleFunc("/debug/clock", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(clk.Stats())
+	})
+
+	mux.HandleFunc("/debug/persist", func(w http.ResponseWriter, r *http.Request) {
+		out := st.Stats()
+		out["snapshot_tick"] = int64(*snapI / time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})
+
+	listenAddr := self.Addr
+	if *listen != "" {
+		listenAddr = *listen
 	}
 
-	return compared, pulled, err
+	log.Printf("node %s listening on %s (advertise %s)", self.ID, listenAddr, self.Addr)
+	// Internal traffic carries the hybrid logical clock both ways.
+	root := http.NewServeMux()
+	internal := transport.Clocked(clk, transport.Advertise(mux))
+	if certs != nil {
+		// Only nodes of the committed or pending ring may call /internal/,
+		// each from its own address.
+		internal = transport.RequireNode(func(id string) (string, bool) {
+			n, ok := topo.Node(id)
+			return n.Addr, ok
+		}, internal)
+	}
+	if secret != "" {
+		internal = transport.RequireSecret(secret, internal)
+	}
+	root.Handle("/internal/", internal)
+	root.Handle("/", g.wrap(mux))
+	if certs == nil {
+		log.Fatal(http.ListenAndServe(listenAddr, traceRequests(root)))
+	}
+	srv := &http.Server{Addr: listenAddr, Handler: traceRequests(root), TLSConfig: certs.ServerConfig()}
+	log.Fatal(srv.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,32 @@
+package main
+
+import "mini-dynamo/internal/metrics"
+
+// Metrics of the node's background loops. The coordinator, hints and store
+// packages declare their own; all of them are served at /metrics.
+var (
+	hintDeliveries = metrics.NewCounter("minidynamo_hint_deliveries_total",
+		"Hints delivered to their target (or to the key's new owners), by result: ok or error.", "result")
+
+	aeRuns = metrics.NewCounter("minidynamo_ae_runs_total",
+		"Anti-entropy rounds with a peer, by result: ok or error.", "result")
+	aeCompared = metrics.NewCounter("minidynamo_ae_keys_compared_total",
+		"Keys compared by anti-entropy under differing Merkle leaves.")
+	aePulled = metrics.NewCounter("minidynamo_ae_keys_pulled_total",
+		"Keys pulled from peers by anti-entropy.")
+	aeDivergent = metrics.NewCounter("minidynamo_ae_ranges_divergent_total",
+		"Ring ranges whose Merkle roots differed from a peer's.")
+	aeDuration = metrics.NewHistogram("minidynamo_ae_run_duration_seconds",
+		"Duration of anti-entropy rounds.", metrics.DefBuckets)
+
+	gcPurged = metrics.NewCounter("minidynamo_gc_purged_total",
+		"Tombstoned keys purged by GC past their gc_grace.")
+)
+
+// result labels an outcome for the counters above.
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"mini-dynamo/internal/ring"
+)
+
+// partitionerRecord is the partitioner a node's data was placed with, kept in
+// <data_dir>/partitioner_<id>.json.
+type partitionerRecord struct {
+	Partitioner string `json:"partitioner"`
+	Config      string `json:"config"`
+	Hash        string `json:"hash"` // ring.ConfigHash
+}
+
+func recordOf(p ring.Partitioner) partitionerRecord {
+	return partitionerRecord{Partitioner: p.Name(), Config: p.Config(), Hash: ring.ConfigHash(p)}
+}
+
+// checkPartitioner refuses to run with a partitioner other than the one the
+// node's data was written with: every key would be looked up on the wrong
+// replicas. A node without a record gets one. prior is what data already in
+// the data directory was placed with, nil for a fresh node.
+func checkPartitioner(path string, configured, prior ring.Partitioner) error {
+	want := recordOf(configured)
+
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		have := want
+		if prior != nil {
+			have = recordOf(prior)
+		}
+		if have.Hash != want.Hash {
+			return mismatch(have, want)
+		}
+		return writeRecord(path, want)
+	case err != nil:
+		return err
+	}
+
+	var have partitionerRecord
+	if err := json.Unmarshal(b, &have); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if have.Hash != want.Hash {
+		return mismatch(have, want)
+	}
+	return nil
+}
+
+// priorPartitioner returns what the data of node id in dataDir was placed
+// with when there is no record: the saved layout's partitioner, or FNV for
+// data from before partitioners were configurable. nil means a fresh node.
+func priorPartitioner(dataDir, id string, saved *ring.Layout) ring.Partitioner {
+	if saved != nil {
+		return saved.Partition()
+	}
+	for _, pattern := range []string{"*_" + id, "*_" + id + ".*"} {
+		if m, _ := filepath.Glob(filepath.Join(dataDir, pattern)); len(m) > 0 {
+			return ring.Layout{}.Partition()
+		}
+	}
+	return nil
+}
+
+func mismatch(have, want partitionerRecord) error {
+	return fmt.Errorf("data was written with partitioner %s (hash %s) but the config asks for %s (hash %s); "+
+		"keep the old partitioner or start from an empty data directory", have.Config, have.Hash, want.Config, want.Hash)
+}
+
+func writeRecord(path string, rec partitionerRecord) error {
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
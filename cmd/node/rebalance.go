@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"mini-dynamo/internal/hints"
+	"mini-dynamo/internal/membership"
+	"mini-dynamo/internal/merkle"
+	"mini-dynamo/internal/ring"
+	"mini-dynamo/internal/store"
+	"mini-dynamo/internal/transport"
+	"mini-dynamo/internal/types"
+)
+
+// rebalancer moves token ranges between nodes when the layout changes.
+//
+// A join or decommission runs in three steps driven by whichever node got the
+// admin call: prepare (every node installs the pending layout and coordinators
+// start copying writes to new owners), stream (nodes pull the keys they gain
+// from the committed owners; a leaving node also pushes its data and hints),
+// then commit (the pending layout becomes current and reads move over).
+type rebalancer struct {
+	self       types.NodeInfo
+	n          func(key string) int // replication factor of key's keyspace
+	topo       *ring.Topology
+	st         store.Engine
+	hm         *hints.Manager
+	gm         *membership.List
+	mt         *merkle.Index
+	tc         *transport.Client // long timeout: stream steps can take a while
+	layoutPath string
+	pageSize   int
+}
+
+func owns(rg ring.Ring, key string, n int, id string) bool {
+	for _, r := range rg.GetReplicas(key, n) {
+		if r.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// prepare installs next as the pending layout.
+func (rb *rebalancer) prepare(cur, next ring.Layout) error {
+	if err := rb.topo.Prepare(cur, next); err != nil {
+		return err
+	}
+	committed, _ := rb.topo.Current()
+	rb.gm.SetNodes(ring.Union(committed.Nodes, next.Nodes))
+	return nil
+}
+
+func (rb *rebalancer) commit(version uint64) bool {
+	_, prev := rb.topo.Current()
+	l, ok := rb.topo.Commit(version)
+	if ok {
+		rb.committed(prev, l)
+	}
+	return ok
+}
+
+func (rb *rebalancer) abort(version uint64) {
+	rb.topo.Abort(version)
+	cur, _ := rb.topo.Current()
+	rb.gm.SetNodes(cur.Nodes)
+}
+
+// adopt installs a newer committed layout learned through gossip.
+func (rb *rebalancer) adopt(l ring.Layout) {
+	_, prev := rb.topo.Current()
+	if rb.topo.Adopt(l) {
+		log.Printf("adopted ring layout version %d from gossip", l.Version)
+		rb.committed(prev, l)
+	}
+}
+
+// committed runs once l replaced the layout whose ring was prev.
+func (rb *rebalancer) committed(prev ring.Ring, l ring.Layout) {
+	if err := ring.SaveLayout(rb.layoutPath, l); err != nil {
+		log.Printf("save ring layout: %v", err)
+	}
+	rb.gm.SetNodes(l.Nodes)
+	if err := rb.mt.Rebuild(l.Ring(), rb.st); err != nil {
+		log.Printf("rebuild merkle trees: %v", err)
+	}
+	go rb.purgeMoved(prev, l.Version)
+}
+
+// purgeMoved drops the keys this node replicated under prev but no longer
+// does: their new owners streamed them before the commit. Keys it holds
+// only as a sloppy fallback are kept (their hints deliver them), and so are
+// keys a pending layout gives back to it.
+func (rb *rebalancer) purgeMoved(prev ring.Ring, version uint64) {
+	n, err := rb.st.Purge(func(key string, _ []store.Meta) bool {
+		_, cur := rb.topo.Current()
+		if !owns(prev, key, rb.n(key), rb.self.ID) || owns(cur, key, rb.n(key), rb.self.ID) {
+			return false
+		}
+		_, next, ok := rb.topo.Pending()
+		return !ok || !owns(next, key, rb.n(key), rb.self.ID)
+	})
+	if err != nil {
+		log.Printf("layout v%d: purge moved keys: %v", version, err)
+		return
+	}
+	if n > 0 {
+		log.Printf("layout v%d: purged %d keys this node no longer owns", version, n)
+	}
+}
+
+// streamPage serves one page of the keys req.For gains under the pending layout.
+func (rb *rebalancer) streamPage(req transport.StreamRequest) (transport.StreamResponse, error) {
+	_, cur := rb.topo.Current()
+	nextL, next, ok := rb.topo.Pending()
+	if !ok || nextL.Version != req.Version {
+		return transport.StreamResponse{}, fmt.Errorf("layout version %d is not pending", req.Version)
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = rb.pageSize
+	}
+
+	resp := transport.StreamResponse{}
+	keys := 0
+	err := rb.st.Scan(req.After, func(k string, sibs []store.Record) bool {
+		if k == req.After || !owns(next, k, rb.n(k), req.For) || owns(cur, k, rb.n(k), req.For) {
+			return true
+		}
+		if keys == limit {
+			resp.Next = resp.Records[len(resp.Records)-1].Key
+			return false
+		}
+		resp.Records = append(resp.Records, sibs...)
+		keys++
+		return true
+	})
+	return resp, err
+}
+
+// pull fetches every key this node gains under the pending layout from all
+// committed owners, so the union of their siblings lands here.
+func (rb *rebalancer) pull(ctx context.Context, version uint64) (int, error) {
+	cur, _ := rb.topo.Current()
+	if _, _, ok := rb.topo.Pending(); !ok {
+		return 0, fmt.Errorf("no pending layout")
+	}
+
+	moved := 0
+	for _, src := range cur.Nodes {
+		if src.ID == rb.self.ID {
+			continue
+		}
+		after := ""
+		for {
+			var resp transport.StreamResponse
+			req := transport.StreamRequest{Version: version, For: rb.self.ID, After: after, Limit: rb.pageSize}
+			if err := rb.tc.PostJSON(ctx, baseURL(src.Addr)+"/internal/stream", req, &resp); err != nil {
+				return moved, fmt.Errorf("stream from %s: %w", src.ID, err)
+			}
+			for _, rec := range resp.Records {
+				if _, err := rb.st.PutMerge(rec); err != nil && !errors.Is(err, store.ErrPartitionNotOpen) {
+					return moved, fmt.Errorf("store streamed %q: %w", rec.Key, err)
+				}
+				moved++
+			}
+			if resp.Next == "" {
+				break
+			}
+			after = resp.Next
+		}
+	}
+	return moved, nil
+}
+
+// drain pushes everything a leaving node holds to the key's owners under the
+// pending layout, then re-homes its outstanding hints on surviving nodes.
+func (rb *rebalancer) drain(ctx context.Context) (int, error) {
+	nextL, next, ok := rb.topo.Pending()
+	if !ok {
+		return 0, fmt.Errorf("no pending layout")
+	}
+
+	// Collect keys first: Scan blocks writes, so no network calls inside it.
+	var keys []string
+	if err := rb.st.Scan("", func(k string, _ []store.Record) bool {
+		keys = append(keys, k)
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	// Push a page of keys at a time, one batch per owner.
+	moved := 0
+	for len(keys) > 0 {
+		page := keys[:min(len(keys), rb.pageSize)]
+		keys = keys[len(page):]
+		batches := make(map[string][]transport.PutRequest)
+		for _, key := range page {
+			sibs, ok := rb.st.Get(key)
+			if !ok {
+				continue
+			}
+			for _, owner := range next.GetReplicas(key, rb.n(key)) {
+				if owner.ID == rb.self.ID {
+					continue
+				}
+				for _, rec := range sibs {
+					batches[owner.ID] = append(batches[owner.ID], transport.PutRequest{Record: rec})
+				}
+			}
+		}
+		for id, puts := range batches {
+			owner, _ := rb.topo.Node(id)
+			for i, err := range rb.tc.PutBatch(ctx, baseURL(owner.Addr), puts) {
+				if err != nil {
+					return moved, fmt.Errorf("push %q to %s: %w", puts[i].Record.Key, id, err)
+				}
+			}
+			moved += len(puts)
+		}
+	}
+
+	// The hinted records themselves were pushed with the data above; only
+	// targets that survive the change still need a hint.
+	handoff := make(map[string][]transport.PutRequest)
+	for _, target := range rb.hm.Targets() {
+		for _, rec := range rb.hm.RecordsFor(target) {
+			if !nextL.Has(target) {
+				rb.hm.DeleteIfSame(target, rec.Key, rec)
+				continue
+			}
+			if holder, ok := hintHolder(next, rec.Key, target, rb.self.ID); ok {
+				handoff[holder.ID] = append(handoff[holder.ID], transport.PutRequest{Record: rec, HintFor: target})
+			}
+		}
+	}
+	for id, puts := range handoff {
+		holder, _ := rb.topo.Node(id)
+		var failed error
+		for i, err := range rb.tc.PutBatch(ctx, baseURL(holder.Addr), puts) {
+			if err != nil {
+				if failed == nil {
+					failed = fmt.Errorf("hand off hint for %s to %s: %w", puts[i].HintFor, id, err)
+				}
+				continue
+			}
+			rb.hm.DeleteIfSame(puts[i].HintFor, puts[i].Record.Key, puts[i].Record)
+		}
+		if failed != nil {
+			return moved, failed
+		}
+	}
+	return moved, nil
+}
+
+// hintHolder picks the first node clockwise from key that is neither the hint
+// target nor the leaving node.
+func hintHolder(rg ring.Ring, key, target, leaving string) (types.NodeInfo, bool) {
+	for _, n := range rg.GetReplicas(key, len(rg.VNodes)) {
+		if n.ID != target && n.ID != leaving {
+			return n, true
+		}
+	}
+	return types.NodeInfo{}, false
+}
+
+// change drives a full layout change from this node. leaving is the
+// decommissioned node ID, or empty for a join.
+func (rb *rebalancer) change(ctx context.Context, next ring.Layout, leaving string) error {
+	cur, _ := rb.topo.Current()
+	// Nodes of cur, this one among them, prepare first, so each of them
+	// knows a joining node's address (and the identity its certificate
+	// must name) before it is contacted.
+	participants := ring.Union(cur.Nodes, next.Nodes)
+
+	post := func(n types.NodeInfo, path string, req any, resp any) error {
+		return rb.tc.PostJSON(ctx, baseURL(n.Addr)+path, req, resp)
+	}
+	abort := func() {
+		for _, n := range participants {
+			var resp transport.RingResponse
+			_ = post(n, "/internal/ring", transport.RingRequest{Op: "abort", Current: cur, Next: next}, &resp)
+		}
+	}
+
+	for _, n := range participants {
+		var resp transport.RingResponse
+		if err := post(n, "/internal/ring", transport.RingRequest{Op: "prepare", Current: cur, Next: next}, &resp); err != nil {
+			abort()
+			return fmt.Errorf("prepare on %s: %w", n.ID, err)
+		}
+	}
+
+	for _, n := range next.Nodes {
+		var resp transport.TransitionResponse
+		if err := post(n, "/internal/rebalance", transport.TransitionRequest{Version: next.Version}, &resp); err != nil {
+			abort()
+			return fmt.Errorf("stream to %s: %w", n.ID, err)
+		}
+		log.Printf("layout v%d: %s pulled %d records", next.Version, n.ID, resp.Moved)
+	}
+
+	if leaving != "" {
+		n, _ := rb.topo.Node(leaving)
+		var resp transport.TransitionResponse
+		if err := post(n, "/internal/drain", transport.TransitionRequest{Version: next.Version}, &resp); err != nil {
+			abort()
+			return fmt.Errorf("drain %s: %w", leaving, err)
+		}
+		log.Printf("layout v%d: %s pushed %d records", next.Version, leaving, resp.Moved)
+	}
+
+	var missed []string
+	for _, n := range participants {
+		var resp transport.RingResponse
+		if err := post(n, "/internal/ring", transport.RingRequest{Op: "commit", Current: cur, Next: next}, &resp); err != nil {
+			missed = append(missed, n.ID)
+		}
+	}
+	if len(missed) > 0 {
+		return fmt.Errorf("layout v%d committed but %v missed the commit (gossip will catch them up)", next.Version, missed)
+	}
+	return nil
+}
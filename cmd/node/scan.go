@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"mini-dynamo/internal/auth"
+	"mini-dynamo/internal/coordinator"
+)
+
+// scanItem is one key of a GET /kv scan page.
+type scanItem struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+	Ts        int64  `json:"ts"`
+	WriterID  string `json:"writer_id"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Siblings  int    `json:"siblings"` // live siblings; Value is the newest
+}
+
+// serveScan answers GET /kv?prefix=&start=&limit=&next=. next is the
+// continuation token of the previous page and takes precedence over start.
+// A scan covers the keys of one keyspace.
+func serveScan(w http.ResponseWriter, r *http.Request, coord *coordinator.Coordinator, s kvSpace) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	opts := coordinator.ScanOptions{Prefix: s.key(prefix)}
+	if !authorize(w, r, auth.Read, opts.Prefix) {
+		return
+	}
+	if start := q.Get("start"); start != "" {
+		opts.Start = s.key(start)
+	}
+	if s.name == "" && opts.Start < "\x01" {
+		opts.Start = "\x01" // past every named keyspace's keys
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "bad limit (want a positive count)", http.StatusBadRequest)
+			return
+		}
+		opts.Limit = limit
+	}
+	if tok := q.Get("next"); tok != "" {
+		after, err := base64.RawURLEncoding.DecodeString(tok)
+		if err != nil || len(after) == 0 {
+			http.Error(w, "bad next token", http.StatusBadRequest)
+			return
+		}
+		opts.After = s.key(string(after))
+	}
+
+	cl, err := parseConsistency(r, prefix, s.serial, s.n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.R, opts.Serial, opts.DC = cl.r, cl.serial, cl.dc
+
+	page, acks, err := coord.Scan(r.Context(), opts)
+	w.Header().Set(acksHeader, strconv.Itoa(acks))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	out := make([]scanItem, 0, len(page.Items))
+	for _, it := range page.Items {
+		out = append(out, scanItem{Key: s.clientKey(it.Key), Value: it.Value, Ts: it.Ts, WriterID: it.WriterID, ExpiresAt: it.ExpiresAt, Siblings: it.Siblings})
+	}
+	var next string
+	if page.Next != "" {
+		next = base64.RawURLEncoding.EncodeToString([]byte(s.clientKey(page.Next)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"items": out,
+		"next":  next,
+	})
+}
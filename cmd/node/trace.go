@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"mini-dynamo/internal/tracing"
+)
+
+// newExporter returns the span exporter the tracing flags ask for, nil if
+// tracing is off.
+func newExporter(file, otlp string) (tracing.Exporter, error) {
+	switch {
+	case file != "" && otlp != "":
+		return nil, fmt.Errorf("pass one of --trace_file and --trace_otlp")
+	case file != "":
+		return tracing.NewFileExporter(file)
+	case otlp != "":
+		return tracing.NewOTLPExporter(otlp)
+	}
+	return nil, nil
+}
+
+// traceRequests starts a trace for each key-value request and joins the
+// trace of every other request that carries a traceparent, such as the
+// /internal/ calls a coordinator makes for a client request.
+func traceRequests(next http.Handler) http.Handler {
+	roots := tracing.HTTPServer(spanName, true, next)
+	joins := tracing.HTTPServer(spanName, false, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := r.URL.Path; p == "/kv" || strings.HasPrefix(p, "/kv/") || strings.HasPrefix(p, "/ks/") {
+			roots.ServeHTTP(w, r)
+			return
+		}
+		joins.ServeHTTP(w, r)
+	})
+}
+
+// spanName names a request's span by method and route, with keys and
+// keyspace names left out: "GET /kv/{key}", "POST /ks/{keyspace}/kv/_batch".
+func spanName(r *http.Request) string {
+	p := r.URL.Path
+	if rest, ok := strings.CutPrefix(p, "/ks/"); ok {
+		_, rest, _ = strings.Cut(rest, "/")
+		p = "/ks/{keyspace}/" + rest
+	}
+	if head, key, ok := strings.Cut(p, "/kv/"); ok && key != "_batch" {
+		p = head + "/kv/{key}"
+	}
+	return r.Method + " " + p
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mini-dynamo/internal/store"
+)
+
+const ttlHeader = "X-TTL"
+
+// parseTTL reads a TTL from the X-TTL header or ?ttl= query parameter, as a
+// Go duration ("90s", "15m") or a whole number of seconds. Empty means none.
+func parseTTL(r *http.Request) (time.Duration, error) {
+	s := r.Header.Get(ttlHeader)
+	if s == "" {
+		s = r.URL.Query().Get("ttl")
+	}
+	return ttlValue(s)
+}
+
+// ttlValue parses a TTL as parseTTL does; empty means none.
+func ttlValue(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, serr := strconv.ParseInt(s, 10, 64)
+		if serr != nil {
+			return 0, fmt.Errorf("bad ttl %q", s)
+		}
+		if secs > math.MaxInt64/int64(time.Second) {
+			return 0, fmt.Errorf("ttl %q is too long (max %d seconds)", s, math.MaxInt64/int64(time.Second))
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("ttl must be positive, got %q", s)
+	}
+	return d, nil
+}
+
+// expiresAt is the earliest expiry among sibs' live values, or 0 if none
+// expires.
+func expiresAt(sibs []store.Record) int64 {
+	var at int64
+	for _, r := range sibs {
+		if !r.Deleted && r.ExpiresAt != 0 && (at == 0 || r.ExpiresAt < at) {
+			at = r.ExpiresAt
+		}
+	}
+	return at
+}
+
+// sweepExpired replaces every expired sibling of the keys due in the expiry
+// index with its expiry tombstone. Replicas sweep independently but produce
+// identical tombstones, so the result converges without any coordination;
+// gc_grace purges them later.
+func sweepExpired(st store.Engine, due *dueIndex, now int64) (int, error) {
+	var err error
+	n := 0
+	for _, key := range due.popDue(now) {
+		sibs, ok := st.Get(key)
+		if !ok {
+			continue
+		}
+		for _, r := range sibs {
+			if r.Deleted || !r.Expired(now) {
+				continue
+			}
+			if _, perr := st.PutMerge(store.ExpiryTombstone(r)); perr != nil {
+				if err == nil {
+					err = perr
+				}
+				continue
+			}
+			n++
+		}
+		// Values that expire later, or failed to sweep, stay due.
+		if sibs, ok := st.Get(key); ok {
+			due.set(key, expiresAt(sibs))
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,77 @@
+// Command ownership prints how much of the keyspace each node replicates,
+// from a cluster config (nodes.json) or a saved ring layout
+// (<data_dir>/ring_<id>.json).
+//
+//	go run ./cmd/ownership --config nodes.json
+//	go run ./cmd/ownership --config data/ring_n1.json --n 3
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	"mini-dynamo/internal/ring"
+)
+
+func main() {
+	var (
+		cfgp       = flag.String("config", "nodes.json", "cluster config or saved ring layout")
+		n          = flag.Int("n", 0, "replicas per key (default: the config's n, or the sum of its replication)")
+		allocation = flag.String("allocation", "", "override the token allocation: hash or balanced (ignores saved tokens)")
+	)
+	flag.Parse()
+
+	b, err := os.ReadFile(*cfgp)
+	if err != nil {
+		log.Fatalf("read %s: %v", *cfgp, err)
+	}
+	var cfg struct {
+		ring.Layout
+		N int `json:"n"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		log.Fatalf("parse %s: %v", *cfgp, err)
+	}
+	if len(cfg.Nodes) == 0 || cfg.VNodes <= 0 {
+		log.Fatalf("%s: need nodes and vnodes", *cfgp)
+	}
+
+	if *n == 0 {
+		*n = cfg.N
+	}
+	if *n == 0 {
+		for _, rf := range cfg.Replication {
+			*n += rf
+		}
+	}
+	if *n <= 0 {
+		log.Fatalf("no replica count in %s; pass --n", *cfgp)
+	}
+	l := cfg.Layout
+	if *allocation != "" {
+		l.Allocation, l.Tokens = *allocation, nil
+	}
+	if l.Tokens == nil {
+		l = l.Allocate(*n)
+	}
+	if l.Allocation == "" {
+		l.Allocation = ring.AllocHash
+	}
+
+	fmt.Printf("n=%d partitioner=%s allocation=%s vnodes/weight=%d\n\n", *n, l.Partition().Config(), l.Allocation, l.VNodes)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "node\tdc\tweight\tvnodes\towns %\ttarget %\tdeviation %\t")
+	for _, o := range l.Ring().Ownership(*n) {
+		dev := 0.0
+		if o.Target > 0 && math.Abs(o.Percent-o.Target) >= 0.005 {
+			dev = 100 * (o.Percent/o.Target - 1)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%g\t%d\t%.2f\t%.2f\t%+.1f\t\n", o.ID, o.DC, o.Weight, o.VNodes, o.Percent, o.Target, dev)
+	}
+	_ = tw.Flush()
+}
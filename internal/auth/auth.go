@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"mini-dynamo/internal/keyspace"
+)
+
+// Perm is an operation on keys a grant allows.
+type Perm string
+
+const (
+	Read   Perm = "read"
+	Write  Perm = "write"
+	Delete Perm = "delete"
+)
+
+// ErrUnauthenticated means a request carried no credentials, or ones that
+// match no principal.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Grant allows Perms on every key of Keyspace ("" is the default one)
+// starting with Prefix ("" is every key).
+type Grant struct {
+	Keyspace string `json:"keyspace,omitempty"`
+	Prefix   string `json:"prefix"`
+	Perms    []Perm `json:"perms"`
+}
+
+// Principal is a client of the API. It authenticates with one of its
+// tokens, or, over TLS, with a client certificate naming it as Common Name
+// or DNS name. Tokens are given in the clear or as "sha256:<hex digest>".
+type Principal struct {
+	Name   string   `json:"name"`
+	Tokens []string `json:"tokens,omitempty"`
+	Admin  bool     `json:"admin,omitempty"` // may call /admin/, /debug/ and /metrics
+	Grants []Grant  `json:"grants"`
+}
+
+// Can reports whether p may perform perm on key, an internal key naming its
+// keyspace. With key a prefix, it reports whether p may perform perm on
+// every key under it.
+func (p *Principal) Can(perm Perm, key string) bool {
+	ks, key := keyspace.Split(key)
+	for _, g := range p.Grants {
+		if g.Keyspace != ks || !strings.HasPrefix(key, g.Prefix) {
+			continue
+		}
+		for _, x := range g.Perms {
+			if x == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ACL maps credentials to principals.
+type ACL struct {
+	byToken map[[sha256.Size]byte]*Principal
+	byName  map[string]*Principal
+}
+
+// Load reads an ACL file: {"principals":[...]}.
+func Load(path string) (*ACL, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Principals []*Principal `json:"principals"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	a := &ACL{byToken: make(map[[sha256.Size]byte]*Principal), byName: make(map[string]*Principal)}
+	for _, p := range f.Principals {
+		if p.Name == "" {
+			return nil, fmt.Errorf("%s: principal without a name", path)
+		}
+		if _, dup := a.byName[p.Name]; dup {
+			return nil, fmt.Errorf("%s: principal %q listed twice", path, p.Name)
+		}
+		a.byName[p.Name] = p
+		for _, g := range p.Grants {
+			for _, x := range g.Perms {
+				if x != Read && x != Write && x != Delete {
+					return nil, fmt.Errorf("%s: principal %q: bad perm %q (want read, write or delete)", path, p.Name, x)
+				}
+			}
+		}
+		for _, t := range p.Tokens {
+			sum, err := tokenDigest(t)
+			if err != nil {
+				return nil, fmt.Errorf("%s: principal %q: %w", path, p.Name, err)
+			}
+			if q, dup := a.byToken[sum]; dup {
+				return nil, fmt.Errorf("%s: principals %q and %q share a token", path, q.Name, p.Name)
+			}
+			a.byToken[sum] = p
+		}
+	}
+	return a, nil
+}
+
+func tokenDigest(t string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	if h, ok := strings.CutPrefix(t, "sha256:"); ok {
+		b, err := hex.DecodeString(h)
+		if err != nil || len(b) != sha256.Size {
+			return sum, errors.New("bad sha256 token digest")
+		}
+		copy(sum[:], b)
+		return sum, nil
+	}
+	if t == "" {
+		return sum, errors.New("empty token")
+	}
+	return sha256.Sum256([]byte(t)), nil
+}
+
+// Token returns the credential of r: an "Authorization: Bearer" token or
+// an X-API-Key header.
+func Token(r *http.Request) string {
+	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(t)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// Authenticate finds the principal of r by its token, or else by its
+// client certificate. The TLS server has already verified the certificate
+// against the cluster CA.
+func (a *ACL) Authenticate(r *http.Request) (*Principal, error) {
+	if t := Token(r); t != "" {
+		// Looked up by digest, so the comparison does not leak the token.
+		if p, ok := a.byToken[sha256.Sum256([]byte(t))]; ok {
+			return p, nil
+		}
+		return nil, fmt.Errorf("%w: unknown token", ErrUnauthenticated)
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+			if p, ok := a.byName[name]; ok {
+				return p, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: certificate %q names no principal", ErrUnauthenticated, cert.Subject.CommonName)
+	}
+	return nil, fmt.Errorf("%w: no token", ErrUnauthenticated)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns ctx carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal WithPrincipal put in ctx, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
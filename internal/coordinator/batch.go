@@ -0,0 +1,342 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"mini-dynamo/internal/store"
+	"mini-dynamo/internal/tracing"
+	"mini-dynamo/internal/transport"
+	"mini-dynamo/internal/types"
+)
+
+// Batches read or write many keys with one internal RPC per replica instead
+// of one per key and replica. Keys are grouped by the nodes among their
+// preferred replicas; quorum is still counted per key, and each key gets its
+// own result. Serial and datacenter-aware levels are not supported.
+
+// BatchRead is the result of one key of GetBatch, as Get would return it.
+type BatchRead struct {
+	Siblings []store.Record
+	Found    bool
+	Acks     int
+	Err      error
+}
+
+// BatchWrite is one write of PutBatch: a put of Value, or a delete.
+type BatchWrite struct {
+	Key     string
+	Value   []byte
+	Delete  bool
+	TTL     time.Duration
+	Context store.VClock // causal context the client read, as for Put
+}
+
+// BatchWriteResult is the result of one BatchWrite, as Put would return it.
+type BatchWriteResult struct {
+	Record store.Record
+	Acks   int
+	Err    error
+}
+
+// errBatchLevel rejects consistency a batch cannot provide.
+func errBatchLevel(serial bool, dc string) error {
+	switch {
+	case serial:
+		return fmt.Errorf("%w: batches do not support serial consistency", ErrBadConsistency)
+	case dc != "":
+		return fmt.Errorf("%w: batches do not support %s", ErrBadConsistency, dc)
+	}
+	return nil
+}
+
+// replicaBatch is the share of a batch sent to one replica: indexes into
+// the batch's keys.
+type replicaBatch struct {
+	node types.NodeInfo
+	idx  []int
+}
+
+// groupByReplica adds key i to the batch of each node in nodes.
+func groupByReplica(batches map[string]*replicaBatch, nodes []types.NodeInfo, i int) {
+	for _, n := range nodes {
+		b, ok := batches[n.ID]
+		if !ok {
+			b = &replicaBatch{node: n}
+			batches[n.ID] = b
+		}
+		b.idx = append(b.idx, i)
+	}
+}
+
+// GetBatch reads keys like Get at opts.R, answering each key separately. The
+// error is for options the batch cannot run with; per-key failures are in
+// the results.
+func (c *Coordinator) GetBatch(ctx context.Context, keys []string, opts ReadOptions) ([]BatchRead, error) {
+	start := time.Now()
+	if err := errBatchLevel(opts.Serial, opts.DC); err != nil {
+		return nil, err
+	}
+
+	_, rg := c.Topo.Current()
+	out := make([]BatchRead, len(keys))
+	need := make([]int, len(keys))
+	batches := make(map[string]*replicaBatch)
+	pending := 0
+	for i, key := range keys {
+		rf, r, _ := c.replication(key)
+		var err error
+		if need[i], err = c.level(opts.R, r, rf); err != nil {
+			return nil, err
+		}
+		var live []types.NodeInfo
+		for _, n := range rg.GetReplicas(key, rf) {
+			if !c.dead(n) {
+				live = append(live, n)
+			}
+		}
+		if len(live) < need[i] {
+			out[i].Err = fmt.Errorf("read quorum impossible: live replicas=%d R=%d", len(live), need[i])
+			continue
+		}
+		groupByReplica(batches, live, i)
+		pending++
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Cfg.Timeout)
+	defer cancel()
+
+	type result struct {
+		batch *replicaBatch
+		resps []transport.GetResponse
+		err   error
+	}
+	ch := make(chan result, len(batches))
+	for _, b := range batches {
+		b := b
+		go func() {
+			ks := make([]string, len(b.idx))
+			for j, i := range b.idx {
+				ks[j] = keys[i]
+			}
+			resps, err := c.replicaGetBatch(ctx, b.node, ks)
+			ch <- result{batch: b, resps: resps, err: err}
+		}()
+	}
+
+	// Collect until every key has R answers or every replica has answered.
+	type reply struct {
+		node types.NodeInfo
+		sibs []store.Record
+	}
+	replies := make([][]reply, len(keys))
+	for range batches {
+		if pending == 0 {
+			break
+		}
+		r := <-ch
+		if r.err != nil {
+			continue
+		}
+		for j, i := range r.batch.idx {
+			if out[i].Acks >= need[i] {
+				continue
+			}
+			replies[i] = append(replies[i], reply{node: r.batch.node, sibs: r.resps[j].Siblings})
+			if out[i].Acks++; out[i].Acks == need[i] {
+				pending--
+			}
+		}
+	}
+
+	repairs := make(map[string]*repairBatch)
+	for i := range keys {
+		if out[i].Err != nil {
+			continue
+		}
+		if out[i].Acks < need[i] {
+			out[i].Err = fmt.Errorf("read quorum not reached: success=%d need=%d", out[i].Acks, need[i])
+			continue
+		}
+		var merged []store.Record
+		for _, r := range replies[i] {
+			merged = c.mergeReply(merged, r.sibs)
+		}
+		// Read repair, batched per replica like the reads.
+		for _, r := range replies[i] {
+			if missing := missingFrom(merged, r.sibs); len(missing) > 0 {
+				readRepairs.Inc()
+				rb, ok := repairs[r.node.ID]
+				if !ok {
+					rb = &repairBatch{node: r.node}
+					repairs[r.node.ID] = rb
+				}
+				rb.recs = append(rb.recs, missing...)
+			}
+		}
+		out[i].Siblings = merged
+		out[i].Found = len(store.Live(merged)) > 0
+	}
+	for _, rb := range repairs {
+		rb := rb
+		go func() {
+			ctx2, cancel2 := context.WithTimeout(tracing.Detach(ctx), c.Cfg.Timeout)
+			defer cancel2()
+			c.readRepair(ctx2, rb.node, rb.recs)
+		}()
+	}
+	for _, rd := range out {
+		if rd.Err != nil {
+			quorumFailures.Inc("get_batch")
+		}
+	}
+	opDuration.Since(start, "get_batch")
+	return out, nil
+}
+
+type repairBatch struct {
+	node types.NodeInfo
+	recs []store.Record
+}
+
+// PutBatch writes like Put at opts.W and opts.Quorum, one new version per
+// write; opts.Context and TTL are not used, and preconditions are an error
+// (checking them would take a read per key). The preferred replicas get one
+// batch each. Keys still short of W afterwards go on to sloppy fallbacks and
+// hints one by one, as PutRecord does.
+func (c *Coordinator) PutBatch(ctx context.Context, writes []BatchWrite, opts WriteOptions) ([]BatchWriteResult, error) {
+	start := time.Now()
+	if err := errBatchLevel(opts.Serial, opts.DC); err != nil {
+		return nil, err
+	}
+	if !opts.If.empty() {
+		return nil, errors.New("batches do not support preconditions")
+	}
+
+	_, rg := c.Topo.Current()
+	out := make([]BatchWriteResult, len(writes))
+	w := make([]int, len(writes))
+	minPref := make([]int, len(writes))
+	fallbacks := make([][]types.NodeInfo, len(writes))
+	failed := make([][]types.NodeInfo, len(writes))
+	batches := make(map[string]*replicaBatch)
+	for i, bw := range writes {
+		var err error
+		if w[i], minPref[i], err = c.writeQuorum(bw.Key, opts); err != nil {
+			return nil, err
+		}
+		rec := c.newVersion(bw.Key, bw.Context)
+		if bw.Delete {
+			rec.Deleted = true
+		} else {
+			rec.Value = bw.Value
+			rec.ExpiresAt = store.ExpiryFor(rec.Ts, bw.TTL)
+		}
+		out[i].Record = rec
+
+		order := rg.GetReplicas(bw.Key, len(rg.VNodes))
+		if len(order) == 0 {
+			out[i].Err = errors.New("no replicas available")
+			continue
+		}
+		prefN, _, _ := c.replication(bw.Key)
+		if prefN > len(order) {
+			prefN = len(order)
+		}
+		preferred := order[:prefN]
+		fallbacks[i] = order[prefN:]
+		c.shadowWrite(bw.Key, rec, preferred)
+
+		var live []types.NodeInfo
+		for _, n := range preferred {
+			if c.dead(n) {
+				failed[i] = append(failed[i], n)
+			} else {
+				live = append(live, n)
+			}
+		}
+		groupByReplica(batches, live, i)
+	}
+
+	ctx1, cancel1 := context.WithTimeout(ctx, c.Cfg.Timeout)
+	defer cancel1()
+
+	type result struct {
+		batch *replicaBatch
+		errs  []error
+	}
+	ch := make(chan result, len(batches))
+	for _, b := range batches {
+		b := b
+		go func() {
+			recs := make([]store.Record, len(b.idx))
+			for j, i := range b.idx {
+				recs[j] = out[i].Record
+			}
+			ch <- result{batch: b, errs: c.replicaPutBatch(ctx1, b.node, recs)}
+		}()
+	}
+	for range batches {
+		r := <-ch
+		for j, i := range r.batch.idx {
+			if r.errs[j] == nil {
+				out[i].Acks++
+			} else {
+				failed[i] = append(failed[i], r.batch.node)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range writes {
+		if out[i].Err != nil || out[i].Acks >= w[i] {
+			continue
+		}
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out[i].Acks, out[i].Err = c.sloppyPut(ctx, out[i].Record, out[i].Acks, w[i], minPref[i], failed[i], fallbacks[i])
+		}()
+	}
+	wg.Wait()
+	for _, wr := range out {
+		if wr.Err != nil {
+			quorumFailures.Inc("put_batch")
+		}
+	}
+	opDuration.Since(start, "put_batch")
+	return out, nil
+}
+
+func (c *Coordinator) replicaGetBatch(ctx context.Context, n types.NodeInfo, keys []string) ([]transport.GetResponse, error) {
+	if n.ID == c.Self.ID {
+		out := make([]transport.GetResponse, len(keys))
+		for i, k := range keys {
+			out[i].Siblings, out[i].Found = c.Store.Get(k)
+		}
+		return out, nil
+	}
+
+	return c.Client.GetBatch(ctx, baseURL(n.Addr), keys)
+}
+
+// replicaPutBatch writes recs to n and returns the error of each.
+func (c *Coordinator) replicaPutBatch(ctx context.Context, n types.NodeInfo, recs []store.Record) []error {
+	if n.ID == c.Self.ID {
+		errs := make([]error, len(recs))
+		for i, rec := range recs {
+			_, errs[i] = c.Store.PutMerge(rec)
+		}
+		return errs
+	}
+
+	puts := make([]transport.PutRequest, len(recs))
+	for i, rec := range recs {
+		puts[i].Record = rec
+	}
+	return c.Client.PutBatch(ctx, baseURL(n.Addr), puts)
+}
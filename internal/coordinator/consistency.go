@@ -0,0 +1,66 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrBadConsistency means a per-request R or W is outside 1..N.
+var ErrBadConsistency = errors.New("bad consistency level")
+
+// ReadOptions tunes a client read.
+type ReadOptions struct {
+	R      int    // replicas that must answer (0 = Config.R)
+	Serial bool   // linearizable read through Paxos (see serial.go); R is ignored
+	DC     string // DCLocal or DCEach (see datacenter.go); R is ignored
+}
+
+// level resolves a per-request replica count against n; 0 means def.
+func (c *Coordinator) level(v, def, n int) (int, error) {
+	if v == 0 {
+		return def, nil
+	}
+	if v < 1 || v > n {
+		return 0, fmt.Errorf("%w: %d replicas (want 1..%d)", ErrBadConsistency, v, n)
+	}
+	return v, nil
+}
+
+// Write quorum policies decide which acks count towards W. Under "sloppy"
+// any node on the ring can stand in for a failed preferred replica (the
+// first N from ring.GetReplicas) and keep a hint for it. "strict" counts only
+// preferred replicas. "preferred=K" needs at least K preferred acks; the rest
+// of W may come from fallbacks.
+const (
+	QuorumSloppy = "sloppy"
+	QuorumStrict = "strict"
+)
+
+// ParseQuorum returns how many preferred acks a quorum policy requires of a
+// write, given replication factor n. Strict needs n, which is capped at the
+// write's W.
+func ParseQuorum(policy string, n int) (int, error) {
+	switch {
+	case policy == QuorumSloppy:
+		return 0, nil
+	case policy == QuorumStrict:
+		return n, nil
+	case strings.HasPrefix(policy, "preferred="):
+		k, err := strconv.Atoi(strings.TrimPrefix(policy, "preferred="))
+		if err != nil || k < 1 || k > n {
+			return 0, fmt.Errorf("%w: quorum %q (want preferred=1..%d)", ErrBadConsistency, policy, n)
+		}
+		return k, nil
+	default:
+		return 0, fmt.Errorf("%w: quorum %q (want sloppy, strict or preferred=K)", ErrBadConsistency, policy)
+	}
+}
+
+func fallbackUse(minPref, w int) string {
+	if minPref >= w {
+		return "disabled by strict quorum"
+	}
+	return fmt.Sprintf("may cover only %d of W=%d", w-minPref, w)
+}
@@ -3,44 +3,71 @@ package coordinator
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"mini-dynamo/internal/hints"
+	"mini-dynamo/internal/hlc"
+	"mini-dynamo/internal/paxos"
 	"mini-dynamo/internal/ring"
 	"mini-dynamo/internal/store"
+	"mini-dynamo/internal/tracing"
 	"mini-dynamo/internal/transport"
 	"mini-dynamo/internal/types"
 )
 
 type Config struct {
-	N        int
-	R        int
-	W        int
-	NumNodes int
-	Timeout  time.Duration
+	N       int
+	R       int
+	W       int
+	Timeout time.Duration
+
+	// MinPreferred is how many of a write's W acks must come from the key's
+	// preferred replicas (see ParseQuorum). 0 is a fully sloppy quorum.
+	MinPreferred int
+
+	// Replication, if set, returns the N, R and W of keys that do not use
+	// the ones above (keys of a keyspace); ok is false for the others.
+	Replication func(key string) (n, r, w int, ok bool)
+}
+
+// Liveness is the failure detector's view of peers.
+type Liveness interface {
+	Dead(id string) bool
 }
 
 type Coordinator struct {
-	Self   types.NodeInfo
-	Ring   ring.Ring
-	Store  *store.MemStore
-	Client *transport.Client
-	Hints  *hints.Manager
-	Cfg    Config
+	Self    types.NodeInfo
+	Topo    *ring.Topology
+	Store   store.Engine
+	Client  *transport.Client
+	Hints   *hints.Manager
+	Members Liveness        // optional; nil means every node is tried
+	Paxos   *paxos.Acceptor // optional; nil disables serial operations
+	Clock   *hlc.Clock      // record timestamps; New starts one without a skew guard
+	Cfg     Config
 }
 
-func New(self types.NodeInfo, rg ring.Ring, st *store.MemStore, cl *transport.Client, hm *hints.Manager, cfg Config) *Coordinator {
+func New(self types.NodeInfo, topo *ring.Topology, st store.Engine, cl *transport.Client, hm *hints.Manager, lv Liveness, cfg Config) *Coordinator {
 	return &Coordinator{
-		Self:   self,
-		Ring:   rg,
-		Store:  st,
-		Client: cl,
-		Hints:  hm,
-		Cfg:    cfg,
+		Self:    self,
+		Topo:    topo,
+		Store:   st,
+		Client:  cl,
+		Hints:   hm,
+		Members: lv,
+		Clock:   hlc.New(0, false),
+		Cfg:     cfg,
 	}
 }
 
+// dead reports whether the failure detector has given up on n.
+// Self is never dead.
+func (c *Coordinator) dead(n types.NodeInfo) bool {
+	return c.Members != nil && n.ID != c.Self.ID && c.Members.Dead(n.ID)
+}
+
 func baseURL(addr string) string {
 	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
 		return addr
@@ -50,7 +77,9 @@ func baseURL(addr string) string {
 
 func (c *Coordinator) replicaPut(ctx context.Context, n types.NodeInfo, rec store.Record, hintFor string) error {
 	if n.ID == c.Self.ID {
-		c.Store.PutLWW(rec)
+		if _, err := c.Store.PutMerge(rec); err != nil {
+			return err
+		}
 		if hintFor != "" && c.Hints != nil {
 			c.Hints.Add(hintFor, rec)
 		}
@@ -58,49 +87,82 @@ func (c *Coordinator) replicaPut(ctx context.Context, n types.NodeInfo, rec stor
 	}
 
 	var resp transport.PutResponse
-	return c.Client.PostJSON(ctx,
+	return c.Client.Post(ctx,
 		baseURL(n.Addr)+"/internal/put",
-		transport.PutRequest{Record: rec, HintFor: hintFor},
+		&transport.PutRequest{Record: rec, HintFor: hintFor},
 		&resp,
 	)
 }
 
-func (c *Coordinator) replicaGet(ctx context.Context, n types.NodeInfo, key string) (store.Record, bool, error) {
+func (c *Coordinator) replicaGet(ctx context.Context, n types.NodeInfo, key string) ([]store.Record, bool, error) {
 	if n.ID == c.Self.ID {
-		rec, ok := c.Store.Get(key)
-		return rec, ok, nil
+		sibs, ok := c.Store.Get(key)
+		return sibs, ok, nil
 	}
 
 	var resp transport.GetResponse
-	err := c.Client.PostJSON(ctx,
+	err := c.Client.Post(ctx,
 		baseURL(n.Addr)+"/internal/get",
-		transport.GetRequest{Key: key},
+		&transport.GetRequest{Key: key},
 		&resp,
 	)
 	if err != nil {
-		return store.Record{}, false, err
+		return nil, false, err
 	}
-	return resp.Record, resp.Found, nil
+	return resp.Siblings, resp.Found, nil
+}
+
+// replicaSpan starts the span of a call to replica n.
+func replicaSpan(ctx context.Context, name string, n types.NodeInfo) (context.Context, *tracing.Span) {
+	ctx, sp := tracing.Start(ctx, name, tracing.Client)
+	sp.SetAttr("node", n.ID)
+	return ctx, sp
 }
 
-func sameVersion(a, b store.Record) bool {
-	return a.Ts == b.Ts && a.WriterID == b.WriterID
+// tick returns the next hybrid logical clock reading, used both as the
+// record timestamp and as this node's vector clock entry.
+func (c *Coordinator) tick() int64 {
+	return c.Clock.Now()
 }
 
-// PutRecord is the shared write path (supports tombstones too).
-func (c *Coordinator) PutRecord(ctx context.Context, key string, rec store.Record) error {
-	if c.Cfg.NumNodes <= 0 {
-		return fmt.Errorf("coordinator config missing NumNodes")
+// newVersion stamps a record that causally follows everything in causal.
+// Without a context the write is concurrent with any sibling it has not seen.
+func (c *Coordinator) newVersion(key string, causal store.VClock) store.Record {
+	ts := c.tick()
+	clock := causal.Clone()
+	clock[c.Self.ID] = uint64(ts)
+	return store.Record{
+		Key:      key,
+		Ts:       ts,
+		WriterID: c.Self.ID,
+		Clock:    clock,
 	}
+}
+
+// PutRecord is the shared write path (supports tombstones too). opts.W,
+// opts.Quorum and opts.DC override Config for this write; the rest of opts is
+// unused. It returns how many replicas acknowledged, fallbacks included.
+func (c *Coordinator) PutRecord(ctx context.Context, key string, rec store.Record, opts WriteOptions) (_ int, err error) {
+	ctx, sp := tracing.Start(ctx, "coordinator.put_record", tracing.Internal)
+	sp.SetAttr("key", key)
+	defer func() { sp.End(err) }()
+	if opts.DC != "" {
+		return c.putDC(ctx, key, rec, opts.DC)
+	}
+	w, minPref, err := c.writeQuorum(key, opts)
+	if err != nil {
+		return 0, err
+	}
+	_, rg := c.Topo.Current()
 
 	// Full unique node order around the ring (for sloppy quorum).
-	order := c.Ring.GetReplicas(key, c.Cfg.NumNodes)
+	order := rg.GetReplicas(key, len(rg.VNodes))
 	if len(order) == 0 {
-		return fmt.Errorf("no replicas available")
+		return 0, fmt.Errorf("no replicas available")
 	}
 
 	// Preferred replicas = first N.
-	prefN := c.Cfg.N
+	prefN, _, _ := c.replication(key)
 	if prefN > len(order) {
 		prefN = len(order)
 	}
@@ -110,6 +172,8 @@ func (c *Coordinator) PutRecord(ctx context.Context, key string, rec store.Recor
 		fallbacks = order[prefN:]
 	}
 
+	c.shadowWrite(key, rec, preferred)
+
 	// Phase 1: preferred replicas in parallel.
 	ctx1, cancel1 := context.WithTimeout(ctx, c.Cfg.Timeout)
 	defer cancel1()
@@ -120,36 +184,85 @@ func (c *Coordinator) PutRecord(ctx context.Context, key string, rec store.Recor
 	}
 	ch := make(chan res, len(preferred))
 
+	// Known-dead preferred replicas fail up front instead of costing a timeout.
+	failedPreferred := make([]types.NodeInfo, 0, len(preferred))
+	sent := 0
 	for _, n := range preferred {
+		if c.dead(n) {
+			failedPreferred = append(failedPreferred, n)
+			continue
+		}
 		n := n
+		sent++
 		go func() {
-			ch <- res{node: n, err: c.replicaPut(ctx1, n, rec, "")}
+			ctx, sp := replicaSpan(ctx1, "replica.put", n)
+			err := c.replicaPut(ctx, n, rec, "")
+			sp.End(err)
+			ch <- res{node: n, err: err}
 		}()
 	}
 
 	acks := 0
-	failedPreferred := make([]types.NodeInfo, 0, len(preferred))
 
-	for i := 0; i < len(preferred); i++ {
+	for i := 0; i < sent; i++ {
 		r := <-ch
 		if r.err == nil {
 			acks++
-			if acks >= c.Cfg.W {
+			if acks >= w {
 				cancel1()
-				return nil
+				return acks, nil
 			}
 		} else {
 			failedPreferred = append(failedPreferred, r.node)
 		}
 	}
 
-	// Phase 2: sloppy quorum fallbacks + hinted handoff.
-	need := c.Cfg.W - acks
+	return c.sloppyPut(ctx, rec, acks, w, minPref, failedPreferred, fallbacks)
+}
+
+// replication returns the N, R and W of key.
+func (c *Coordinator) replication(key string) (n, r, w int) {
+	if c.Cfg.Replication != nil {
+		if n, r, w, ok := c.Cfg.Replication(key); ok {
+			return n, r, w
+		}
+	}
+	return c.Cfg.N, c.Cfg.R, c.Cfg.W
+}
+
+// writeQuorum resolves a write's W and how many of its acks must come from
+// preferred replicas.
+func (c *Coordinator) writeQuorum(key string, opts WriteOptions) (w, minPref int, err error) {
+	rf, _, defW := c.replication(key)
+	if w, err = c.level(opts.W, defW, rf); err != nil {
+		return 0, 0, err
+	}
+	minPref = c.Cfg.MinPreferred
+	if opts.Quorum != "" {
+		if minPref, err = ParseQuorum(opts.Quorum, rf); err != nil {
+			return 0, 0, err
+		}
+	}
+	if minPref > w {
+		minPref = w
+	}
+	return w, minPref, nil
+}
+
+// sloppyPut is phase 2 of a write that got acks from the preferred replicas:
+// sloppy quorum fallbacks + hinted handoff for the failed ones, unless the
+// policy wants more preferred acks than we got. The fallback writes outlive
+// ctx's deadline but stay in its trace.
+func (c *Coordinator) sloppyPut(ctx context.Context, rec store.Record, acks, w, minPref int, failedPreferred, fallbacks []types.NodeInfo) (int, error) {
+	need := w - acks
 	if need <= 0 {
-		return nil
+		return acks, nil
+	}
+	if acks < minPref {
+		return acks, fmt.Errorf("write quorum not reached: preferred acks=%d need=%d (sloppy fallbacks %s)", acks, minPref, fallbackUse(minPref, w))
 	}
 	if len(fallbacks) == 0 {
-		return fmt.Errorf("write quorum not reached: acks=%d need=%d (no fallbacks)", acks, c.Cfg.W)
+		return acks, fmt.Errorf("write quorum not reached: acks=%d need=%d (no fallbacks)", acks, w)
 	}
 
 	failedIDs := make([]string, 0, len(failedPreferred))
@@ -157,11 +270,14 @@ func (c *Coordinator) PutRecord(ctx context.Context, key string, rec store.Recor
 		failedIDs = append(failedIDs, n.ID)
 	}
 
-	ctx2, cancel2 := context.WithTimeout(context.Background(), c.Cfg.Timeout)
+	ctx2, cancel2 := context.WithTimeout(tracing.Detach(ctx), c.Cfg.Timeout)
 	defer cancel2()
 
 	for i := 0; i < len(fallbacks) && need > 0; i++ {
 		fb := fallbacks[i]
+		if c.dead(fb) {
+			continue
+		}
 
 		hintFor := ""
 		if len(failedIDs) > 0 {
@@ -169,46 +285,129 @@ func (c *Coordinator) PutRecord(ctx context.Context, key string, rec store.Recor
 			failedIDs = failedIDs[1:]
 		}
 
-		if err := c.replicaPut(ctx2, fb, rec, hintFor); err == nil {
+		ctx, sp := replicaSpan(ctx2, "replica.put.fallback", fb)
+		sp.SetAttr("hint_for", hintFor)
+		err := c.replicaPut(ctx, fb, rec, hintFor)
+		sp.End(err)
+		if err == nil {
+			sloppyWrites.Inc()
 			acks++
 			need--
-			if acks >= c.Cfg.W {
-				return nil
+			if acks >= w {
+				return acks, nil
 			}
 		}
 	}
 
-	return fmt.Errorf("write quorum not reached: acks=%d need=%d", acks, c.Cfg.W)
+	return acks, fmt.Errorf("write quorum not reached: acks=%d need=%d", acks, w)
 }
 
-// Normal PUT (non-delete)
-func (c *Coordinator) Put(ctx context.Context, key string, value []byte) error {
-	rec := store.Record{
-		Key:      key,
-		Value:    value,
-		Ts:       time.Now().UnixNano(),
-		WriterID: c.Self.ID,
-		Deleted:  false,
+// shadowWrite copies rec to nodes that only own key under the pending layout,
+// so they do not miss writes made while ranges are streaming to them.
+// It does not count towards W; failures become local hints.
+func (c *Coordinator) shadowWrite(key string, rec store.Record, preferred []types.NodeInfo) {
+	_, next, ok := c.Topo.Pending()
+	if !ok {
+		return
+	}
+
+	have := make(map[string]bool, len(preferred))
+	for _, n := range preferred {
+		have[n.ID] = true
+	}
+	rf, _, _ := c.replication(key)
+	for _, n := range next.GetReplicas(key, rf) {
+		if have[n.ID] {
+			continue
+		}
+		n := n
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), c.Cfg.Timeout)
+			defer cancel()
+			if err := c.replicaPut(ctx, n, rec, ""); err != nil && c.Hints != nil {
+				c.Hints.Add(n.ID, rec)
+			}
+		}()
 	}
-	return c.PutRecord(ctx, key, rec)
+}
+
+// Normal PUT (non-delete). opts.Context is the context the client read;
+// siblings it covers are collapsed into this write. A positive TTL makes the
+// value expire; expired values read as not found. Returns the written version
+// and how many replicas acknowledged it.
+func (c *Coordinator) Put(ctx context.Context, key string, value []byte, opts WriteOptions) (_ store.Record, _ int, err error) {
+	defer func(start time.Time) { observe("put", start, err) }(time.Now())
+	if opts.Serial {
+		return c.serialWrite(ctx, key, opts, func(rec *store.Record) {
+			rec.Value = value
+			rec.ExpiresAt = store.ExpiryFor(rec.Ts, opts.TTL)
+		})
+	}
+	causal, err := c.causalFor(ctx, key, opts)
+	if err != nil {
+		return store.Record{}, 0, err
+	}
+	rec := c.newVersion(key, causal)
+	rec.Value = value
+	rec.ExpiresAt = store.ExpiryFor(rec.Ts, opts.TTL)
+	acks, err := c.PutRecord(ctx, key, rec, opts)
+	return rec, acks, err
 }
 
 // DELETE = tombstone write
-func (c *Coordinator) Delete(ctx context.Context, key string) error {
-	rec := store.Record{
-		Key:      key,
-		Value:    nil,
-		Ts:       time.Now().UnixNano(),
-		WriterID: c.Self.ID,
-		Deleted:  true,
+func (c *Coordinator) Delete(ctx context.Context, key string, opts WriteOptions) (_ int, err error) {
+	defer func(start time.Time) { observe("delete", start, err) }(time.Now())
+	if opts.Serial {
+		_, acks, err := c.serialWrite(ctx, key, opts, func(rec *store.Record) { rec.Deleted = true })
+		return acks, err
+	}
+	causal, err := c.causalFor(ctx, key, opts)
+	if err != nil {
+		return 0, err
 	}
-	return c.PutRecord(ctx, key, rec)
+	rec := c.newVersion(key, causal)
+	rec.Deleted = true
+	return c.PutRecord(ctx, key, rec, opts)
 }
 
-func (c *Coordinator) Get(ctx context.Context, key string) (store.Record, bool, error) {
-	replicas := c.Ring.GetReplicas(key, c.Cfg.N)
-	if len(replicas) < c.Cfg.R {
-		return store.Record{}, false, fmt.Errorf("read quorum impossible: replicas=%d R=%d", len(replicas), c.Cfg.R)
+// Get returns every concurrent sibling for key (tombstones included, so the
+// caller can build a causal context). found is false when no sibling is live
+// (every one is a tombstone or expired). acks is how many replicas answered.
+func (c *Coordinator) Get(ctx context.Context, key string, opts ReadOptions) (_ []store.Record, _ bool, _ int, err error) {
+	defer func(start time.Time) { observe("get", start, err) }(time.Now())
+	ctx, sp := tracing.Start(ctx, "coordinator.get", tracing.Internal)
+	sp.SetAttr("key", key)
+	defer func() { sp.End(err) }()
+	if opts.Serial {
+		return c.serialGet(ctx, key)
+	}
+	rf, r, _ := c.replication(key)
+	need, err := c.level(opts.R, r, rf)
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	replicas := make([]types.NodeInfo, 0, rf)
+	// During a layout change the committed owners keep serving reads until
+	// the new owners have streamed their ranges and the layout is committed.
+	_, rg := c.Topo.Current()
+	preferred := rg.GetReplicas(key, rf)
+	var q *dcQuorum
+	if opts.DC != "" {
+		if q, err = c.newDCQuorum(opts.DC, preferred); err != nil {
+			return nil, false, 0, err
+		}
+	}
+	for _, n := range preferred {
+		if !c.dead(n) && (q == nil || q.wants(n)) {
+			replicas = append(replicas, n)
+		}
+	}
+	if q != nil && !q.possible(replicas) {
+		return nil, false, 0, fmt.Errorf("read quorum impossible: live replicas=%d (%s)", len(replicas), q)
+	}
+	if q == nil && len(replicas) < need {
+		return nil, false, 0, fmt.Errorf("read quorum impossible: live replicas=%d R=%d", len(replicas), need)
 	}
 
 	ctx, cancel := context.WithTimeout(ctx, c.Cfg.Timeout)
@@ -216,7 +415,7 @@ func (c *Coordinator) Get(ctx context.Context, key string) (store.Record, bool,
 
 	type result struct {
 		node  types.NodeInfo
-		rec   store.Record
+		sibs  []store.Record
 		found bool
 		err   error
 	}
@@ -225,73 +424,105 @@ func (c *Coordinator) Get(ctx context.Context, key string) (store.Record, bool,
 	for _, n := range replicas {
 		n := n
 		go func() {
-			rec, found, err := c.replicaGet(ctx, n, key)
-			ch <- result{node: n, rec: rec, found: found, err: err}
+			ctx, sp := replicaSpan(ctx, "replica.get", n)
+			sibs, found, err := c.replicaGet(ctx, n, key)
+			sp.End(err)
+			ch <- result{node: n, sibs: sibs, found: found, err: err}
 		}()
 	}
 
-	// Collect R successful responses.
+	// Collect R successful responses, or a quorum per datacenter.
 	success := 0
-	resps := make([]result, 0, c.Cfg.R)
+	resps := make([]result, 0, need)
+	enough := func() bool {
+		if q != nil {
+			return q.met()
+		}
+		return success >= need
+	}
 
-	for i := 0; i < len(replicas) && success < c.Cfg.R; i++ {
+	for i := 0; i < len(replicas) && !enough(); i++ {
 		r := <-ch
 		if r.err == nil {
 			success++
 			resps = append(resps, r)
+			if q != nil {
+				q.ack(r.node)
+			}
 		}
 	}
 
-	if success < c.Cfg.R {
-		return store.Record{}, false, fmt.Errorf("read quorum not reached: success=%d need=%d", success, c.Cfg.R)
+	if q != nil && !q.met() {
+		return nil, false, success, fmt.Errorf("read quorum not reached: %s", q)
+	}
+	if q == nil && success < need {
+		return nil, false, success, fmt.Errorf("read quorum not reached: success=%d need=%d", success, need)
 	}
 
-	// Resolve winner via LWW among found responses.
-	var winner store.Record
-	haveWinner := false
+	// Resolve siblings via causal merge across found responses. Versions
+	// stamped too far in the future are dropped if the skew guard rejects them.
+	var merged []store.Record
 	for _, r := range resps {
-		if !r.found {
-			continue
-		}
-		if !haveWinner {
-			winner = r.rec
-			haveWinner = true
-		} else {
-			winner = store.Newer(winner, r.rec)
+		if r.found {
+			merged = c.mergeReply(merged, r.sibs)
 		}
 	}
 
-	if !haveWinner {
-		return store.Record{}, false, nil
+	if len(merged) == 0 {
+		return nil, false, success, nil
 	}
 
-	// Read repair (best-effort), INCLUDING tombstones.
+	// Read repair (best-effort), INCLUDING tombstones: push every merged
+	// sibling the replica does not already cover.
 	for _, r := range resps {
-		needsRepair := false
-
-		if !r.found {
-			needsRepair = true
-		} else {
-			best := store.Newer(r.rec, winner)
-			if sameVersion(best, winner) && !sameVersion(r.rec, winner) {
-				needsRepair = true
-			}
-		}
-
-		if needsRepair {
+		if missing := missingFrom(merged, r.sibs); len(missing) > 0 {
+			readRepairs.Inc()
 			n := r.node
 			go func() {
-				ctx2, cancel2 := context.WithTimeout(context.Background(), c.Cfg.Timeout)
+				ctx2, cancel2 := context.WithTimeout(tracing.Detach(ctx), c.Cfg.Timeout)
 				defer cancel2()
-				_ = c.replicaPut(ctx2, n, winner, "")
+				c.readRepair(ctx2, n, missing)
 			}()
 		}
 	}
 
-	// Tombstone means "logically not found"
-	if winner.Deleted {
-		return winner, false, nil
+	// Tombstones mean "logically not found" once no live sibling remains.
+	return merged, len(store.Live(merged)) > 0, success, nil
+}
+
+// mergeReply folds one replica's siblings into merged. Versions stamped too
+// far in the future are dropped if the skew guard rejects them.
+func (c *Coordinator) mergeReply(merged, sibs []store.Record) []store.Record {
+	for _, rec := range sibs {
+		if c.Clock.Observe(rec.Ts) != nil {
+			continue
+		}
+		merged, _ = store.MergeSiblings(merged, rec)
 	}
+	return merged
+}
 
-	return winner, true, nil
+// missingFrom returns the merged siblings a replica holding have lacks.
+func missingFrom(merged, have []store.Record) []store.Record {
+	var missing []store.Record
+	for _, rec := range merged {
+		if _, changed := store.MergeSiblings(have, rec); changed {
+			missing = append(missing, rec)
+		}
+	}
+	return missing
+}
+
+// readRepair pushes missing to replica n, best-effort.
+func (c *Coordinator) readRepair(ctx context.Context, n types.NodeInfo, missing []store.Record) {
+	ctx, sp := replicaSpan(ctx, "read_repair", n)
+	sp.SetAttr("records", strconv.Itoa(len(missing)))
+	var err error
+	for _, e := range c.replicaPutBatch(ctx, n, missing) {
+		if e != nil {
+			err = e
+			break
+		}
+	}
+	sp.End(err)
 }
@@ -0,0 +1,155 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"mini-dynamo/internal/store"
+	"mini-dynamo/internal/types"
+)
+
+// Datacenter-aware levels count acks per datacenter (types.NodeInfo.DC)
+// among the key's preferred replicas; a datacenter's quorum is a majority of
+// its replicas. LOCAL_QUORUM waits only on the coordinator's datacenter, so a
+// request never waits on a cross-DC round trip; EACH_QUORUM waits on every
+// datacenter holding replicas. Neither uses sloppy fallbacks: a write still
+// goes to every preferred replica, and one that is down gets a hint.
+const (
+	DCLocal = "local_quorum"
+	DCEach  = "each_quorum"
+)
+
+// dcQuorum tracks the acks a datacenter-aware request still needs.
+type dcQuorum struct {
+	need map[string]int // datacenter -> acks still missing
+}
+
+func (c *Coordinator) newDCQuorum(level string, preferred []types.NodeInfo) (*dcQuorum, error) {
+	size := make(map[string]int)
+	for _, n := range preferred {
+		size[n.DC]++
+	}
+	q := &dcQuorum{need: make(map[string]int)}
+	switch level {
+	case DCLocal:
+		if size[c.Self.DC] == 0 {
+			return nil, fmt.Errorf("%w: no replicas in local datacenter %q", ErrBadConsistency, c.Self.DC)
+		}
+		q.need[c.Self.DC] = size[c.Self.DC]/2 + 1
+	case DCEach:
+		for dc, s := range size {
+			q.need[dc] = s/2 + 1
+		}
+	default:
+		return nil, fmt.Errorf("%w: datacenter level %q (want %s or %s)", ErrBadConsistency, level, DCLocal, DCEach)
+	}
+	return q, nil
+}
+
+// wants reports whether an ack from n counts towards the quorum.
+func (q *dcQuorum) wants(n types.NodeInfo) bool {
+	_, ok := q.need[n.DC]
+	return ok
+}
+
+func (q *dcQuorum) ack(n types.NodeInfo) {
+	if q.need[n.DC] > 0 {
+		q.need[n.DC]--
+	}
+}
+
+func (q *dcQuorum) met() bool {
+	for _, v := range q.need {
+		if v > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// possible reports whether the live replicas can still meet the quorum.
+func (q *dcQuorum) possible(live []types.NodeInfo) bool {
+	have := make(map[string]int)
+	for _, n := range live {
+		have[n.DC]++
+	}
+	for dc, v := range q.need {
+		if have[dc] < v {
+			return false
+		}
+	}
+	return true
+}
+
+// String lists the datacenters still short of acks, e.g. "dc1 needs 1".
+func (q *dcQuorum) String() string {
+	var parts []string
+	for dc, v := range q.need {
+		if v > 0 {
+			parts = append(parts, fmt.Sprintf("%q needs %d", dc, v))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// putDC writes rec to every preferred replica and returns once the
+// datacenter quorum has acknowledged. The remaining sends outlive the
+// request, so remote datacenters still get the write.
+func (c *Coordinator) putDC(ctx context.Context, key string, rec store.Record, level string) (int, error) {
+	_, rg := c.Topo.Current()
+	rf, _, _ := c.replication(key)
+	preferred := rg.GetReplicas(key, rf)
+	q, err := c.newDCQuorum(level, preferred)
+	if err != nil {
+		return 0, err
+	}
+
+	c.shadowWrite(key, rec, preferred)
+
+	sendCtx, cancel := context.WithTimeout(context.Background(), c.Cfg.Timeout)
+	type res struct {
+		node types.NodeInfo
+		err  error
+	}
+	ch := make(chan res, len(preferred))
+	var wg sync.WaitGroup
+	for _, n := range preferred {
+		if c.dead(n) {
+			if c.Hints != nil {
+				c.Hints.Add(n.ID, rec)
+			}
+			continue
+		}
+		n := n
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.replicaPut(sendCtx, n, rec, "")
+			if err != nil && c.Hints != nil {
+				c.Hints.Add(n.ID, rec)
+			}
+			ch <- res{node: n, err: err}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(ch)
+	}()
+
+	acks := 0
+	for r := range ch {
+		if r.err == nil {
+			acks++
+			q.ack(r.node)
+			if q.met() {
+				return acks, nil
+			}
+		}
+	}
+	return acks, fmt.Errorf("write quorum not reached: %s", q)
+}
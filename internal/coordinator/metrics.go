@@ -0,0 +1,28 @@
+package coordinator
+
+import (
+	"errors"
+	"time"
+
+	"mini-dynamo/internal/metrics"
+)
+
+var (
+	opDuration = metrics.NewHistogram("minidynamo_coordinator_op_duration_seconds",
+		"Latency of client operations coordinated by this node, by operation.", metrics.DefBuckets, "op")
+	quorumFailures = metrics.NewCounter("minidynamo_coordinator_quorum_failures_total",
+		"Client operations (batch keys counted one by one) that did not reach their quorum, by operation.", "op")
+	readRepairs = metrics.NewCounter("minidynamo_coordinator_read_repairs_total",
+		"Replicas sent siblings they were missing by read repair.")
+	sloppyWrites = metrics.NewCounter("minidynamo_coordinator_sloppy_fallback_writes_total",
+		"Writes a fallback replica took in place of a failed preferred replica (sloppy quorum).")
+)
+
+// observe records how long op took and whether it failed for lack of
+// replicas. Failed preconditions and bad options are not quorum failures.
+func observe(op string, start time.Time, err error) {
+	opDuration.Since(start, op)
+	if err != nil && !errors.Is(err, ErrPreconditionFailed) && !errors.Is(err, ErrBadConsistency) {
+		quorumFailures.Inc(op)
+	}
+}
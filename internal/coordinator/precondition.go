@@ -0,0 +1,82 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"mini-dynamo/internal/store"
+)
+
+// ErrPreconditionFailed means a conditional write saw a different version.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Precondition is an HTTP-style write condition on the key's version tag
+// (store.VersionTag). "*" stands for "any live version".
+type Precondition struct {
+	IfMatch     []string // write only if the current tag is one of these
+	IfNoneMatch []string // write only if the current tag is none of these
+}
+
+func (p Precondition) empty() bool { return len(p.IfMatch) == 0 && len(p.IfNoneMatch) == 0 }
+
+func (p Precondition) holds(tag string) bool {
+	match := func(tags []string) bool {
+		for _, t := range tags {
+			if (t == "*" && tag != "") || (t != "*" && t == tag) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(p.IfMatch) > 0 && !match(p.IfMatch) {
+		return false
+	}
+	if len(p.IfNoneMatch) > 0 && match(p.IfNoneMatch) {
+		return false
+	}
+	return true
+}
+
+// WriteOptions tunes a client write.
+type WriteOptions struct {
+	Context store.VClock  // causal context the client read (X-Context)
+	TTL     time.Duration // expire the value after this long (Put only)
+	If      Precondition
+	Serial  bool // run the write through Paxos (see serial.go); R and W are ignored
+
+	// R and W override Config for this write (0 = default). R applies to the
+	// read a conditional write does first.
+	R, W int
+
+	// Quorum overrides Config.MinPreferred with a policy for ParseQuorum
+	// ("" = default).
+	Quorum string
+
+	// DC selects a datacenter-aware level, DCLocal or DCEach, for the write
+	// and its read; W and Quorum are then ignored.
+	DC string
+}
+
+// causalFor returns the context to stamp a write with. A conditional write
+// first does a quorum read and checks the condition against it; the write
+// then supersedes exactly the versions it was checked against.
+//
+// This is check-then-write, not an atomic compare-and-set: two writers can
+// both pass the check. Because each write descends only from what its own
+// read saw, such writes come out as concurrent siblings rather than one
+// silently overwriting the other. Serial writes check the condition inside
+// a Paxos round instead, which makes them a true compare-and-set.
+func (c *Coordinator) causalFor(ctx context.Context, key string, opts WriteOptions) (store.VClock, error) {
+	if opts.If.empty() {
+		return opts.Context, nil
+	}
+	sibs, _, _, err := c.Get(ctx, key, ReadOptions{R: opts.R, DC: opts.DC})
+	if err != nil {
+		return nil, err
+	}
+	if !opts.If.holds(store.VersionTag(sibs)) {
+		return nil, ErrPreconditionFailed
+	}
+	return opts.Context.Merge(store.ContextOf(sibs)), nil
+}
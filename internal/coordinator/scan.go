@@ -0,0 +1,257 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"mini-dynamo/internal/store"
+	"mini-dynamo/internal/transport"
+	"mini-dynamo/internal/types"
+)
+
+// Scan page sizes: DefaultScanLimit when a scan does not ask, never more
+// than MaxScanLimit.
+const (
+	DefaultScanLimit = 100
+	MaxScanLimit     = 1000
+)
+
+// ScanOptions selects a page of keys in order: those starting with Prefix,
+// from Start (inclusive), or after After (exclusive) when continuing a scan.
+// R and DC work as for Get; serial scans are not supported.
+type ScanOptions struct {
+	ReadOptions
+	Prefix string
+	Start  string
+	After  string
+	Limit  int // 0 = DefaultScanLimit
+}
+
+// ScanItem is a live key in a scan page. Value, Ts, WriterID and ExpiresAt
+// are from the last-writer-wins sibling; Siblings counts the live ones.
+type ScanItem struct {
+	Key       string
+	Value     []byte
+	Ts        int64
+	WriterID  string
+	ExpiresAt int64
+	Siblings  int
+}
+
+// ScanPage is one page of a scan. Next is the After of the following page,
+// empty once the scan is complete.
+type ScanPage struct {
+	Items []ScanItem
+	Next  string
+}
+
+func clampScanLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultScanLimit
+	}
+	if limit > MaxScanLimit {
+		return MaxScanLimit
+	}
+	return limit
+}
+
+// Scan returns a page of live keys in key order. Keys are hash partitioned,
+// so every node is asked for its first Limit matching keys. The page ends at
+// the smallest last key of the nodes that stopped at Limit, the point up to
+// which every node has answered in full. Each range of the ring needs R (or
+// the datacenter quorum) of its replicas among the nodes that answered.
+// Replica answers are merged per key like Get, then tombstones and expired
+// values are dropped. Scans do not read repair; anti-entropy covers them.
+// acks is how many nodes answered.
+func (c *Coordinator) Scan(ctx context.Context, opts ScanOptions) (_ ScanPage, _ int, err error) {
+	defer func(start time.Time) { observe("scan", start, err) }(time.Now())
+	if opts.Serial {
+		return ScanPage{}, 0, fmt.Errorf("%w: scans do not support serial consistency", ErrBadConsistency)
+	}
+	// A scan stays within the keyspace of its prefix.
+	rf, r, _ := c.replication(opts.Prefix)
+	need, err := c.level(opts.R, r, rf)
+	if err != nil {
+		return ScanPage{}, 0, err
+	}
+
+	_, rg := c.Topo.Current()
+	var nodes []types.NodeInfo
+	for _, n := range rg.Nodes() {
+		if !c.dead(n) {
+			nodes = append(nodes, n)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Cfg.Timeout)
+	defer cancel()
+
+	req := transport.ScanRequest{Prefix: opts.Prefix, Start: opts.Start, After: opts.After, Limit: clampScanLimit(opts.Limit)}
+	type result struct {
+		node types.NodeInfo
+		resp transport.ScanResponse
+		err  error
+	}
+	ch := make(chan result, len(nodes))
+	for _, n := range nodes {
+		n := n
+		go func() {
+			resp, err := c.replicaScan(ctx, n, req)
+			ch <- result{node: n, resp: resp, err: err}
+		}()
+	}
+
+	answered := make(map[string]bool, len(nodes))
+	resps := make([]result, 0, len(nodes))
+	for range nodes {
+		if r := <-ch; r.err == nil {
+			answered[r.node.ID] = true
+			resps = append(resps, r)
+		}
+	}
+
+	for _, set := range rg.ReplicaSets(rf) {
+		if err := c.scanQuorum(set, answered, need, opts.DC); err != nil {
+			return ScanPage{}, len(resps), err
+		}
+	}
+
+	var page ScanPage
+	for _, r := range resps {
+		if items := r.resp.Items; r.resp.More && len(items) > 0 {
+			if last := items[len(items)-1].Key; page.Next == "" || last < page.Next {
+				page.Next = last
+			}
+		}
+	}
+
+	// Merge what each key's replicas returned; copies on other nodes (such
+	// as data a node no longer owns) are ignored, as Get would.
+	merged := make(map[string][]store.Record)
+	for _, r := range resps {
+		for _, it := range r.resp.Items {
+			if page.Next != "" && it.Key > page.Next {
+				break
+			}
+			if !containsID(rg.GetReplicas(it.Key, rf), r.node.ID) {
+				continue
+			}
+			merged[it.Key] = c.mergeReply(merged[it.Key], it.Siblings)
+		}
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		live := store.Live(merged[k])
+		if len(live) == 0 {
+			continue
+		}
+		win := live[0]
+		for _, rec := range live[1:] {
+			win = store.Newer(win, rec)
+		}
+		page.Items = append(page.Items, ScanItem{
+			Key:       k,
+			Value:     win.Value,
+			Ts:        win.Ts,
+			WriterID:  win.WriterID,
+			ExpiresAt: win.ExpiresAt,
+			Siblings:  len(live),
+		})
+	}
+	return page, len(resps), nil
+}
+
+// scanQuorum checks that enough of one range's replicas answered a scan.
+func (c *Coordinator) scanQuorum(set []types.NodeInfo, answered map[string]bool, need int, dc string) error {
+	if dc != "" {
+		q, err := c.newDCQuorum(dc, set)
+		if err != nil {
+			return err
+		}
+		for _, n := range set {
+			if answered[n.ID] && q.wants(n) {
+				q.ack(n)
+			}
+		}
+		if !q.met() {
+			return fmt.Errorf("read quorum not reached: %s for replicas %s", q, nodeIDs(set))
+		}
+		return nil
+	}
+	got := 0
+	for _, n := range set {
+		if answered[n.ID] {
+			got++
+		}
+	}
+	if got < need {
+		return fmt.Errorf("read quorum not reached: success=%d need=%d for replicas %s", got, need, nodeIDs(set))
+	}
+	return nil
+}
+
+func (c *Coordinator) replicaScan(ctx context.Context, n types.NodeInfo, req transport.ScanRequest) (transport.ScanResponse, error) {
+	if n.ID == c.Self.ID {
+		return c.HandleScan(req)
+	}
+	var resp transport.ScanResponse
+	err := c.Client.PostJSON(ctx, baseURL(n.Addr)+"/internal/scan", req, &resp)
+	return resp, err
+}
+
+// HandleScan answers a replica scan from the local store.
+func (c *Coordinator) HandleScan(req transport.ScanRequest) (transport.ScanResponse, error) {
+	limit := clampScanLimit(req.Limit)
+	from := req.Start
+	if req.Prefix > from {
+		from = req.Prefix
+	}
+	if req.After > from {
+		from = req.After
+	}
+
+	resp := transport.ScanResponse{Items: []transport.ScanItem{}}
+	err := c.Store.Scan(from, func(k string, sibs []store.Record) bool {
+		if req.After != "" && k <= req.After {
+			return true
+		}
+		if !strings.HasPrefix(k, req.Prefix) {
+			return false // keys are ordered: past the prefix
+		}
+		if len(sibs) == 0 {
+			return true
+		}
+		if len(resp.Items) == limit {
+			resp.More = true
+			return false
+		}
+		resp.Items = append(resp.Items, transport.ScanItem{Key: k, Siblings: sibs})
+		return true
+	})
+	return resp, err
+}
+
+func containsID(nodes []types.NodeInfo, id string) bool {
+	for _, n := range nodes {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeIDs(nodes []types.NodeInfo) string {
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.ID
+	}
+	return strings.Join(ids, ",")
+}
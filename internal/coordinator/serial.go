@@ -0,0 +1,334 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"mini-dynamo/internal/paxos"
+	"mini-dynamo/internal/store"
+	"mini-dynamo/internal/transport"
+	"mini-dynamo/internal/types"
+)
+
+// Serial operations run single-decree Paxos per key among the key's preferred
+// replicas, in the style of Cassandra's lightweight transactions: each
+// operation prepares a ballot, reads the key from the majority that promised,
+// proposes one new version and commits it. Every committed version descends
+// from everything committed before it, so serial reads and writes of a key
+// are linearizable, and a conditional serial write is an atomic
+// compare-and-set.
+//
+// Linearizability only covers keys that are written serially. A regular
+// quorum write to the same key is not ordered against the Paxos rounds.
+
+var (
+	// ErrSerialDisabled means this node has no Paxos acceptor.
+	ErrSerialDisabled = errors.New("serial consistency is not enabled on this node")
+	// ErrSerialUnknown means a write gave up while one of its proposals
+	// might still be accepted by a minority: a later round may commit it.
+	ErrSerialUnknown = errors.New("serial write outcome unknown")
+)
+
+const serialAttempts = 8
+
+// HandlePaxos runs one Paxos phase against this node's acceptor. A commit
+// applies the record to the store before closing the instance.
+func (c *Coordinator) HandlePaxos(req transport.PaxosRequest) (transport.PaxosResponse, error) {
+	if c.Paxos == nil {
+		return transport.PaxosResponse{}, ErrSerialDisabled
+	}
+
+	switch req.Phase {
+	case "prepare":
+		ok, st, err := c.Paxos.Prepare(req.Key, req.Ballot)
+		if err != nil {
+			return transport.PaxosResponse{}, err
+		}
+		resp := transport.PaxosResponse{OK: ok, State: st}
+		if ok {
+			resp.Siblings, _ = c.Store.Get(req.Key)
+		}
+		return resp, nil
+
+	case "propose":
+		if req.Record == nil {
+			return transport.PaxosResponse{}, errors.New("propose without record")
+		}
+		ok, st, err := c.Paxos.Accept(req.Key, req.Ballot, *req.Record)
+		return transport.PaxosResponse{OK: ok, State: st}, err
+
+	case "commit":
+		if req.Record == nil {
+			return transport.PaxosResponse{}, errors.New("commit without record")
+		}
+		if _, err := c.Store.PutMerge(*req.Record); err != nil {
+			return transport.PaxosResponse{}, err
+		}
+		return transport.PaxosResponse{OK: true}, c.Paxos.Commit(req.Key, req.Ballot)
+
+	default:
+		return transport.PaxosResponse{}, fmt.Errorf("unknown paxos phase %q", req.Phase)
+	}
+}
+
+func (c *Coordinator) replicaPaxos(ctx context.Context, n types.NodeInfo, req transport.PaxosRequest) (transport.PaxosResponse, error) {
+	if n.ID == c.Self.ID {
+		return c.HandlePaxos(req)
+	}
+
+	var resp transport.PaxosResponse
+	err := c.Client.PostJSON(ctx,
+		baseURL(n.Addr)+"/internal/paxos",
+		req,
+		&resp,
+	)
+	return resp, err
+}
+
+// ballot returns a ballot above every one this node has issued or seen.
+func (c *Coordinator) ballot() paxos.Ballot {
+	return paxos.Ballot{N: c.tick(), Node: c.Self.ID}
+}
+
+// witness moves the clock past a ballot seen from another proposer.
+func (c *Coordinator) witness(b paxos.Ballot) {
+	_ = c.Clock.Observe(b.N)
+}
+
+// paxosRound sends req to replicas and waits until need of them say OK or
+// all have answered. failed counts replicas that gave no answer.
+func (c *Coordinator) paxosRound(ctx context.Context, replicas []types.NodeInfo, need int, req transport.PaxosRequest) (oks []transport.PaxosResponse, failed int) {
+	ctx, cancel := context.WithTimeout(ctx, c.Cfg.Timeout)
+	defer cancel()
+
+	type result struct {
+		resp transport.PaxosResponse
+		err  error
+	}
+	ch := make(chan result, len(replicas))
+	for _, n := range replicas {
+		n := n
+		go func() {
+			resp, err := c.replicaPaxos(ctx, n, req)
+			ch <- result{resp: resp, err: err}
+		}()
+	}
+
+	for i := 0; i < len(replicas) && len(oks) < need; i++ {
+		r := <-ch
+		switch {
+		case r.err != nil:
+			failed++
+		case r.resp.OK:
+			oks = append(oks, r.resp)
+		default:
+			c.witness(r.resp.State.Promised)
+		}
+	}
+	return oks, failed
+}
+
+// serial runs one Paxos operation on key. update sees the key's current
+// siblings and returns the version to write, or nil for a read. It returns
+// the siblings update saw, the version written and how many replicas
+// acknowledged (promised for a read, committed for a write).
+func (c *Coordinator) serial(ctx context.Context, key string, update func(cur []store.Record) (*store.Record, error)) ([]store.Record, store.Record, int, error) {
+	if c.Paxos == nil {
+		return nil, store.Record{}, 0, ErrSerialDisabled
+	}
+
+	_, rg := c.Topo.Current()
+	rf, _, _ := c.replication(key)
+	preferred := rg.GetReplicas(key, rf)
+	need := len(preferred)/2 + 1
+	replicas := make([]types.NodeInfo, 0, len(preferred))
+	for _, n := range preferred {
+		if !c.dead(n) {
+			replicas = append(replicas, n)
+		}
+	}
+	if len(replicas) < need {
+		return nil, store.Record{}, 0, fmt.Errorf("serial quorum impossible: live replicas=%d need=%d", len(replicas), need)
+	}
+
+	// Our proposals that a minority may have accepted. One of them can still
+	// be committed by a later round, so a retry first looks for them.
+	var pending []store.Record
+	for attempt := 0; attempt < serialAttempts; attempt++ {
+		if attempt > 0 {
+			if err := backoff(ctx, attempt); err != nil {
+				return nil, store.Record{}, 0, err
+			}
+		}
+
+		b := c.ballot()
+		promises, _ := c.paxosRound(ctx, replicas, need, transport.PaxosRequest{Phase: "prepare", Key: key, Ballot: b})
+		if len(promises) < need {
+			continue
+		}
+
+		// Finish a proposal an earlier round left accepted but not committed;
+		// it may already have been chosen. Then start over on top of it.
+		if prev := inProgress(promises); prev != nil {
+			acks, err := c.propose(ctx, replicas, need, key, b, *prev)
+			if err != nil && !errors.Is(err, errNotAccepted) {
+				return nil, store.Record{}, acks, err
+			}
+			if err == nil && sameVersion(pending, *prev) {
+				return nil, *prev, acks, nil
+			}
+			continue
+		}
+
+		var cur []store.Record
+		for _, p := range promises {
+			for _, rec := range p.Siblings {
+				cur, _ = store.MergeSiblings(cur, rec)
+			}
+		}
+		if mine, ok := committedOf(pending, cur); ok {
+			return cur, mine, len(promises), nil
+		}
+
+		rec, err := update(cur)
+		if err != nil || rec == nil {
+			return cur, store.Record{}, len(promises), err
+		}
+
+		acks, err := c.propose(ctx, replicas, need, key, b, *rec)
+		if err != nil {
+			if !errors.Is(err, errNotAccepted) {
+				return cur, store.Record{}, acks, err
+			}
+			pending = append(pending, *rec)
+			continue
+		}
+		return cur, *rec, acks, nil
+	}
+	if len(pending) > 0 {
+		return nil, store.Record{}, 0, fmt.Errorf("%w after %d contended attempts", ErrSerialUnknown, serialAttempts)
+	}
+	return nil, store.Record{}, 0, fmt.Errorf("serial operation on %q: too much contention after %d attempts", key, serialAttempts)
+}
+
+// errNotAccepted means fewer than a majority accepted a proposal, usually
+// because another proposer prepared a higher ballot.
+var errNotAccepted = errors.New("proposal not accepted by a majority")
+
+// sameVersion reports whether rec is one of recs.
+func sameVersion(recs []store.Record, rec store.Record) bool {
+	for _, r := range recs {
+		if r.Ts == rec.Ts && r.WriterID == rec.WriterID {
+			return true
+		}
+	}
+	return false
+}
+
+// committedOf returns the proposal from pending that cur shows was committed:
+// cur holds it, or a version that descends from it.
+func committedOf(pending, cur []store.Record) (store.Record, bool) {
+	for _, m := range pending {
+		for _, s := range cur {
+			if (s.Ts == m.Ts && s.WriterID == m.WriterID) || m.Clock.Compare(s.Clock) == store.Before {
+				return m, true
+			}
+		}
+	}
+	return store.Record{}, false
+}
+
+// propose asks the replicas to accept rec under b and, once a majority has,
+// commits it to every replica and waits for a majority of those. It returns
+// how many replicas acknowledged the commit.
+func (c *Coordinator) propose(ctx context.Context, replicas []types.NodeInfo, need int, key string, b paxos.Ballot, rec store.Record) (int, error) {
+	accepted, _ := c.paxosRound(ctx, replicas, need, transport.PaxosRequest{Phase: "propose", Key: key, Ballot: b, Record: &rec})
+	if len(accepted) < need {
+		return 0, errNotAccepted
+	}
+
+	// Commit everywhere; a replica that misses it gets a hint, and the value
+	// stays recoverable from the acceptors that accepted it.
+	ctx, cancel := context.WithTimeout(ctx, c.Cfg.Timeout)
+	defer cancel()
+	ch := make(chan error, len(replicas))
+	for _, n := range replicas {
+		n := n
+		go func() {
+			_, err := c.replicaPaxos(ctx, n, transport.PaxosRequest{Phase: "commit", Key: key, Ballot: b, Record: &rec})
+			if err != nil && c.Hints != nil && n.ID != c.Self.ID {
+				c.Hints.Add(n.ID, rec)
+			}
+			ch <- err
+		}()
+	}
+
+	acks := 0
+	for i := 0; i < len(replicas) && acks < need; i++ {
+		if err := <-ch; err == nil {
+			acks++
+		}
+	}
+	if acks < need {
+		return acks, fmt.Errorf("serial commit reached %d of %d replicas (value is chosen; the next serial operation completes it)", acks, need)
+	}
+	return acks, nil
+}
+
+// inProgress returns the newest accepted value among promises if it is newer
+// than every commit they report.
+func inProgress(promises []transport.PaxosResponse) *store.Record {
+	var committed, accepted paxos.Ballot
+	var val *store.Record
+	for _, p := range promises {
+		if committed.Less(p.State.Committed) {
+			committed = p.State.Committed
+		}
+		if p.State.Value != nil && accepted.Less(p.State.Accepted) {
+			accepted, val = p.State.Accepted, p.State.Value
+		}
+	}
+	if val == nil || !committed.Less(accepted) {
+		return nil
+	}
+	return val
+}
+
+func backoff(ctx context.Context, attempt int) error {
+	d := time.Duration(rand.Int63n(int64(attempt) * int64(10*time.Millisecond)))
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serialGet is a linearizable read: it completes any in-progress proposal on
+// key before reading it from a majority of its replicas.
+func (c *Coordinator) serialGet(ctx context.Context, key string) ([]store.Record, bool, int, error) {
+	sibs, _, acks, err := c.serial(ctx, key, func([]store.Record) (*store.Record, error) { return nil, nil })
+	if err != nil {
+		return nil, false, acks, err
+	}
+	return sibs, len(store.Live(sibs)) > 0, acks, nil
+}
+
+// serialWrite checks opts.If against the key's current version and writes a
+// version superseding it, atomically. fill sets the payload.
+func (c *Coordinator) serialWrite(ctx context.Context, key string, opts WriteOptions, fill func(rec *store.Record)) (store.Record, int, error) {
+	_, rec, acks, err := c.serial(ctx, key, func(cur []store.Record) (*store.Record, error) {
+		if !opts.If.holds(store.VersionTag(cur)) {
+			return nil, ErrPreconditionFailed
+		}
+		rec := c.newVersion(key, opts.Context.Merge(store.ContextOf(cur)))
+		fill(&rec)
+		return &rec, nil
+	})
+	return rec, acks, err
+}
@@ -9,22 +9,27 @@ import (
 	"sync"
 	"time"
 
+	"mini-dynamo/internal/metrics"
 	"mini-dynamo/internal/store"
 )
 
+var walFsync = metrics.NewHistogram("minidynamo_hints_wal_fsync_duration_seconds",
+	"Latency of hint WAL fsyncs.", metrics.DefBuckets)
+
 type walEntry struct {
 	Op     string        `json:"op"` // "add" | "del"
 	Target string        `json:"target,omitempty"`
 	Key    string        `json:"key,omitempty"`
 	Ts     int64         `json:"ts,omitempty"`
 	Writer string        `json:"writer_id,omitempty"`
+	Clock  store.VClock  `json:"clock,omitempty"`
 	Record *store.Record `json:"record,omitempty"`
 }
 
 type Manager struct {
 	mu sync.Mutex
-	// targetID -> key -> record (keep only latest per key/target)
-	m map[string]map[string]store.Record
+	// targetID -> key -> siblings (only versions not superseded per key/target)
+	m map[string]map[string][]store.Record
 
 	// WAL (optional)
 	walPath     string
@@ -35,7 +40,7 @@ type Manager struct {
 }
 
 func New() *Manager {
-	return &Manager{m: make(map[string]map[string]store.Record)}
+	return &Manager{m: make(map[string]map[string][]store.Record)}
 }
 
 // NewPersistent loads any existing WAL at walPath and appends future updates to it.
@@ -52,7 +57,7 @@ func NewPersistent(walPath string) (*Manager, error) {
 	}
 
 	h := &Manager{
-		m:       make(map[string]map[string]store.Record),
+		m:       make(map[string]map[string][]store.Record),
 		walPath: walPath,
 	}
 
@@ -105,7 +110,7 @@ func (h *Manager) replay() error {
 				h.addNoWAL(e.Target, *e.Record)
 			}
 		case "del":
-			h.delNoWAL(e.Target, e.Key, e.Ts, e.Writer)
+			h.delNoWAL(e.Target, e.Key, store.Record{Ts: e.Ts, WriterID: e.Writer, Clock: e.Clock})
 		default:
 			// ignore unknown ops for forward-compat
 		}
@@ -123,50 +128,65 @@ func (h *Manager) addNoWAL(targetID string, rec store.Record) {
 	h.addLocked(targetID, rec)
 }
 
-func (h *Manager) delNoWAL(targetID, key string, ts int64, writerID string) {
+func (h *Manager) delNoWAL(targetID, key string, version store.Record) {
 	if targetID == "" || key == "" {
 		return
 	}
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
-
-	byKey := h.m[targetID]
-	if byKey == nil {
-		return
-	}
-	cur, ok := byKey[key]
-	if !ok {
-		return
-	}
-	if cur.Ts == ts && cur.WriterID == writerID {
-		delete(byKey, key)
-		if len(byKey) == 0 {
-			delete(h.m, targetID)
-		}
-	}
+	h.delLocked(targetID, key, version)
 }
 
 func (h *Manager) addLocked(targetID string, rec store.Record) (changed bool) {
 	byKey, ok := h.m[targetID]
 	if !ok {
-		byKey = make(map[string]store.Record)
+		byKey = make(map[string][]store.Record)
 		h.m[targetID] = byKey
 	}
 
-	if cur, ok := byKey[rec.Key]; ok {
-		w := store.Newer(cur, rec)
-		if w.Ts != cur.Ts || w.WriterID != cur.WriterID {
-			byKey[rec.Key] = w
-			return true
+	sibs, changed := store.MergeSiblings(byKey[rec.Key], rec)
+	if changed {
+		byKey[rec.Key] = sibs
+	}
+	return changed
+}
+
+// delLocked drops the sibling matching version exactly; newer versions stay queued.
+func (h *Manager) delLocked(targetID, key string, version store.Record) (deleted bool) {
+	byKey := h.m[targetID]
+	if byKey == nil {
+		return false
+	}
+
+	sibs := byKey[key]
+	kept := sibs[:0]
+	for _, cur := range sibs {
+		if !deleted && sameVersion(cur, version) {
+			deleted = true
+			continue
 		}
+		kept = append(kept, cur)
+	}
+	if !deleted {
 		return false
 	}
 
-	byKey[rec.Key] = rec
+	if len(kept) == 0 {
+		delete(byKey, key)
+		if len(byKey) == 0 {
+			delete(h.m, targetID)
+		}
+	} else {
+		byKey[key] = kept
+	}
 	return true
 }
 
+func sameVersion(a, b store.Record) bool {
+	return a.Ts == b.Ts && a.WriterID == b.WriterID && a.Clock.Compare(b.Clock) == store.Equal
+}
+
 func (h *Manager) appendWAL(e walEntry) error {
 	if h.walFile == nil {
 		return nil
@@ -181,9 +201,11 @@ func (h *Manager) appendWAL(e walEntry) error {
 	if _, err := h.walFile.Write(b); err != nil {
 		return err
 	}
+	start := time.Now()
 	if err := h.walFile.Sync(); err != nil {
 		return err
 	}
+	walFsync.Since(start)
 
 	h.walOps++
 	h.walBytes += int64(len(b))
@@ -225,11 +247,7 @@ func (h *Manager) RecordsFor(targetID string) []store.Record {
 	if len(byKey) == 0 {
 		return nil
 	}
-	out := make([]store.Record, 0, len(byKey))
-	for _, rec := range byKey {
-		out = append(out, rec)
-	}
-	return out
+	return flatten(byKey)
 }
 
 // DeleteIfSame removes the hint only if it has not been overwritten by a newer version.
@@ -239,20 +257,8 @@ func (h *Manager) DeleteIfSame(targetID string, key string, rec store.Record) {
 		return
 	}
 
-	deleted := false
-
 	h.mu.Lock()
-	byKey := h.m[targetID]
-	if byKey != nil {
-		cur, ok := byKey[key]
-		if ok && cur.Ts == rec.Ts && cur.WriterID == rec.WriterID {
-			delete(byKey, key)
-			if len(byKey) == 0 {
-				delete(h.m, targetID)
-			}
-			deleted = true
-		}
-	}
+	deleted := h.delLocked(targetID, key, rec)
 	h.mu.Unlock()
 
 	if deleted {
@@ -262,21 +268,75 @@ func (h *Manager) DeleteIfSame(targetID string, key string, rec store.Record) {
 			Key:    key,
 			Ts:     rec.Ts,
 			Writer: rec.WriterID,
+			Clock:  rec.Clock,
 		})
 	}
 }
 
+// PurgeBefore drops every hint written before ts (unix nanoseconds). Hints
+// older than gc_grace could resurrect data whose tombstone was already purged.
+func (h *Manager) PurgeBefore(ts int64) int {
+	return h.PurgeIf(func(rec store.Record) bool { return rec.Ts < ts })
+}
+
+// PurgeIf drops every hint whose record matches drop.
+func (h *Manager) PurgeIf(drop func(rec store.Record) bool) int {
+	type stale struct {
+		target string
+		rec    store.Record
+	}
+	var old []stale
+	h.mu.Lock()
+	for target, byKey := range h.m {
+		for _, rec := range flatten(byKey) {
+			if drop(rec) {
+				old = append(old, stale{target, rec})
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	for _, o := range old {
+		h.DeleteIfSame(o.target, o.rec.Key, o.rec)
+	}
+	return len(old)
+}
+
+func flatten(byKey map[string][]store.Record) []store.Record {
+	out := make([]store.Record, 0, len(byKey))
+	for _, sibs := range byKey {
+		out = append(out, sibs...)
+	}
+	return out
+}
+
 func (h *Manager) Count() int {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	total := 0
 	for _, byKey := range h.m {
-		total += len(byKey)
+		for _, sibs := range byKey {
+			total += len(sibs)
+		}
 	}
 	return total
 }
 
+// CountByTarget returns how many hints are queued for each target.
+func (h *Manager) CountByTarget() map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make(map[string]int, len(h.m))
+	for t, byKey := range h.m {
+		for _, sibs := range byKey {
+			out[t] += len(sibs)
+		}
+	}
+	return out
+}
+
 // MaybeCompact rewrites the WAL to contain only current outstanding hints.
 // Call this periodically from a background loop.
 func (h *Manager) MaybeCompact() error {
@@ -315,7 +375,7 @@ func (h *Manager) compactLocked() error {
 
 	w := bufio.NewWriter(f)
 	for target, byKey := range h.m {
-		for _, rec := range byKey {
+		for _, rec := range flatten(byKey) {
 			rc := rec
 			b, err := json.Marshal(walEntry{Op: "add", Target: target, Record: &rc})
 			if err != nil {
@@ -0,0 +1,99 @@
+package hlc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Header carries the sender's clock on every internal request and response.
+const Header = "X-HLC"
+
+// ErrSkew means a timestamp is further ahead of the local wall clock than the
+// configured maximum skew allows.
+var ErrSkew = errors.New("timestamp too far in the future")
+
+// Clock is a hybrid logical clock. Timestamps are unix nanoseconds, so they
+// stay comparable with wall-clock times (TTL expiry, gc_grace), but they
+// never run behind a timestamp this node has seen and strictly increase:
+// a write always sorts after everything its coordinator has observed, even
+// when the coordinator's wall clock is behind.
+//
+// A node whose wall clock is far ahead would drag every clock it talks to
+// along with it. With a maximum skew set, timestamps further ahead than that
+// are counted and, in reject mode, refused instead of observed.
+type Clock struct {
+	maxSkew time.Duration
+	reject  bool
+
+	mu       sync.Mutex
+	last     int64
+	flagged  uint64
+	rejected uint64
+	maxAhead int64 // furthest ahead of the wall clock a timestamp has been
+}
+
+// New returns a clock. maxSkew <= 0 disables the skew guard; reject selects
+// whether skewed timestamps are refused or only flagged.
+func New(maxSkew time.Duration, reject bool) *Clock {
+	return &Clock{maxSkew: maxSkew, reject: reject}
+}
+
+// Now returns a timestamp for a local or send event.
+func (c *Clock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	if now <= c.last {
+		now = c.last + 1
+	}
+	c.last = now
+	return now
+}
+
+// Observe folds a received timestamp into the clock. It returns an error
+// wrapping ErrSkew, without advancing the clock, if ts is too far ahead and
+// the clock is in reject mode.
+func (c *Clock) Observe(ts int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ahead := ts - time.Now().UnixNano(); c.maxSkew > 0 && ahead > int64(c.maxSkew) {
+		if ahead > c.maxAhead {
+			c.maxAhead = ahead
+		}
+		if c.reject {
+			c.rejected++
+			return fmt.Errorf("%w: %s ahead (max %s)", ErrSkew, time.Duration(ahead), c.maxSkew)
+		}
+		c.flagged++
+	}
+	if ts > c.last {
+		c.last = ts
+	}
+	return nil
+}
+
+func (c *Clock) Stats() map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mode := "off"
+	if c.maxSkew > 0 {
+		mode = "flag"
+		if c.reject {
+			mode = "reject"
+		}
+	}
+	return map[string]any{
+		"last":         c.last,
+		"offset_ms":    (c.last - time.Now().UnixNano()) / int64(time.Millisecond), // > 0 when running ahead of the wall clock
+		"max_skew_ms":  int64(c.maxSkew / time.Millisecond),
+		"skew_mode":    mode,
+		"flagged":      c.flagged,
+		"rejected":     c.rejected,
+		"max_ahead_ms": c.maxAhead / int64(time.Millisecond),
+	}
+}
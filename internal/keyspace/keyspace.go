@@ -0,0 +1,266 @@
+package keyspace
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A keyspace is a named set of keys with its own replication, default TTL
+// and gc_grace. Its keys are stored, replicated and hinted under the
+// internal key Key(name, key), which sorts before every key of the default
+// (unnamed) keyspace and never collides with one: default keys must not
+// start with a NUL byte.
+
+// MaxNameLen bounds keyspace names.
+const MaxNameLen = 48
+
+var ErrBadName = errors.New("bad keyspace name")
+
+// Keyspace is one entry of the catalog. N, R and W work like the cluster's;
+// TTL is the expiry of writes that do not set one, and GCGrace overrides
+// --gc_grace for the keyspace's tombstones (0 uses the node's).
+type Keyspace struct {
+	Name    string   `json:"name"`
+	N       int      `json:"n"`
+	R       int      `json:"r"`
+	W       int      `json:"w"`
+	TTL     Duration `json:"ttl,omitempty"`
+	GCGrace Duration `json:"gc_grace,omitempty"`
+
+	// Created is the catalog version that created the keyspace, so a
+	// keyspace dropped and created again is not mistaken for the old one.
+	Created uint64 `json:"created"`
+}
+
+// Duration is a time.Duration written as a string such as "24h".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil || v < 0 {
+		return fmt.Errorf("bad duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// CheckName validates a keyspace name: 1..MaxNameLen of a-z, 0-9, _ and -.
+func CheckName(name string) error {
+	if name == "" || len(name) > MaxNameLen {
+		return fmt.Errorf("%w %q (want 1..%d characters)", ErrBadName, name, MaxNameLen)
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' && r != '-' {
+			return fmt.Errorf("%w %q (want a-z, 0-9, _ or -)", ErrBadName, name)
+		}
+	}
+	return nil
+}
+
+// Check validates ks against a cluster of nodes nodes. fixedN is the
+// cluster's N when replica placement ignores it (per-datacenter
+// replication), 0 otherwise.
+func (ks Keyspace) Check(nodes, fixedN int) error {
+	if err := CheckName(ks.Name); err != nil {
+		return err
+	}
+	switch {
+	case ks.N < 1 || ks.N > nodes:
+		return fmt.Errorf("bad n=%d (nodes=%d)", ks.N, nodes)
+	case fixedN > 0 && ks.N != fixedN:
+		return fmt.Errorf("bad n=%d: per-datacenter replication places %d replicas", ks.N, fixedN)
+	case ks.R < 1 || ks.R > ks.N || ks.W < 1 || ks.W > ks.N:
+		return fmt.Errorf("bad quorum r=%d w=%d for n=%d", ks.R, ks.W, ks.N)
+	}
+	return nil
+}
+
+// Prefix is the internal key prefix of the keyspace name.
+func Prefix(name string) string { return "\x00" + name + "\x00" }
+
+// Key is the internal key of key in the keyspace name ("" is the default
+// keyspace, whose keys are unchanged).
+func Key(name, key string) string {
+	if name == "" {
+		return key
+	}
+	return Prefix(name) + key
+}
+
+// Split returns the keyspace and the client key of an internal key.
+func Split(key string) (name, rest string) {
+	if !strings.HasPrefix(key, "\x00") {
+		return "", key
+	}
+	i := strings.IndexByte(key[1:], 0)
+	if i < 0 {
+		return "", key
+	}
+	return key[1 : i+1], key[i+2:]
+}
+
+// Of returns the keyspace of an internal key.
+func Of(key string) string {
+	name, _ := Split(key)
+	return name
+}
+
+// Catalog is the cluster's set of keyspaces. Nodes adopt a catalog that
+// supersedes their own, through the admin API or gossip.
+type Catalog struct {
+	Version   uint64     `json:"version"`
+	Keyspaces []Keyspace `json:"keyspaces"` // sorted by name
+}
+
+// Supersedes reports whether c replaces other: it has a higher version or,
+// when two nodes made different changes at the same version, the higher
+// content hash. Every node thus settles on the same catalog.
+func (c Catalog) Supersedes(other Catalog) bool {
+	if c.Version != other.Version {
+		return c.Version > other.Version
+	}
+	x, y := c.hash(), other.hash()
+	return bytes.Compare(x[:], y[:]) > 0
+}
+
+func (c Catalog) hash() [sha256.Size]byte {
+	b, _ := json.Marshal(c)
+	return sha256.Sum256(b)
+}
+
+// Find returns the keyspace called name.
+func (c Catalog) Find(name string) (Keyspace, bool) {
+	i := sort.Search(len(c.Keyspaces), func(i int) bool { return c.Keyspaces[i].Name >= name })
+	if i < len(c.Keyspaces) && c.Keyspaces[i].Name == name {
+		return c.Keyspaces[i], true
+	}
+	return Keyspace{}, false
+}
+
+// With returns the next version of c with ks added.
+func (c Catalog) With(ks Keyspace) Catalog {
+	next := Catalog{Version: c.Version + 1, Keyspaces: append([]Keyspace(nil), c.Keyspaces...)}
+	ks.Created = next.Version
+	next.Keyspaces = append(next.Keyspaces, ks)
+	sort.Slice(next.Keyspaces, func(i, j int) bool { return next.Keyspaces[i].Name < next.Keyspaces[j].Name })
+	return next
+}
+
+// Without returns the next version of c with the keyspace name removed.
+func (c Catalog) Without(name string) Catalog {
+	next := Catalog{Version: c.Version + 1}
+	for _, ks := range c.Keyspaces {
+		if ks.Name != name {
+			next.Keyspaces = append(next.Keyspaces, ks)
+		}
+	}
+	return next
+}
+
+// Registry holds a node's catalog and saves every version it adopts.
+type Registry struct {
+	path string
+
+	mu  sync.RWMutex
+	cat Catalog
+}
+
+// Open loads the catalog saved at path, if any.
+func Open(path string) (*Registry, error) {
+	r := &Registry{path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &r.cat); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// Catalog returns the current catalog.
+func (r *Registry) Catalog() Catalog {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cat
+}
+
+// Lookup returns the keyspace called name.
+func (r *Registry) Lookup(name string) (Keyspace, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cat.Find(name)
+}
+
+// For returns the keyspace of an internal key; false for the default one.
+func (r *Registry) For(key string) (Keyspace, bool) {
+	name := Of(key)
+	if name == "" {
+		return Keyspace{}, false
+	}
+	return r.Lookup(name)
+}
+
+// Adopt installs cat if it supersedes the current catalog and saves it. It
+// returns the keyspaces that went away (or were recreated) and those that
+// are new, in that order of application; ok is false for a catalog that
+// does not supersede the current one.
+func (r *Registry) Adopt(cat Catalog) (dropped, created []Keyspace, ok bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !cat.Supersedes(r.cat) {
+		return nil, nil, false, nil
+	}
+	if err := r.save(cat); err != nil {
+		return nil, nil, false, err
+	}
+	for _, old := range r.cat.Keyspaces {
+		if ks, ok := cat.Find(old.Name); !ok || ks.Created != old.Created {
+			dropped = append(dropped, old)
+		}
+	}
+	for _, ks := range cat.Keyspaces {
+		if old, ok := r.cat.Find(ks.Name); !ok || old.Created != ks.Created {
+			created = append(created, ks)
+		}
+	}
+	r.cat = cat
+	return dropped, created, true, nil
+}
+
+func (r *Registry) save(cat Catalog) error {
+	b, err := json.Marshal(cat)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	_ = os.Remove(r.path) // Windows-safe replace
+	return os.Rename(tmp, r.path)
+}
@@ -0,0 +1,131 @@
+package keyspace
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openRegistry(t *testing.T, cat Catalog) *Registry {
+	t.Helper()
+	r, err := Open(filepath.Join(t.TempDir(), "keyspaces.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := r.Adopt(cat); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func names(kss []Keyspace) []string {
+	var out []string
+	for _, ks := range kss {
+		out = append(out, ks.Name)
+	}
+	return out
+}
+
+// newest returns the keyspace that version cat.Version created.
+func newest(cat Catalog) string {
+	for _, ks := range cat.Keyspaces {
+		if ks.Created == cat.Version {
+			return ks.Name
+		}
+	}
+	return ""
+}
+
+// conflict returns two catalogs made from the same one by different nodes,
+// each creating its own keyspace, ordered so that winner supersedes loser.
+func conflict(t *testing.T) (base, winner, loser Catalog) {
+	t.Helper()
+	base = Catalog{}.With(Keyspace{Name: "shared", N: 3, R: 2, W: 2})
+	winner = base.With(Keyspace{Name: "orders", N: 3, R: 2, W: 2})
+	loser = base.With(Keyspace{Name: "users", N: 3, R: 2, W: 2})
+	if winner.Version != loser.Version {
+		t.Fatalf("versions %d and %d, want equal", winner.Version, loser.Version)
+	}
+	if loser.Supersedes(winner) {
+		winner, loser = loser, winner
+	}
+	if !winner.Supersedes(loser) {
+		t.Fatal("neither catalog supersedes the other")
+	}
+	return base, winner, loser
+}
+
+// Whichever order two conflicting catalogs reach a node in, it ends up with
+// the same one.
+func TestConflictingCatalogsConverge(t *testing.T) {
+	base, winner, loser := conflict(t)
+
+	tests := []struct {
+		name  string
+		order []Catalog // adopted after base, in this order
+	}{
+		{"winner first", []Catalog{winner, loser}},
+		{"loser first", []Catalog{loser, winner}},
+		{"loser again", []Catalog{loser, winner, loser}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := openRegistry(t, base)
+			for _, cat := range tt.order {
+				if _, _, _, err := r.Adopt(cat); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := r.Catalog(); !reflect.DeepEqual(got, winner) {
+				t.Fatalf("catalog %v, want %v", names(got.Keyspaces), names(winner.Keyspaces))
+			}
+
+			reopened, err := Open(r.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := reopened.Catalog(); !reflect.DeepEqual(got, winner) {
+				t.Fatalf("reopened catalog %v, want %v", names(got.Keyspaces), names(winner.Keyspaces))
+			}
+		})
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	base, winner, loser := conflict(t)
+	newer := winner.Without("shared")
+	won, lost := newest(winner), newest(loser)
+
+	tests := []struct {
+		name        string
+		from, cat   Catalog
+		wantOK      bool
+		wantDropped []string
+		wantCreated []string
+	}{
+		{"newer version", base, winner, true, nil, []string{won}},
+		{"older version", winner, base, false, nil, nil},
+		{"same catalog", winner, winner, false, nil, nil},
+		{"tie won", loser, winner, true, []string{lost}, []string{won}},
+		{"tie lost", winner, loser, false, nil, nil},
+		{"newer version after a tie", loser, newer, true, names(loser.Keyspaces), []string{won}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := openRegistry(t, tt.from)
+			dropped, created, ok, err := r.Adopt(tt.cat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if got := names(dropped); !reflect.DeepEqual(got, tt.wantDropped) {
+				t.Errorf("dropped %v, want %v", got, tt.wantDropped)
+			}
+			if got := names(created); !reflect.DeepEqual(got, tt.wantCreated) {
+				t.Errorf("created %v, want %v", got, tt.wantCreated)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package membership
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"mini-dynamo/internal/keyspace"
+	"mini-dynamo/internal/ring"
+	"mini-dynamo/internal/transport"
+	"mini-dynamo/internal/types"
+)
+
+type Status string
+
+const (
+	Alive   Status = "alive"
+	Suspect Status = "suspect"
+	Dead    Status = "dead"
+)
+
+type Config struct {
+	Interval     time.Duration // how often to gossip with one random peer
+	SuspectAfter time.Duration // no heartbeat progress for this long -> suspect
+	DeadAfter    time.Duration // no heartbeat progress for this long -> dead
+	Timeout      time.Duration // per gossip round trip
+
+	// Layout and Adopt piggyback the committed ring on gossip so a node that
+	// missed a layout commit catches up. Both are optional.
+	Layout func() ring.Layout
+	Adopt  func(ring.Layout)
+
+	// Keyspaces and AdoptKeyspaces do the same for the keyspace catalog.
+	Keyspaces      func() keyspace.Catalog
+	AdoptKeyspaces func(keyspace.Catalog)
+}
+
+type member struct {
+	info       types.NodeInfo
+	generation int64  // start time of the member's current process
+	heartbeat  uint64 // bumped by the member on every gossip tick
+	updated    time.Time
+	status     Status
+}
+
+// Member is a read-only view of one peer for debug output.
+type Member struct {
+	ID         string `json:"id"`
+	Addr       string `json:"addr"`
+	Status     Status `json:"status"`
+	Generation int64  `json:"generation"`
+	Heartbeat  uint64 `json:"heartbeat"`
+	AgeMs      int64  `json:"age_ms"`
+}
+
+// List tracks peer liveness through heartbeat gossip.
+// A member whose (generation, heartbeat) has not advanced recently is
+// first suspected and later declared dead; any newer heartbeat revives it.
+type List struct {
+	mu     sync.Mutex
+	self   string
+	m      map[string]*member
+	cfg    Config
+	client *transport.Client
+}
+
+func New(self types.NodeInfo, nodes []types.NodeInfo, cl *transport.Client, cfg Config) *List {
+	now := time.Now()
+	l := &List{
+		self:   self.ID,
+		m:      make(map[string]*member, len(nodes)),
+		cfg:    cfg,
+		client: cl,
+	}
+	// Peers start optimistic: alive until their heartbeats stop arriving.
+	for _, n := range nodes {
+		l.m[n.ID] = &member{info: n, updated: now, status: Alive}
+	}
+	l.m[self.ID] = &member{info: self, generation: now.UnixNano(), updated: now, status: Alive}
+	return l
+}
+
+// Alive reports whether id is believed alive (not suspect, not dead).
+// Unknown nodes are assumed alive so callers fall back to timeouts.
+func (l *List) Alive(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m, ok := l.m[id]
+	return !ok || m.status == Alive
+}
+
+// Dead reports whether id has been declared dead.
+func (l *List) Dead(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m, ok := l.m[id]
+	return ok && m.status == Dead
+}
+
+// Members returns the current membership view sorted by ID.
+func (l *List) Members() []Member {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	out := make([]Member, 0, len(l.m))
+	for id, m := range l.m {
+		out = append(out, Member{
+			ID:         id,
+			Addr:       m.info.Addr,
+			Status:     m.status,
+			Generation: m.generation,
+			Heartbeat:  m.heartbeat,
+			AgeMs:      int64(now.Sub(m.updated) / time.Millisecond),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// SetNodes makes the member set match nodes (self is always kept).
+// New nodes start alive; nodes no longer listed are forgotten.
+func (l *List) SetNodes(nodes []types.NodeInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	keep := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		keep[n.ID] = true
+		if _, ok := l.m[n.ID]; !ok {
+			l.m[n.ID] = &member{info: n, updated: now, status: Alive}
+		}
+	}
+	for id := range l.m {
+		if id != l.self && !keep[id] {
+			delete(l.m, id)
+		}
+	}
+}
+
+// HandleGossip is the server side of /internal/gossip.
+func (l *List) HandleGossip(req transport.GossipRequest) transport.GossipResponse {
+	l.adopt(req.Layout)
+	l.adoptKeyspaces(req.Keyspaces)
+	return transport.GossipResponse{Members: l.Merge(req.Members), Layout: l.layout(), Keyspaces: l.keyspaces()}
+}
+
+func (l *List) layout() *ring.Layout {
+	if l.cfg.Layout == nil {
+		return nil
+	}
+	lay := l.cfg.Layout()
+	return &lay
+}
+
+func (l *List) adopt(lay *ring.Layout) {
+	if lay != nil && l.cfg.Adopt != nil {
+		l.cfg.Adopt(*lay)
+	}
+}
+
+// keyspaces returns the catalog to gossip; nil until a keyspace exists.
+func (l *List) keyspaces() *keyspace.Catalog {
+	if l.cfg.Keyspaces == nil {
+		return nil
+	}
+	cat := l.cfg.Keyspaces()
+	if cat.Version == 0 {
+		return nil
+	}
+	return &cat
+}
+
+func (l *List) adoptKeyspaces(cat *keyspace.Catalog) {
+	if cat != nil && l.cfg.AdoptKeyspaces != nil {
+		l.cfg.AdoptKeyspaces(*cat)
+	}
+}
+
+// Merge folds a peer's digests into the local view and returns ours.
+// Digests for nodes outside the ring are ignored; membership follows the layout.
+func (l *List) Merge(in []transport.MemberDigest) []transport.MemberDigest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, d := range in {
+		if d.ID == "" || d.ID == l.self {
+			continue
+		}
+		cur, ok := l.m[d.ID]
+		if !ok {
+			continue
+		}
+		if d.Generation > cur.generation || (d.Generation == cur.generation && d.Heartbeat > cur.heartbeat) {
+			cur.generation = d.Generation
+			cur.heartbeat = d.Heartbeat
+			cur.updated = now
+			cur.status = Alive
+			if d.Addr != "" {
+				cur.info.Addr = d.Addr
+			}
+		}
+	}
+	return l.digestsLocked()
+}
+
+func (l *List) digestsLocked() []transport.MemberDigest {
+	out := make([]transport.MemberDigest, 0, len(l.m))
+	for id, m := range l.m {
+		out = append(out, transport.MemberDigest{
+			ID:         id,
+			Addr:       m.info.Addr,
+			Generation: m.generation,
+			Heartbeat:  m.heartbeat,
+		})
+	}
+	return out
+}
+
+// Run gossips until ctx is cancelled.
+func (l *List) Run(ctx context.Context) {
+	t := time.NewTicker(l.cfg.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			l.tick(ctx)
+		}
+	}
+}
+
+func (l *List) tick(ctx context.Context) {
+	l.mu.Lock()
+	now := time.Now()
+	self := l.m[l.self]
+	self.heartbeat++
+	self.updated = now
+
+	// Age out peers whose heartbeats stopped.
+	peers := make([]types.NodeInfo, 0, len(l.m))
+	for id, m := range l.m {
+		if id == l.self {
+			continue
+		}
+		age := now.Sub(m.updated)
+		switch {
+		case age > l.cfg.DeadAfter:
+			m.status = Dead
+		case age > l.cfg.SuspectAfter:
+			m.status = Suspect
+		}
+		peers = append(peers, m.info)
+	}
+	digests := l.digestsLocked()
+	l.mu.Unlock()
+
+	if len(peers) == 0 {
+		return
+	}
+
+	// Dead peers stay in the candidate set so a restarted node is noticed.
+	peer := peers[rand.Intn(len(peers))]
+
+	ctx2, cancel := context.WithTimeout(ctx, l.cfg.Timeout)
+	defer cancel()
+
+	var resp transport.GossipResponse
+	req := transport.GossipRequest{From: l.self, Members: digests, Layout: l.layout(), Keyspaces: l.keyspaces()}
+	err := l.client.PostJSON(ctx2, baseURL(peer.Addr)+"/internal/gossip", req, &resp)
+	if err != nil {
+		return
+	}
+	l.Merge(resp.Members)
+	l.adopt(resp.Layout)
+	l.adoptKeyspaces(resp.Keyspaces)
+}
+
+func baseURL(addr string) string {
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return addr
+	}
+	return "http://" + addr
+}
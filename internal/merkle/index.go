@@ -0,0 +1,253 @@
+package merkle
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/bits"
+	"sort"
+	"sync"
+
+	"mini-dynamo/internal/keyspace"
+	"mini-dynamo/internal/ring"
+	"mini-dynamo/internal/store"
+)
+
+// Index keeps one Merkle tree per token range this node replicates, for each
+// keyspace: keyspaces with different N replicate different ranges.
+// It remembers each key's current digest, so setting a key is idempotent and
+// a rebuild can overlap with live updates without double counting, and the
+// keys under each leaf, so anti-entropy can list a differing leaf without
+// going through every key.
+type Index struct {
+	mu      sync.Mutex
+	ring    ring.Ring
+	self    string
+	depth   int
+	spaces  map[string]*space // by keyspace name, "" the default one
+	digests map[string]uint64
+}
+
+// space is the trees of one keyspace.
+type space struct {
+	n     int
+	trees map[uint64]*Tree // by Range.End
+	keys  map[leafID]map[string]struct{}
+}
+
+// leafID names a leaf of one of a space's trees.
+type leafID struct {
+	end  uint64 // Range.End of the tree
+	leaf int
+}
+
+// NewIndex indexes the default keyspace, replicated n times.
+func NewIndex(rg ring.Ring, selfID string, n, depth int) *Index {
+	idx := &Index{
+		ring:    rg,
+		self:    selfID,
+		depth:   depth,
+		spaces:  make(map[string]*space),
+		digests: make(map[string]uint64),
+	}
+	idx.spaces[""] = idx.newSpace(n)
+	return idx
+}
+
+func (x *Index) newSpace(n int) *space {
+	sp := &space{n: n, trees: make(map[uint64]*Tree), keys: make(map[leafID]map[string]struct{})}
+	for _, r := range x.ring.Ranges(x.self, n) {
+		sp.trees[r.End] = NewTree(x.depth)
+	}
+	return sp
+}
+
+func (x *Index) Depth() int { return x.depth }
+
+// AddKeyspace indexes keyspace name, replicated n times. Its keys already
+// in the engine are only picked up by the next Rebuild.
+func (x *Index) AddKeyspace(name string, n int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.spaces[name] = x.newSpace(n)
+}
+
+// DropKeyspace forgets keyspace name and its keys.
+func (x *Index) DropKeyspace(name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.spaces, name)
+	for key := range x.digests {
+		if keyspace.Of(key) == name {
+			delete(x.digests, key)
+		}
+	}
+}
+
+// Keyspaces lists the indexed keyspaces.
+func (x *Index) Keyspaces() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	out := make([]string, 0, len(x.spaces))
+	for name := range x.spaces {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Rebuild switches to rg and resets every tree from a full engine scan.
+func (x *Index) Rebuild(rg ring.Ring, eng store.Engine) error {
+	x.mu.Lock()
+	x.ring = rg
+	for name, sp := range x.spaces {
+		x.spaces[name] = x.newSpace(sp.n)
+	}
+	x.digests = make(map[string]uint64)
+	x.mu.Unlock()
+
+	return eng.Scan("", func(key string, sibs []store.Record) bool {
+		x.Update(key, nil, sibs)
+		return true
+	})
+}
+
+// Update records a key's new siblings. Matches store.Engine.Observe.
+func (x *Index) Update(key string, _, after []store.Record) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	sp, ok := x.spaces[keyspace.Of(key)]
+	if !ok {
+		return
+	}
+	rg, leaf := x.locateLocked(key)
+	t, ok := sp.trees[rg.End]
+	if !ok {
+		return
+	}
+	t.Toggle(leaf, x.digests[key])
+	id := leafID{rg.End, leaf}
+	if len(after) == 0 { // purged
+		delete(x.digests, key)
+		if set := sp.keys[id]; set != nil {
+			delete(set, key)
+			if len(set) == 0 {
+				delete(sp.keys, id)
+			}
+		}
+		return
+	}
+	d := Digest(key, after)
+	t.Toggle(leaf, d)
+	x.digests[key] = d
+	set := sp.keys[id]
+	if set == nil {
+		set = make(map[string]struct{})
+		sp.keys[id] = set
+	}
+	set[key] = struct{}{}
+}
+
+// LeafKeys returns the keys under the given leaves of the range of keyspace
+// ks ending at end, in no particular order.
+func (x *Index) LeafKeys(ks string, end uint64, leaves []int) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	sp, ok := x.spaces[ks]
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, leaf := range leaves {
+		for key := range sp.keys[leafID{end, leaf}] {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+func (x *Index) locateLocked(key string) (ring.Range, int) {
+	tok := x.ring.Token(key)
+	rg := x.ring.RangeFor(tok)
+	return rg, bucket(rg, tok, x.depth)
+}
+
+// SharedRanges returns the ranges of keyspace ks replicated by both this
+// node and peerID.
+func (x *Index) SharedRanges(ks, peerID string) []ring.Range {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	out := make([]ring.Range, 0)
+	sp, ok := x.spaces[ks]
+	if !ok {
+		return out
+	}
+	for _, r := range x.ring.Ranges(peerID, sp.n) {
+		if _, ok := sp.trees[r.End]; ok {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Hashes returns node hashes at level for the range of keyspace ks ending
+// at end. Ranges this node does not replicate look empty.
+func (x *Index) Hashes(ks string, end uint64, level int, nodes []int) []uint64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	sp, ok := x.spaces[ks]
+	if !ok {
+		return make([]uint64, len(nodes))
+	}
+	t, ok := sp.trees[end]
+	if !ok {
+		return make([]uint64, len(nodes))
+	}
+	return t.Hashes(level, nodes)
+}
+
+// bucket maps token proportionally onto the 2^depth leaves of rg.
+func bucket(rg ring.Range, token uint64, depth int) int {
+	offset := token - rg.Start - 1
+	width := rg.End - rg.Start
+	if width == 0 {
+		// Single vnode: the range is the whole ring.
+		return int(offset >> (64 - depth))
+	}
+	hi, lo := bits.Mul64(offset, 1<<depth)
+	q, _ := bits.Div64(hi, lo, width)
+	return int(q)
+}
+
+// Digest fingerprints a key's sibling versions. Values are not hashed:
+// a version (clock, ts, writer) identifies its value.
+func Digest(key string, sibs []store.Record) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	_, _ = h.Write([]byte(key))
+	for _, s := range sibs {
+		binary.BigEndian.PutUint64(buf[:], uint64(s.Ts))
+		_, _ = h.Write(buf[:])
+		_, _ = h.Write([]byte(s.WriterID))
+		if s.Deleted {
+			_, _ = h.Write([]byte{1})
+		} else {
+			_, _ = h.Write([]byte{0})
+		}
+
+		ids := make([]string, 0, len(s.Clock))
+		for id := range s.Clock {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			_, _ = h.Write([]byte(id))
+			binary.BigEndian.PutUint64(buf[:], s.Clock[id])
+			_, _ = h.Write(buf[:])
+		}
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,75 @@
+package merkle
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// Tree is a fixed-depth binary hash tree over one token range.
+// Leaves are XORs of per-key digests, so a key change is an O(1) leaf update;
+// inner levels are recomputed lazily the next time they are read.
+type Tree struct {
+	depth  int
+	levels [][]uint64 // levels[0] is the root, levels[depth] the leaves
+	dirty  bool
+}
+
+func NewTree(depth int) *Tree {
+	levels := make([][]uint64, depth+1)
+	for l := range levels {
+		levels[l] = make([]uint64, 1<<l)
+	}
+	return &Tree{depth: depth, levels: levels}
+}
+
+func (t *Tree) Depth() int { return t.depth }
+
+// Toggle XORs digest into a leaf. Calling it twice with the same digest undoes it.
+func (t *Tree) Toggle(leaf int, digest uint64) {
+	if digest == 0 {
+		return
+	}
+	t.levels[t.depth][leaf] ^= digest
+	t.dirty = true
+}
+
+// Hashes returns the hashes of the given node indexes at level.
+// Out-of-range levels or indexes hash to 0.
+func (t *Tree) Hashes(level int, nodes []int) []uint64 {
+	t.rehash()
+
+	out := make([]uint64, len(nodes))
+	if level < 0 || level > t.depth {
+		return out
+	}
+	for i, n := range nodes {
+		if n >= 0 && n < len(t.levels[level]) {
+			out[i] = t.levels[level][n]
+		}
+	}
+	return out
+}
+
+func (t *Tree) rehash() {
+	if !t.dirty {
+		return
+	}
+	for l := t.depth - 1; l >= 0; l-- {
+		for i := range t.levels[l] {
+			t.levels[l][i] = combine(t.levels[l+1][2*i], t.levels[l+1][2*i+1])
+		}
+	}
+	t.dirty = false
+}
+
+func combine(left, right uint64) uint64 {
+	if left == 0 && right == 0 {
+		return 0
+	}
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], left)
+	binary.BigEndian.PutUint64(buf[8:], right)
+	h := fnv.New64a()
+	_, _ = h.Write(buf[:])
+	return h.Sum64()
+}
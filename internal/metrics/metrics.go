@@ -0,0 +1,313 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small Prometheus client: counters, gauges and histograms with labels,
+// written in the text exposition format. Metrics are package variables of
+// the code they instrument, registered with Default when declared.
+
+// DefBuckets are latency buckets in seconds, from 0.5ms to 10s.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a set of metrics, written sorted by name.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	write(w *bufio.Writer, name string)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// Default holds every metric declared with the package functions.
+var Default = NewRegistry()
+
+func (r *Registry) register(name, help, typ string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.metrics[name]; dup {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.metrics[name] = described{help: help, typ: typ, metric: m}
+}
+
+type described struct {
+	help, typ string
+	metric
+}
+
+func (d described) write(w *bufio.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, d.help, name, d.typ)
+	d.metric.write(w, name)
+}
+
+// WriteText writes every metric in the Prometheus text format.
+func (r *Registry) WriteText(out io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ms := make([]metric, len(names))
+	for i, name := range names {
+		ms[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	w := bufio.NewWriter(out)
+	for i, m := range ms {
+		m.write(w, names[i])
+	}
+	return w.Flush()
+}
+
+// Handler serves r at a Prometheus scrape endpoint.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteText(w)
+	})
+}
+
+// vec keeps one value per combination of label values.
+type vec[T any] struct {
+	labels []string
+	mu     sync.Mutex
+	series map[string]*T // by joined label values
+	values map[string][]string
+	init   func() *T
+}
+
+func newVec[T any](labels []string, init func() *T) *vec[T] {
+	v := &vec[T]{labels: labels, series: make(map[string]*T), values: make(map[string][]string), init: init}
+	if len(labels) == 0 {
+		v.get(nil) // a metric without labels is exported from the start
+	}
+	return v
+}
+
+func (v *vec[T]) get(lvs []string) *T {
+	if len(lvs) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: got %d label values for labels %v", len(lvs), v.labels))
+	}
+	k := strings.Join(lvs, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[k]
+	if !ok {
+		s = v.init()
+		v.series[k] = s
+		v.values[k] = append([]string(nil), lvs...)
+	}
+	return s
+}
+
+// each calls fn for every series, sorted by label values.
+func (v *vec[T]) each(fn func(labels string, s *T)) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]*T, len(keys))
+	labels := make([]string, len(keys))
+	for i, k := range keys {
+		series[i], labels[i] = v.series[k], labelPairs(v.labels, v.values[k])
+	}
+	v.mu.Unlock()
+	for i := range keys {
+		fn(labels[i], series[i])
+	}
+}
+
+// labelPairs renders names and values as `a="x",b="y"`.
+func labelPairs(names, values []string) string {
+	var b strings.Builder
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(escape(values[i]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// braces wraps label pairs, joined with extra ones, for a sample line.
+func braces(pairs ...string) string {
+	var nonEmpty []string
+	for _, p := range pairs {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(nonEmpty, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// value is a float64 guarded by a mutex.
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (x *value) add(d float64) {
+	x.mu.Lock()
+	x.v += d
+	x.mu.Unlock()
+}
+
+func (x *value) load() float64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.v
+}
+
+// Counter only goes up.
+type Counter struct{ v *vec[value] }
+
+// NewCounter declares a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{v: newVec(labels, func() *value { return new(value) })}
+	Default.register(name, help, "counter", c)
+	return c
+}
+
+// Inc adds 1 to the series of the label values lvs.
+func (c *Counter) Inc(lvs ...string) { c.Add(1, lvs...) }
+
+// Add adds d (>= 0) to the series of the label values lvs.
+func (c *Counter) Add(d float64, lvs ...string) {
+	if d < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.v.get(lvs).add(d)
+}
+
+func (c *Counter) write(w *bufio.Writer, name string) {
+	c.v.each(func(labels string, x *value) {
+		fmt.Fprintf(w, "%s%s %s\n", name, braces(labels), formatFloat(x.load()))
+	})
+}
+
+// GaugeFunc is a gauge read at scrape time, one series per value of label.
+type GaugeFunc struct {
+	label string
+	fn    func() map[string]float64
+}
+
+// NewGaugeFunc declares a gauge whose series fn returns, keyed by the value
+// of label. With label "", fn returns a single series under the key "".
+func NewGaugeFunc(name, help, label string, fn func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{label: label, fn: fn}
+	Default.register(name, help, "gauge", g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer, name string) {
+	vals := g.fn()
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		labels := ""
+		if g.label != "" {
+			labels = labelPairs([]string{g.label}, []string{k})
+		}
+		fmt.Fprintf(w, "%s%s %s\n", name, braces(labels), formatFloat(vals[k]))
+	}
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	buckets []float64
+	v       *vec[histo]
+}
+
+type histo struct {
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+}
+
+// NewHistogram declares a histogram with the given upper bounds (sorted)
+// and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{buckets: buckets}
+	h.v = newVec(labels, func() *histo { return &histo{counts: make([]uint64, len(buckets)+1)} })
+	Default.register(name, help, "histogram", h)
+	return h
+}
+
+// Observe records v in the series of the label values lvs.
+func (h *Histogram) Observe(v float64, lvs ...string) {
+	s := h.v.get(lvs)
+	i := sort.SearchFloat64s(h.buckets, v)
+	s.mu.Lock()
+	s.counts[i]++
+	s.sum += v
+	s.mu.Unlock()
+}
+
+// Since records the seconds elapsed since start.
+func (h *Histogram) Since(start time.Time, lvs ...string) {
+	h.Observe(time.Since(start).Seconds(), lvs...)
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string) {
+	h.v.each(func(labels string, s *histo) {
+		s.mu.Lock()
+		counts := append([]uint64(nil), s.counts...)
+		sum := s.sum
+		s.mu.Unlock()
+
+		var total uint64
+		for i, c := range counts {
+			total += c
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(labels, `le="`+formatFloat(le)+`"`), total)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), total)
+	})
+}
@@ -0,0 +1,279 @@
+package paxos
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"mini-dynamo/internal/store"
+)
+
+// Ballot orders proposals. N is a wall-clock seeded counter; Node breaks ties
+// so two proposers never share a ballot.
+type Ballot struct {
+	N    int64  `json:"n"`
+	Node string `json:"node,omitempty"`
+}
+
+func (b Ballot) Less(o Ballot) bool {
+	if b.N != o.N {
+		return b.N < o.N
+	}
+	return b.Node < o.Node
+}
+
+func (b Ballot) IsZero() bool { return b.N == 0 && b.Node == "" }
+
+// State is one key's single-decree Paxos state on an acceptor. After a
+// commit the instance is reused for the next operation on the key (as in
+// Cassandra LWT), so Value only holds an accepted but uncommitted proposal.
+type State struct {
+	Promised  Ballot        `json:"promised"`
+	Accepted  Ballot        `json:"accepted"`
+	Value     *store.Record `json:"value,omitempty"`
+	Committed Ballot        `json:"committed"`
+}
+
+// logEntry is one line of the acceptor log. The entry with an empty key
+// records the floor.
+type logEntry struct {
+	Key   string `json:"key"`
+	State State  `json:"state"`
+}
+
+// Acceptor holds per-key Paxos state. Every change is appended and fsynced
+// to a log before it is acknowledged, so promises survive a restart.
+//
+// Prune drops the state of instances that are closed and idle. Their highest
+// promise is kept as the floor, which every key without state starts from,
+// so a dropped promise still refuses the ballots below it.
+type Acceptor struct {
+	mu     sync.Mutex
+	states map[string]State
+	floor  Ballot
+	path   string
+	f      *os.File
+	ops    int
+	pruned int
+}
+
+// Open replays the acceptor log at path (if any) and appends to it.
+func Open(path string) (*Acceptor, error) {
+	if path == "" {
+		return nil, errors.New("paxos log path is empty")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	a := &Acceptor{states: make(map[string]State), path: path}
+	if err := a.replay(); err != nil {
+		return nil, err
+	}
+	if err := a.rewrite(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Acceptor) replay() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var e logEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			break // torn tail from a crash mid-append
+		}
+		if e.Key == "" {
+			a.floor = e.State.Promised
+			continue
+		}
+		a.states[e.Key] = e.State
+	}
+	return sc.Err()
+}
+
+// rewrite replaces the log with one entry per key and reopens it for appends.
+func (a *Acceptor) rewrite() error {
+	if a.f != nil {
+		_ = a.f.Close()
+		a.f = nil
+	}
+
+	tmp := a.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	if !a.floor.IsZero() {
+		if err := enc.Encode(logEntry{State: State{Promised: a.floor}}); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	for k, st := range a.states {
+		if err := enc.Encode(logEntry{Key: k, State: st}); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	_ = f.Close()
+
+	_ = os.Remove(a.path) // Windows-safe replace
+	if err := os.Rename(tmp, a.path); err != nil {
+		return err
+	}
+	a.f, err = os.OpenFile(a.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	a.ops = 0
+	return err
+}
+
+func (a *Acceptor) saveLocked(key string, st State) error {
+	b, err := json.Marshal(logEntry{Key: key, State: st})
+	if err != nil {
+		return err
+	}
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	a.states[key] = st
+	a.ops++
+	if a.ops > 4*len(a.states)+1000 {
+		return a.rewrite()
+	}
+	return nil
+}
+
+// stateLocked returns key's state, starting from the floor if it has none.
+func (a *Acceptor) stateLocked(key string) State {
+	if st, ok := a.states[key]; ok {
+		return st
+	}
+	return State{Promised: a.floor}
+}
+
+// Prepare promises not to accept anything below b. It reports whether the
+// promise was made, and the key's state either way.
+func (a *Acceptor) Prepare(key string, b Ballot) (bool, State, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st := a.stateLocked(key)
+	if !st.Promised.Less(b) {
+		return false, st, nil
+	}
+	st.Promised = b
+	if err := a.saveLocked(key, st); err != nil {
+		return false, a.stateLocked(key), err
+	}
+	return true, st, nil
+}
+
+// Accept accepts rec under b unless a higher ballot has been promised.
+func (a *Acceptor) Accept(key string, b Ballot, rec store.Record) (bool, State, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st := a.stateLocked(key)
+	if b.Less(st.Promised) {
+		return false, st, nil
+	}
+	st.Promised, st.Accepted, st.Value = b, b, &rec
+	if err := a.saveLocked(key, st); err != nil {
+		return false, a.stateLocked(key), err
+	}
+	return true, st, nil
+}
+
+// Commit records that the proposal under b was applied to the store, which
+// closes the instance. The caller applies the value itself, before calling
+// Commit, so a cleared Value is always already in the store.
+func (a *Acceptor) Commit(key string, b Ballot) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st := a.stateLocked(key)
+	if !st.Committed.Less(b) {
+		return nil
+	}
+	st.Committed = b
+	if !b.Less(st.Accepted) {
+		st.Value = nil
+	}
+	return a.saveLocked(key, st)
+}
+
+// Prune drops the state of every key whose instance is closed (no accepted
+// value is waiting for its commit) and whose last promise is older than
+// before, a ballot counter (unix nanoseconds). It raises the floor to the
+// highest promise dropped and compacts the log.
+func (a *Acceptor) Prune(before int64) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := 0
+	for k, st := range a.states {
+		if st.Value != nil || st.Promised.N >= before {
+			continue
+		}
+		if a.floor.Less(st.Promised) {
+			a.floor = st.Promised
+		}
+		delete(a.states, k)
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	a.pruned += n
+	return n, a.rewrite()
+}
+
+func (a *Acceptor) Stats() map[string]any {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	inflight := 0
+	for _, st := range a.states {
+		if st.Value != nil {
+			inflight++
+		}
+	}
+	return map[string]any{"log": a.path, "keys": len(a.states), "in_progress": inflight, "log_ops": a.ops, "pruned": a.pruned, "floor": a.floor}
+}
+
+func (a *Acceptor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
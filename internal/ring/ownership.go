@@ -0,0 +1,73 @@
+package ring
+
+import (
+	"math"
+	"sort"
+)
+
+// Ownership is one node's share of the keyspace.
+type Ownership struct {
+	ID      string  `json:"id"`
+	DC      string  `json:"dc,omitempty"`
+	Weight  float64 `json:"weight"`
+	VNodes  int     `json:"vnodes"`
+	Percent float64 `json:"percent"` // of the keyspace this node holds a replica of
+	Target  float64 `json:"target"`  // Percent if ownership followed weight exactly
+}
+
+// Ownership reports what share of the keyspace each node holds a replica of
+// when keys are stored on N replicas; the percentages sum to N*100. Nodes
+// come in ID order.
+func (r Ring) Ownership(N int) []Ownership {
+	byID := make(map[string]*Ownership)
+	var out []*Ownership
+	for _, vn := range r.VNodes {
+		o, ok := byID[vn.Node.ID]
+		if !ok {
+			o = &Ownership{ID: vn.Node.ID, DC: vn.Node.DC, Weight: weight(vn.Node)}
+			byID[vn.Node.ID] = o
+			out = append(out, o)
+		}
+		o.VNodes++
+	}
+
+	const space = float64(math.MaxUint64) + 1
+	for i, vn := range r.VNodes {
+		span := space
+		if len(r.VNodes) > 1 {
+			span = float64(vn.Token - r.VNodes[(i+len(r.VNodes)-1)%len(r.VNodes)].Token)
+		}
+		for _, n := range r.replicasAt(i, N) {
+			byID[n.ID].Percent += 100 * span / space
+		}
+	}
+
+	// Targets: each group's replicas spread by weight, at most one per key.
+	groupWeight := make(map[string]float64)
+	for _, o := range out {
+		groupWeight[r.group(o.DC)] += o.Weight
+	}
+	for _, o := range out {
+		rf := N
+		if len(r.Replication) > 0 {
+			rf = r.Replication[o.DC]
+		}
+		o.Target = math.Min(100, float64(rf)*100*o.Weight/groupWeight[r.group(o.DC)])
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	res := make([]Ownership, len(out))
+	for i, o := range out {
+		res[i] = *o
+	}
+	return res
+}
+
+// group is the placement group of a datacenter: itself under per-DC
+// replication, otherwise the whole ring.
+func (r Ring) group(dc string) string {
+	if len(r.Replication) > 0 {
+		return dc
+	}
+	return ""
+}
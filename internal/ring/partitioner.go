@@ -0,0 +1,221 @@
+package ring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"mini-dynamo/internal/types"
+)
+
+// Partitioner decides where keys live: it maps keys onto the 64-bit token
+// space and lays the ring's vnodes out over it.
+//
+// Token-ring partitioners (fnv, murmur3) give every node vnodes at tokens of
+// their own and walk clockwise from a key's token to find its replicas.
+// Partitioned ones (rendezvous, jump) cut the token space into a fixed number
+// of equal ranges and rank the nodes per range; VNode.Prefs holds the
+// ranking, which replaces the clockwise walk. Either way the rest of the
+// system sees ranges, so anti-entropy and range streaming work unchanged.
+type Partitioner interface {
+	Name() string
+	// Config identifies everything that affects placement (name and
+	// parameters). Data written under one config is misplaced under another.
+	Config() string
+	// Token maps a key onto the token space.
+	Token(key string) uint64
+	// VNodes lays out the ring for nodes. Token rings use tokens where given
+	// and hash vnodesPerNode per unit of weight otherwise; partitioned
+	// partitioners ignore both.
+	VNodes(nodes []types.NodeInfo, tokens map[string][]uint64, vnodesPerNode int) []VNode
+}
+
+// Partitioner names for Layout.Partitioner.
+const (
+	PartFNV        = "fnv" // default: FNV-1a token ring, the original layout
+	PartMurmur3    = "murmur3"
+	PartRendezvous = "rendezvous"
+	PartJump       = "jump"
+)
+
+// DefaultPartitions is the range count of partitioned partitioners when the
+// layout does not set one.
+const DefaultPartitions = 256
+
+// NewPartitioner returns the named partitioner. partitions only applies to
+// rendezvous and jump (0 = DefaultPartitions).
+func NewPartitioner(name string, partitions int) (Partitioner, error) {
+	if partitions == 0 {
+		partitions = DefaultPartitions
+	}
+	switch name {
+	case "", PartFNV:
+		return fnvRing, nil
+	case PartMurmur3:
+		return tokenRing{name: PartMurmur3, hash: func(s string) uint64 { return murmur3([]byte(s)) }}, nil
+	case PartRendezvous, PartJump:
+		if partitions < 1 {
+			return nil, fmt.Errorf("bad partitions=%d for %s", partitions, name)
+		}
+		return partitioned{name: name, partitions: partitions}, nil
+	default:
+		return nil, fmt.Errorf("unknown partitioner %q (want fnv, murmur3, rendezvous or jump)", name)
+	}
+}
+
+// ConfigHash fingerprints a partitioner's config for recording on disk.
+func ConfigHash(p Partitioner) string {
+	sum := sha256.Sum256([]byte(p.Config()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// IsTokenRing reports whether p places vnodes at per-node tokens, the only
+// kind balanced token allocation applies to.
+func IsTokenRing(p Partitioner) bool {
+	_, ok := p.(tokenRing)
+	return ok
+}
+
+type tokenRing struct {
+	name string
+	hash func(string) uint64
+}
+
+func (p tokenRing) Name() string            { return p.name }
+func (p tokenRing) Config() string          { return p.name }
+func (p tokenRing) Token(key string) uint64 { return p.hash(key) }
+
+func (p tokenRing) VNodes(nodes []types.NodeInfo, tokens map[string][]uint64, vnodesPerNode int) []VNode {
+	vnodes := make([]VNode, 0, len(nodes))
+	for _, n := range nodes {
+		ts, ok := tokens[n.ID]
+		if !ok {
+			ts = make([]uint64, vnodeCount(n, vnodesPerNode))
+			for i := range ts {
+				// Token for vnode i of node n
+				ts[i] = p.hash(n.ID + "#" + strconv.Itoa(i))
+			}
+		}
+		for i, token := range ts {
+			vnodes = append(vnodes, VNode{
+				Token:  token,
+				Node:   n,
+				VIndex: i,
+			})
+		}
+	}
+	return vnodes
+}
+
+// partitioned cuts the token space into equal ranges and ranks the nodes for
+// each range, by highest random weight (rendezvous) or jump consistent hash.
+type partitioned struct {
+	name       string
+	partitions int
+}
+
+func (p partitioned) Name() string            { return p.name }
+func (p partitioned) Config() string          { return p.name + "/partitions=" + strconv.Itoa(p.partitions) }
+func (p partitioned) Token(key string) uint64 { return murmur3([]byte(key)) }
+
+func (p partitioned) VNodes(nodes []types.NodeInfo, _ map[string][]uint64, _ int) []VNode {
+	if len(nodes) == 0 {
+		return nil
+	}
+	vnodes := make([]VNode, p.partitions)
+	for i := range vnodes {
+		var prefs []types.NodeInfo
+		if p.name == PartJump {
+			prefs = jumpRank(uint64(i), nodes)
+		} else {
+			prefs = rendezvousRank(uint64(i), nodes)
+		}
+		vnodes[i] = VNode{Token: partitionEnd(i, p.partitions), Node: prefs[0], VIndex: i, Prefs: prefs}
+	}
+	return vnodes
+}
+
+// partitionEnd is the last token of partition i of n equal partitions.
+func partitionEnd(i, n int) uint64 {
+	if i == n-1 {
+		return math.MaxUint64
+	}
+	q, _ := bits.Div64(uint64(i+1), 0, uint64(n))
+	return q - 1
+}
+
+// rendezvousRank orders nodes by weighted highest random weight for
+// partition p: score = -weight/ln(u), u uniform in (0,1) from hash(p, node).
+// Adding or removing a node only moves the partitions it wins or held.
+func rendezvousRank(p uint64, nodes []types.NodeInfo) []types.NodeInfo {
+	type scored struct {
+		n     types.NodeInfo
+		score float64
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, p)
+	ss := make([]scored, len(nodes))
+	for i, n := range nodes {
+		h := murmur3(append(buf[:8:8], n.ID...))
+		u := (float64(h>>11) + 0.5) / (1 << 53)
+		ss[i] = scored{n: n, score: -weight(n) / math.Log(u)}
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].score != ss[j].score {
+			return ss[i].score > ss[j].score
+		}
+		return ss[i].n.ID < ss[j].n.ID
+	})
+	out := make([]types.NodeInfo, len(ss))
+	for i, s := range ss {
+		out[i] = s.n
+	}
+	return out
+}
+
+// jumpRank orders nodes for partition p by repeated jump consistent hash
+// over the nodes not yet chosen, in layout order. Each node gets one bucket
+// per unit of weight (rounded, at least one). Jump hash only moves the
+// minimum of keys when buckets are added or removed at the end, so it suits
+// clusters that grow by joins; decommissioning a node in the middle of the
+// layout moves much more.
+func jumpRank(p uint64, nodes []types.NodeInfo) []types.NodeInfo {
+	var buckets []types.NodeInfo
+	for _, n := range nodes {
+		for i := 0; i < vnodeCount(n, 1); i++ {
+			buckets = append(buckets, n)
+		}
+	}
+	out := make([]types.NodeInfo, 0, len(nodes))
+	key := fmix64(p + 1)
+	for len(buckets) > 0 {
+		b := jump(key, len(buckets))
+		chosen := buckets[b]
+		out = append(out, chosen)
+		rest := buckets[:0:0]
+		for _, n := range buckets {
+			if n.ID != chosen.ID {
+				rest = append(rest, n)
+			}
+		}
+		buckets = rest
+		key = fmix64(key)
+	}
+	return out
+}
+
+// jump is Lamping and Veach's jump consistent hash.
+func jump(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
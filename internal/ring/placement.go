@@ -0,0 +1,96 @@
+package ring
+
+import "mini-dynamo/internal/types"
+
+// Replica placement takes the nodes in the order the partitioner prefers
+// them for the key's range (clockwise from the key's token on a token ring),
+// but spreads replicas over racks: within a datacenter a node is
+// skipped while its rack already holds a replica and another rack of that
+// datacenter does not yet. Skipped nodes fill the remaining slots once every
+// rack is used (Cassandra's NetworkTopologyStrategy). With per-DC replication
+// each datacenter gets its own replica count; otherwise the whole cluster is
+// one group. Unlabelled nodes all share one rack, which gives the plain order.
+
+// replicasAt returns the replicas of the range ending at vnode start
+// followed by every other node in ring order, n nodes at most.
+func (r Ring) replicasAt(start, n int) []types.NodeInfo {
+	if len(r.Replication) == 0 && r.racksAll <= 1 {
+		return r.walk(start, n) // one rack: nothing to spread over
+	}
+	group := func(nd types.NodeInfo) string { return r.group(nd.DC) }
+	want := make(map[string]int)
+	racks := r.racks
+	if len(r.Replication) > 0 {
+		for dc, c := range r.Replication {
+			want[dc] = c
+		}
+	} else {
+		want[""] = n
+		racks = map[string]int{"": r.racksAll}
+	}
+	remaining := 0
+	for _, c := range want {
+		remaining += c
+	}
+
+	var (
+		out     = make([]types.NodeInfo, 0, n)
+		order   = make([]types.NodeInfo, 0, n) // distinct nodes in walk order
+		placed  = make(map[string]bool)
+		used    = make(map[string]map[types.NodeInfo]bool) // group -> racks holding a replica
+		skipped = make(map[string][]types.NodeInfo)
+	)
+	place := func(nd types.NodeInfo) {
+		g := group(nd)
+		out = append(out, nd)
+		placed[nd.ID] = true
+		want[g]--
+		remaining--
+		if used[g] == nil {
+			used[g] = make(map[types.NodeInfo]bool)
+		}
+		used[g][types.NodeInfo{DC: nd.DC, Rack: nd.Rack}] = true
+	}
+
+	next := r.candidates(start)
+	for remaining > 0 || len(order) < n {
+		nd, ok := next()
+		if !ok {
+			break
+		}
+		order = append(order, nd)
+
+		g := group(nd)
+		if want[g] <= 0 {
+			continue
+		}
+		if used[g][types.NodeInfo{DC: nd.DC, Rack: nd.Rack}] && len(used[g]) < racks[g] {
+			skipped[g] = append(skipped[g], nd)
+			continue
+		}
+		place(nd)
+		if len(used[g]) >= racks[g] {
+			for want[g] > 0 && len(skipped[g]) > 0 {
+				place(skipped[g][0])
+				skipped[g] = skipped[g][1:]
+			}
+		}
+	}
+
+	// A datacenter with fewer racks left than replicas wanted: take the
+	// skipped nodes after all, in ring order.
+	for _, nd := range order {
+		if g := group(nd); !placed[nd.ID] && want[g] > 0 {
+			place(nd)
+		}
+	}
+	for _, nd := range order {
+		if !placed[nd.ID] {
+			out = append(out, nd)
+		}
+	}
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
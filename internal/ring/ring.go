@@ -4,7 +4,7 @@ import (
 	"encoding/binary"
 	"hash/fnv"
 	"sort"
-	"strconv"
+	"strings"
 
 	"mini-dynamo/internal/types"
 )
@@ -13,52 +13,195 @@ type VNode struct {
 	Token  uint64         `json:"token"`
 	Node   types.NodeInfo `json:"node"`
 	VIndex int            `json:"vindex"`
+
+	// Prefs ranks the nodes for this range under a partitioned partitioner;
+	// nil on token rings, where replicas are found walking clockwise.
+	Prefs []types.NodeInfo `json:"prefs,omitempty"`
 }
 
 type Ring struct {
 	VNodes []VNode
+
+	// Replication, if set, is the replica count per datacenter (e.g.
+	// dc1:3, dc2:2); nodes in other datacenters hold no replicas. Without it
+	// a key gets N replicas wherever they fall. See placement.go.
+	Replication map[string]int
+
+	part      Partitioner
+	racks     map[string]int // distinct racks per datacenter
+	racksAll  int            // distinct (datacenter, rack) pairs
+	nodeCount int
 }
 
-// New builds a ring with vnodesPerNode virtual nodes per physical node.
+// New builds an FNV token ring with vnodesPerNode virtual nodes per unit of
+// node weight, their tokens hashed from the node ID.
 func New(nodes []types.NodeInfo, vnodesPerNode int) Ring {
-	vnodes := make([]VNode, 0, len(nodes)*vnodesPerNode)
-	for _, n := range nodes {
-		for i := 0; i < vnodesPerNode; i++ {
-			// Token for vnode i of node n
-			token := hash64(n.ID + "#" + strconv.Itoa(i))
-			vnodes = append(vnodes, VNode{
-				Token:  token,
-				Node:   n,
-				VIndex: i,
-			})
-		}
-	}
+	return Build(fnvRing, nodes, nil, vnodesPerNode)
+}
 
+// FromTokens builds an FNV token ring from explicit per-node tokens.
+func FromTokens(nodes []types.NodeInfo, tokens map[string][]uint64) Ring {
+	return Build(fnvRing, nodes, tokens, 0)
+}
+
+// Build lays out a ring for nodes with partitioner p (see Partitioner.VNodes).
+func Build(p Partitioner, nodes []types.NodeInfo, tokens map[string][]uint64, vnodesPerNode int) Ring {
+	vnodes := p.VNodes(nodes, tokens, vnodesPerNode)
 	sort.Slice(vnodes, func(i, j int) bool {
 		return vnodes[i].Token < vnodes[j].Token
 	})
 
-	return Ring{VNodes: vnodes}
+	r := Ring{VNodes: vnodes, part: p, racks: make(map[string]int)}
+	seen := make(map[types.NodeInfo]bool)
+	for _, n := range nodes {
+		rk := types.NodeInfo{DC: n.DC, Rack: n.Rack}
+		if !seen[rk] {
+			seen[rk] = true
+			r.racks[n.DC]++
+			r.racksAll++
+		}
+	}
+	r.nodeCount = len(nodes)
+	return r
 }
 
-// GetReplicas returns N distinct physical nodes responsible for the key.
-// It walks clockwise on the ring starting from the key's token.
+// Nodes returns the distinct physical nodes on the ring.
+func (r Ring) Nodes() []types.NodeInfo {
+	return r.walk(0, len(r.VNodes))
+}
+
+// GetReplicas returns N distinct physical nodes for the key, walking clockwise
+// from the key's token. The key's replicas under the placement strategy come
+// first; if N asks for more, the remaining nodes follow in ring order (the
+// sloppy-quorum fallbacks).
 func (r Ring) GetReplicas(key string, N int) []types.NodeInfo {
 	if len(r.VNodes) == 0 || N <= 0 {
 		return nil
 	}
 
-	start := r.search(hash64(key))
+	return r.replicasAt(r.search(r.Token(key)), N)
+}
 
-	seen := make(map[string]bool, N)
+// walk collects N distinct physical nodes in preference order for the range
+// of vnode index start.
+func (r Ring) walk(start int, N int) []types.NodeInfo {
+	if N > r.nodeCount {
+		N = r.nodeCount
+	}
 	out := make([]types.NodeInfo, 0, N)
+	next := r.candidates(start)
+	for len(out) < N {
+		n, ok := next()
+		if !ok {
+			break
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// candidates yields the distinct nodes for the range of vnode start in
+// preference order: clockwise on a token ring, the range's ranking on a
+// partitioned one.
+func (r Ring) candidates(start int) func() (types.NodeInfo, bool) {
+	if prefs := r.VNodes[start].Prefs; prefs != nil {
+		i := 0
+		return func() (types.NodeInfo, bool) {
+			if i == len(prefs) {
+				return types.NodeInfo{}, false
+			}
+			i++
+			return prefs[i-1], true
+		}
+	}
+
+	// Walk ring until every distinct node was returned or we looped all vnodes.
+	var seen []types.NodeInfo
+	i := 0
+	return func() (types.NodeInfo, bool) {
+		for ; i < len(r.VNodes) && len(seen) < r.nodeCount; i++ {
+			vn := r.VNodes[(start+i)%len(r.VNodes)]
+			if !containsNode(seen, vn.Node.ID) {
+				seen = append(seen, vn.Node)
+				return vn.Node, true
+			}
+		}
+		return types.NodeInfo{}, false
+	}
+}
 
-	// Walk ring until we collect N distinct nodes or we looped all vnodes.
-	for i := 0; i < len(r.VNodes) && len(out) < N; i++ {
-		vn := r.VNodes[(start+i)%len(r.VNodes)]
-		if !seen[vn.Node.ID] {
-			seen[vn.Node.ID] = true
-			out = append(out, vn.Node)
+func containsNode(nodes []types.NodeInfo, id string) bool {
+	for _, n := range nodes {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Range is the slice of token space (Start, End] owned by the vnode whose token is End.
+// A ring with a single vnode has Start == End and covers the whole token space.
+type Range struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// Token maps a key onto the ring.
+func (r Ring) Token(key string) uint64 {
+	if r.part == nil {
+		return hash64(key)
+	}
+	return r.part.Token(key)
+}
+
+// Partitioner returns the ring's partitioner.
+func (r Ring) Partitioner() Partitioner {
+	if r.part == nil {
+		return fnvRing
+	}
+	return r.part
+}
+
+// RangeFor returns the range containing token.
+func (r Ring) RangeFor(token uint64) Range {
+	if len(r.VNodes) == 0 {
+		return Range{}
+	}
+	i := r.search(token)
+	prev := (i + len(r.VNodes) - 1) % len(r.VNodes)
+	return Range{Start: r.VNodes[prev].Token, End: r.VNodes[i].Token}
+}
+
+// Ranges returns every range nodeID holds a replica of when keys are stored on N nodes.
+func (r Ring) Ranges(nodeID string, N int) []Range {
+	out := make([]Range, 0)
+	for i, vn := range r.VNodes {
+		prev := r.VNodes[(i+len(r.VNodes)-1)%len(r.VNodes)]
+		for _, n := range r.replicasAt(i, N) {
+			if n.ID == nodeID {
+				out = append(out, Range{Start: prev.Token, End: vn.Token})
+				break
+			}
+		}
+	}
+	return out
+}
+
+// ReplicaSets returns the distinct replica sets of the ring's ranges when
+// keys are stored on N nodes; every key is stored on one of them.
+func (r Ring) ReplicaSets(N int) [][]types.NodeInfo {
+	var out [][]types.NodeInfo
+	seen := make(map[string]bool)
+	for i := range r.VNodes {
+		set := r.replicasAt(i, N)
+		ids := make([]string, len(set))
+		for j, n := range set {
+			ids[j] = n.ID
+		}
+		sort.Strings(ids)
+		if id := strings.Join(ids, ","); !seen[id] {
+			seen[id] = true
+			out = append(out, set)
 		}
 	}
 	return out
@@ -76,6 +219,8 @@ func (r Ring) search(target uint64) int {
 	return i
 }
 
+var fnvRing = tokenRing{name: PartFNV, hash: hash64}
+
 func hash64(s string) uint64 {
 	h := fnv.New64a()
 	_, _ = h.Write([]byte(s))
@@ -0,0 +1,130 @@
+package ring
+
+import (
+	"math"
+	"strconv"
+
+	"mini-dynamo/internal/types"
+)
+
+// Token allocation strategies for Layout.Allocation.
+//
+// "hash" derives a node's tokens from its ID, so any node can compute them
+// independently, but ownership varies with how the hashes happen to fall.
+// "balanced" places each new vnode in the middle of the largest range of the
+// node that currently owns the most per unit of weight, so adding a node
+// takes load from the most loaded nodes first. Balanced tokens depend on the
+// tokens already on the ring and are stored in the layout.
+const (
+	AllocHash     = "hash"
+	AllocBalanced = "balanced"
+)
+
+// weight returns a node's weight, 1 when unset.
+func weight(n types.NodeInfo) float64 {
+	if n.Weight <= 0 {
+		return 1
+	}
+	return n.Weight
+}
+
+// vnodeCount is how many vnodes n gets with vnodesPerNode per unit of weight.
+func vnodeCount(n types.NodeInfo, vnodesPerNode int) int {
+	c := int(math.Round(weight(n) * float64(vnodesPerNode)))
+	if c < 1 {
+		c = 1
+	}
+	return c
+}
+
+// balancedTokens picks tokens for n given the ring so far (tokens of nodes)
+// and keys stored on replicas nodes. Each vnode splits one of the largest
+// ranges replicated by the node that holds the most per unit of weight, the
+// split that leaves ownership closest to the weights.
+func balancedTokens(nodes []types.NodeInfo, tokens map[string][]uint64, replication map[string]int, n types.NodeInfo, vnodesPerNode, replicas int) []uint64 {
+	count := vnodeCount(n, vnodesPerNode)
+	if len(nodes) == 0 {
+		// First node: spread evenly from a hashed offset.
+		out := make([]uint64, count)
+		step := math.MaxUint64/uint64(count) + 1
+		for i := range out {
+			out[i] = hash64(n.ID) + uint64(i)*step
+		}
+		return out
+	}
+
+	members := append(append([]types.NodeInfo(nil), nodes...), n)
+	trial := make(map[string][]uint64, len(tokens)+1)
+	for id, t := range tokens {
+		trial[id] = t
+	}
+	build := func(mine []uint64) Ring {
+		trial[n.ID] = mine
+		r := FromTokens(members, trial)
+		r.Replication = replication
+		return r
+	}
+	// imbalance is the squared relative error of every node in n's group.
+	imbalance := func(r Ring) float64 {
+		sum := 0.0
+		for _, o := range r.Ownership(replicas) {
+			if o.Target > 0 && r.group(o.DC) == r.group(n.DC) {
+				d := o.Percent/o.Target - 1
+				sum += d * d
+			}
+		}
+		return sum
+	}
+
+	out := make([]uint64, 0, count)
+	for len(out) < count {
+		// Score a handful of hashed positions and keep the best.
+		best, bestScore := uint64(0), math.Inf(1)
+		for j := 0; j < balanceCandidates; j++ {
+			t := hash64(n.ID + "#" + strconv.Itoa(len(out)) + "#" + strconv.Itoa(j))
+			if score := imbalance(build(append(out[:len(out):len(out)], t))); score < bestScore {
+				best, bestScore = t, score
+			}
+		}
+		out = append(out, best)
+	}
+	return out
+}
+
+// balanceCandidates bounds how many splits balancedTokens scores per vnode.
+const balanceCandidates = 16
+
+// span is the width of vnode i's range.
+func (r Ring) span(i int) uint64 {
+	if len(r.VNodes) == 1 {
+		return math.MaxUint64
+	}
+	return r.VNodes[i].Token - r.VNodes[(i+len(r.VNodes)-1)%len(r.VNodes)].Token
+}
+
+// Allocate returns l with tokens for exactly its nodes, balanced for keys
+// stored on replicas nodes. Under balanced allocation nodes without tokens
+// get them in layout order, so a joining node never moves the tokens of
+// existing ones. Hash allocation keeps no tokens in the layout.
+func (l Layout) Allocate(replicas int) Layout {
+	if l.Allocation != AllocBalanced || !IsTokenRing(l.Partition()) {
+		l.Tokens = nil
+		return l
+	}
+	tokens := make(map[string][]uint64, len(l.Nodes))
+	var placed []types.NodeInfo
+	for _, n := range l.Nodes {
+		if t, ok := l.Tokens[n.ID]; ok {
+			tokens[n.ID] = t
+			placed = append(placed, n)
+		}
+	}
+	for _, n := range l.Nodes {
+		if _, ok := tokens[n.ID]; !ok {
+			tokens[n.ID] = balancedTokens(placed, tokens, l.Replication, n, l.VNodes, replicas)
+			placed = append(placed, n)
+		}
+	}
+	l.Tokens = tokens
+	return l
+}
@@ -0,0 +1,244 @@
+package ring
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"mini-dynamo/internal/types"
+)
+
+// Layout is a versioned, serialisable description of the ring.
+type Layout struct {
+	Version uint64           `json:"version"`
+	Nodes   []types.NodeInfo `json:"nodes"`
+	VNodes  int              `json:"vnodes"`
+
+	Replication map[string]int `json:"replication,omitempty"` // per-DC replica counts
+
+	// Allocation is AllocHash (default) or AllocBalanced; balanced tokens
+	// are kept in Tokens (see Allocate).
+	Allocation string              `json:"allocation,omitempty"`
+	Tokens     map[string][]uint64 `json:"tokens,omitempty"`
+
+	// Partitioner names the partitioner (PartFNV when empty); Partitions is
+	// the range count of partitioned ones. See NewPartitioner.
+	Partitioner string `json:"partitioner,omitempty"`
+	Partitions  int    `json:"partitions,omitempty"`
+}
+
+// Partition returns the layout's partitioner. Layouts are validated before
+// use, so an unknown name falls back to FNV rather than failing here.
+func (l Layout) Partition() Partitioner {
+	p, err := NewPartitioner(l.Partitioner, l.Partitions)
+	if err != nil {
+		return fnvRing
+	}
+	return p
+}
+
+func (l Layout) Ring() Ring {
+	r := Build(l.Partition(), l.Nodes, l.Tokens, l.VNodes)
+	r.Replication = l.Replication
+	return r
+}
+
+func (l Layout) Has(id string) bool {
+	for _, n := range l.Nodes {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Topology holds the committed layout and, while ranges are being moved to
+// new owners, the pending layout the cluster is transitioning to.
+type Topology struct {
+	mu       sync.RWMutex
+	cur      Layout
+	curRing  Ring
+	next     *Layout
+	nextRing Ring
+}
+
+func NewTopology(l Layout) *Topology {
+	return &Topology{cur: l, curRing: l.Ring()}
+}
+
+// Current returns the committed layout and its ring.
+func (t *Topology) Current() (Layout, Ring) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cur, t.curRing
+}
+
+// Pending returns the layout being moved to, if a transition is in progress.
+func (t *Topology) Pending() (Layout, Ring, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.next == nil {
+		return Layout{}, Ring{}, false
+	}
+	return *t.next, t.nextRing, true
+}
+
+// Prepare starts a transition to next. cur is the orchestrator's committed
+// layout; a node that is behind (e.g. just joined) adopts it first.
+func (t *Topology) Prepare(cur, next Layout) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.samePartitioner(next); err != nil {
+		return err
+	}
+	if cur.Version > t.cur.Version {
+		t.cur, t.curRing = cur, cur.Ring()
+	}
+	if next.Version <= t.cur.Version {
+		return fmt.Errorf("stale layout version %d (have %d)", next.Version, t.cur.Version)
+	}
+	if t.next != nil {
+		return fmt.Errorf("transition to version %d already in progress", t.next.Version)
+	}
+	t.next, t.nextRing = &next, next.Ring()
+	return nil
+}
+
+// Commit makes the pending layout current. It reports false if version is not pending.
+func (t *Topology) Commit(version uint64) (Layout, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.next == nil || t.next.Version != version {
+		return t.cur, false
+	}
+	t.cur, t.curRing = *t.next, t.nextRing
+	t.next, t.nextRing = nil, Ring{}
+	return t.cur, true
+}
+
+// Abort drops the pending layout if it matches version.
+func (t *Topology) Abort(version uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.next != nil && t.next.Version == version {
+		t.next, t.nextRing = nil, Ring{}
+	}
+}
+
+// Adopt installs a newer committed layout learned out of band (e.g. via gossip).
+func (t *Topology) Adopt(l Layout) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if l.Version <= t.cur.Version || t.samePartitioner(l) != nil {
+		return false
+	}
+	t.cur, t.curRing = l, l.Ring()
+	if t.next != nil && t.next.Version <= l.Version {
+		t.next, t.nextRing = nil, Ring{}
+	}
+	return true
+}
+
+// samePartitioner refuses a layout that places keys differently from the
+// committed one: the data on disk was written under the committed one.
+func (t *Topology) samePartitioner(l Layout) error {
+	if have, got := t.cur.Partition().Config(), l.Partition().Config(); have != got {
+		return fmt.Errorf("layout version %d uses partitioner %s, this node uses %s", l.Version, got, have)
+	}
+	return nil
+}
+
+// Node looks a node up in the committed or pending layout.
+func (t *Topology) Node(id string) (types.NodeInfo, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, n := range t.cur.Nodes {
+		if n.ID == id {
+			return n, true
+		}
+	}
+	if t.next != nil {
+		for _, n := range t.next.Nodes {
+			if n.ID == id {
+				return n, true
+			}
+		}
+	}
+	return types.NodeInfo{}, false
+}
+
+// NodeAt looks a node up by address in the committed or pending layout.
+func (t *Topology) NodeAt(addr string) (types.NodeInfo, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, n := range t.cur.Nodes {
+		if n.Addr == addr {
+			return n, true
+		}
+	}
+	if t.next != nil {
+		for _, n := range t.next.Nodes {
+			if n.Addr == addr {
+				return n, true
+			}
+		}
+	}
+	return types.NodeInfo{}, false
+}
+
+// Union returns the distinct nodes of a and b, a's order first.
+func Union(a, b []types.NodeInfo) []types.NodeInfo {
+	seen := make(map[string]bool, len(a)+len(b))
+	out := make([]types.NodeInfo, 0, len(a)+len(b))
+	for _, list := range [][]types.NodeInfo{a, b} {
+		for _, n := range list {
+			if !seen[n.ID] {
+				seen[n.ID] = true
+				out = append(out, n)
+			}
+		}
+	}
+	return out
+}
+
+// LoadLayout reads a persisted layout. A missing file returns ok=false.
+func LoadLayout(path string) (Layout, bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Layout{}, false, nil
+		}
+		return Layout{}, false, err
+	}
+	var l Layout
+	if err := json.Unmarshal(b, &l); err != nil {
+		return Layout{}, false, err
+	}
+	return l, true, nil
+}
+
+// SaveLayout persists l atomically so a restarted node keeps the committed ring.
+func SaveLayout(path string, l Layout) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	_ = os.Remove(path) // Windows-safe replace
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,368 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DiskStore keeps values on disk in an append-only data log. Only keys and
+// sibling metadata live in memory (the key directory), so the dataset is no
+// longer capped by RAM. Each log entry holds a key's full sibling set after a
+// merge; the newest entry per key wins on recovery, and an entry without
+// siblings marks a purged key. Snapshot() compacts the log down to one entry
+// per live key.
+//
+// Frame layout: [len uint32][crc32 uint32][json diskEntry].
+type DiskStore struct {
+	mu      sync.RWMutex
+	dir     string
+	f       *os.File
+	size    int64
+	live    int64 // bytes of frames still referenced by the key directory
+	keydir  map[string]diskLoc
+	keys    *keyIndex // keys of keydir in order, for Scan
+	observe func(key string, before, after []Record)
+}
+
+type diskLoc struct {
+	off  int64
+	n    int64 // frame length including header
+	meta []Meta
+}
+
+type diskEntry struct {
+	Key      string   `json:"key"`
+	Siblings []Record `json:"siblings"`
+}
+
+const frameHeader = 8
+
+func dataPath(dir string) string { return filepath.Join(dir, "data.log") }
+
+// OpenDisk opens (or creates) the engine in dir and rebuilds the key
+// directory from the data log. A torn frame at the tail is truncated.
+func OpenDisk(dir string) (*DiskStore, error) {
+	if dir == "" {
+		return nil, errors.New("disk engine dir is empty")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(dataPath(dir), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &DiskStore{dir: dir, f: f, keydir: make(map[string]diskLoc), keys: newKeyIndex()}
+	if err := s.recover(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *DiskStore) recover() error {
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, 1<<62))
+	var off int64
+	for {
+		e, n, err := readFrame(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errCorruptFrame) {
+				break
+			}
+			return err
+		}
+		if old, ok := s.keydir[e.Key]; ok {
+			s.live -= old.n
+		}
+		if len(e.Siblings) == 0 {
+			delete(s.keydir, e.Key) // purge marker
+			s.keys.remove(e.Key)
+		} else {
+			s.keydir[e.Key] = diskLoc{off: off, n: n, meta: MetaOf(e.Siblings)}
+			s.keys.insert(e.Key)
+			s.live += n
+		}
+		off += n
+	}
+
+	// Drop anything after the last good frame (crash mid-append).
+	if err := s.f.Truncate(off); err != nil {
+		return err
+	}
+	s.size = off
+	return nil
+}
+
+var errCorruptFrame = errors.New("corrupt frame")
+
+func readFrame(r io.Reader) (diskEntry, int64, error) {
+	var hdr [frameHeader]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return diskEntry{}, 0, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	sum := binary.BigEndian.Uint32(hdr[4:])
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return diskEntry{}, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return diskEntry{}, 0, errCorruptFrame
+	}
+
+	var e diskEntry
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return diskEntry{}, 0, errCorruptFrame
+	}
+	return e, int64(frameHeader + n), nil
+}
+
+func encodeFrame(e diskEntry) ([]byte, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, frameHeader+len(payload))
+	binary.BigEndian.PutUint32(b[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(payload))
+	copy(b[frameHeader:], payload)
+	return b, nil
+}
+
+func (s *DiskStore) readLocked(loc diskLoc) ([]Record, error) {
+	b := make([]byte, loc.n)
+	if _, err := s.f.ReadAt(b, loc.off); err != nil {
+		return nil, err
+	}
+	e, _, err := readFrame(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("read frame at %d: %w", loc.off, err)
+	}
+	return e.Siblings, nil
+}
+
+func (s *DiskStore) appendLocked(key string, sibs []Record) error {
+	b, err := encodeFrame(diskEntry{Key: key, Siblings: sibs})
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.WriteAt(b, s.size); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	fsyncDuration.Since(start, "data")
+
+	if old, ok := s.keydir[key]; ok {
+		s.live -= old.n
+	}
+	n := int64(len(b))
+	if len(sibs) == 0 {
+		delete(s.keydir, key)
+		s.keys.remove(key)
+	} else {
+		s.keydir[key] = diskLoc{off: s.size, n: n, meta: MetaOf(sibs)}
+		s.keys.insert(key)
+		s.live += n
+	}
+	s.size += n
+	return nil
+}
+
+func (s *DiskStore) Observe(fn func(key string, before, after []Record)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observe = fn
+}
+
+func (s *DiskStore) Get(key string) ([]Record, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	loc, ok := s.keydir[key]
+	if !ok {
+		return nil, false
+	}
+	sibs, err := s.readLocked(loc)
+	if err != nil {
+		return nil, false
+	}
+	return sibs, true
+}
+
+// PutMerge merges rec with the key's current siblings and appends the result.
+func (s *DiskStore) PutMerge(rec Record) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var before []Record
+	if loc, ok := s.keydir[rec.Key]; ok {
+		cur, err := s.readLocked(loc)
+		if err != nil {
+			return nil, err
+		}
+		before = cur
+	}
+
+	sibs, changed := MergeSiblings(before, rec)
+	if !changed {
+		return before, nil
+	}
+	if err := s.appendLocked(rec.Key, sibs); err != nil {
+		return before, err
+	}
+	if s.observe != nil {
+		s.observe(rec.Key, before, sibs)
+	}
+	return sibs, nil
+}
+
+// KeysMeta is served from the in-memory key directory (no disk reads).
+func (s *DiskStore) KeysMeta() map[string][]Meta {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string][]Meta, len(s.keydir))
+	for k, loc := range s.keydir {
+		out[k] = append([]Meta(nil), loc.meta...)
+	}
+	return out
+}
+
+func (s *DiskStore) Scan(start string, fn func(key string, sibs []Record) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var err error
+	s.keys.ascend(start, func(k string) bool {
+		var sibs []Record
+		if sibs, err = s.readLocked(s.keydir[k]); err != nil {
+			return false
+		}
+		return fn(k, sibs)
+	})
+	return err
+}
+
+// Snapshot rewrites the data log with one frame per key, dropping
+// superseded frames. Writers are blocked while it runs.
+func (s *DiskStore) Snapshot() error {
+	defer snapshotDuration.Since(time.Now(), "disk")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.live == s.size {
+		return nil
+	}
+
+	tmp := dataPath(s.dir) + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+
+	keydir := make(map[string]diskLoc, len(s.keydir))
+	var off int64
+	for k, loc := range s.keydir {
+		b := make([]byte, loc.n)
+		if _, err := s.f.ReadAt(b, loc.off); err != nil {
+			_ = out.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			_ = out.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+		keydir[k] = diskLoc{off: off, n: loc.n, meta: loc.meta}
+		off += loc.n
+	}
+	if err := w.Flush(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	// os.Rename replaces the old log; on failure it is left untouched.
+	if err := os.Rename(tmp, dataPath(s.dir)); err != nil {
+		_ = out.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	_ = s.f.Close()
+	s.f = out
+	s.keydir = keydir
+	s.size = off
+	s.live = off
+	return nil
+}
+
+// Purge appends a marker frame (a key with no siblings) for each matching
+// key; the next Snapshot drops both the marker and the key's old frames.
+func (s *DiskStore) Purge(drop func(key string, meta []Meta) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for k, loc := range s.keydir {
+		if !drop(k, loc.meta) {
+			continue
+		}
+		before, err := s.readLocked(loc)
+		if err != nil {
+			return n, err
+		}
+		if err := s.appendLocked(k, nil); err != nil {
+			return n, err
+		}
+		n++
+		if s.observe != nil {
+			s.observe(k, before, nil)
+		}
+	}
+	return n, nil
+}
+
+func (s *DiskStore) Stats() map[string]any {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return map[string]any{
+		"engine":     "disk",
+		"dir":        s.dir,
+		"keys":       len(s.keydir),
+		"log_bytes":  s.size,
+		"live_bytes": s.live,
+	}
+}
+
+func (s *DiskStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -0,0 +1,67 @@
+package store
+
+// Engine is a local storage engine. Per key it holds the set of causally
+// concurrent siblings; every implementation merges with MergeSiblings so
+// engines are interchangeable underneath the coordinator and anti-entropy.
+type Engine interface {
+	Get(key string) ([]Record, bool)
+
+	// PutMerge folds rec into the key's siblings and makes the result durable.
+	// It returns the key's siblings afterwards, or an error if rec could not
+	// be stored; a record the siblings already cover is not an error.
+	PutMerge(rec Record) ([]Record, error)
+
+	// KeysMeta returns key->sibling metadata for anti-entropy comparisons.
+	KeysMeta() map[string][]Meta
+
+	// Scan visits keys >= start in ascending order until fn returns false.
+	// Writes are blocked while it runs, so fn must not write to the engine.
+	Scan(start string, fn func(key string, sibs []Record) bool) error
+
+	// Observe registers fn to be called (under the engine lock) whenever a
+	// key's siblings change. Used to keep derived indexes current.
+	Observe(fn func(key string, before, after []Record))
+
+	// Snapshot compacts the engine's on-disk state.
+	Snapshot() error
+
+	// Purge permanently removes every key for which drop returns true,
+	// including from the WAL and on-disk state, and reports how many went.
+	Purge(drop func(key string, meta []Meta) bool) (int, error)
+
+	// Stats describes the engine for /debug/persist.
+	Stats() map[string]any
+
+	Close() error
+}
+
+var (
+	_ Engine = (*MemStore)(nil)
+	_ Engine = (*DiskStore)(nil)
+	_ Engine = (*LSMStore)(nil)
+)
+
+// MetaOf returns the metadata of each sibling.
+func MetaOf(sibs []Record) []Meta {
+	ms := make([]Meta, 0, len(sibs))
+	for _, r := range sibs {
+		ms = append(ms, Meta{Ts: r.Ts, WriterID: r.WriterID, Deleted: r.Deleted, Clock: r.Clock, ExpiresAt: r.ExpiresAt})
+	}
+	return ms
+}
+
+// TombstonesBefore matches keys whose siblings are all tombstones written
+// before horizon (unix nanoseconds). Use it with Purge for gc_grace.
+func TombstonesBefore(horizon int64) func(key string, meta []Meta) bool {
+	return func(_ string, meta []Meta) bool {
+		if len(meta) == 0 {
+			return false
+		}
+		for _, m := range meta {
+			if !m.Deleted || m.Ts >= horizon {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,376 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// engineCase opens one engine implementation in a directory. log names the
+// file its most recent writes were appended to, for crash tests.
+type engineCase struct {
+	name string
+	open func(dir string) (Engine, error)
+	log  func(t *testing.T, dir string) string
+}
+
+var engines = []engineCase{
+	{
+		name: "mem",
+		open: func(dir string) (Engine, error) {
+			return OpenMem(filepath.Join(dir, "kv.wal"), filepath.Join(dir, "kv.snap.json"))
+		},
+		log: func(_ *testing.T, dir string) string { return filepath.Join(dir, "kv.wal") },
+	},
+	{
+		name: "disk",
+		open: func(dir string) (Engine, error) { return OpenDisk(dir) },
+		log:  func(_ *testing.T, dir string) string { return dataPath(dir) },
+	},
+	{
+		name: "lsm",
+		open: func(dir string) (Engine, error) {
+			// Tiny memtables, so the tests flush and compact.
+			return OpenLSM(dir, LSMConfig{MemtableBytes: 512, BlockBytes: 256, CompactMin: 2})
+		},
+		log: func(t *testing.T, dir string) string {
+			wals, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+			if err != nil || len(wals) == 0 {
+				t.Fatalf("no WAL in %s: %v", dir, err)
+			}
+			sort.Strings(wals)
+			return wals[len(wals)-1]
+		},
+	},
+}
+
+func rec(key, value string, ts int64, clock VClock) Record {
+	return Record{Key: key, Value: []byte(value), Ts: ts, WriterID: "n1", Clock: clock}
+}
+
+func tomb(key string, ts int64, clock VClock) Record {
+	return Record{Key: key, Ts: ts, WriterID: "n1", Deleted: true, Clock: clock}
+}
+
+func mustPut(t *testing.T, e Engine, r Record) []Record {
+	t.Helper()
+	sibs, err := e.PutMerge(r)
+	if err != nil {
+		t.Fatalf("PutMerge(%q): %v", r.Key, err)
+	}
+	return sibs
+}
+
+// describe renders siblings as "value@ts" or "del@ts", in order.
+func describe(sibs []Record) string {
+	var b bytes.Buffer
+	for i, r := range sibs {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		if r.Deleted {
+			fmt.Fprintf(&b, "del@%d", r.Ts)
+		} else {
+			fmt.Fprintf(&b, "%s@%d", r.Value, r.Ts)
+		}
+	}
+	return b.String()
+}
+
+func expect(t *testing.T, e Engine, key, want string) {
+	t.Helper()
+	sibs, ok := e.Get(key)
+	if got := describe(sibs); !ok && want != "" || got != want {
+		t.Fatalf("Get(%q) = %q (found %v), want %q", key, got, ok, want)
+	}
+}
+
+func reopen(t *testing.T, ec engineCase, e Engine, dir string) Engine {
+	t.Helper()
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	e, err := ec.open(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	return e
+}
+
+func TestEngines(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, ec engineCase, dir string, e Engine) Engine
+	}{
+		{"lww on equal clocks", func(t *testing.T, _ engineCase, _ string, e Engine) Engine {
+			mustPut(t, e, rec("k", "a", 10, nil))
+			mustPut(t, e, rec("k", "b", 20, nil))
+			mustPut(t, e, rec("k", "old", 15, nil))
+			expect(t, e, "k", "b@20")
+			return e
+		}},
+		{"causal overwrite and siblings", func(t *testing.T, _ engineCase, _ string, e Engine) Engine {
+			mustPut(t, e, rec("k", "a", 10, VClock{"n1": 1}))
+			mustPut(t, e, rec("k", "b", 20, VClock{"n1": 2}))
+			expect(t, e, "k", "b@20")
+			mustPut(t, e, rec("k", "c", 15, VClock{"n1": 1, "n2": 1}))
+			if sibs, _ := e.Get("k"); len(sibs) != 2 {
+				t.Fatalf("concurrent writes: got %q, want 2 siblings", describe(sibs))
+			}
+			mustPut(t, e, rec("k", "d", 30, VClock{"n1": 2, "n2": 1}))
+			expect(t, e, "k", "d@30")
+			return e
+		}},
+		{"tombstone precedence", func(t *testing.T, _ engineCase, _ string, e Engine) Engine {
+			mustPut(t, e, rec("k", "a", 10, VClock{"n1": 1}))
+			mustPut(t, e, tomb("k", 20, VClock{"n1": 2}))
+			// A stale replica's copy must not resurrect the value.
+			sibs := mustPut(t, e, rec("k", "a", 10, VClock{"n1": 1}))
+			if describe(sibs) != "del@20" {
+				t.Fatalf("PutMerge of a covered value = %q, want del@20", describe(sibs))
+			}
+			expect(t, e, "k", "del@20")
+			return e
+		}},
+		{"replay after crash", func(t *testing.T, ec engineCase, dir string, e Engine) Engine {
+			mustPut(t, e, rec("a", "1", 10, VClock{"n1": 1}))
+			mustPut(t, e, rec("b", "2", 11, VClock{"n1": 2}))
+			mustPut(t, e, tomb("a", 12, VClock{"n1": 3}))
+			mustPut(t, e, rec("c", "3", 13, VClock{"n2": 1}))
+			mustPut(t, e, rec("c", "4", 14, VClock{"n3": 1}))
+			e = reopen(t, ec, e, dir)
+			expect(t, e, "a", "del@12")
+			expect(t, e, "b", "2@11")
+			if sibs, _ := e.Get("c"); len(sibs) != 2 {
+				t.Fatalf("siblings after replay: got %q, want 2", describe(sibs))
+			}
+			return e
+		}},
+		{"torn tail", func(t *testing.T, ec engineCase, dir string, e Engine) Engine {
+			mustPut(t, e, rec("a", "1", 10, VClock{"n1": 1}))
+			mustPut(t, e, tomb("b", 11, VClock{"n1": 2}))
+			if err := e.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// A crash in the middle of an append leaves half a record.
+			f, err := os.OpenFile(ec.log(t, dir), os.O_APPEND|os.O_WRONLY, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = f.Write([]byte(`{"key":"c","value":"d2Fz`))
+			_ = f.Close()
+			if e, err = ec.open(dir); err != nil {
+				t.Fatalf("open after torn write: %v", err)
+			}
+			expect(t, e, "a", "1@10")
+			expect(t, e, "b", "del@11")
+			expect(t, e, "c", "")
+			mustPut(t, e, rec("c", "3", 12, VClock{"n1": 3}))
+			e = reopen(t, ec, e, dir)
+			expect(t, e, "c", "3@12")
+			return e
+		}},
+		{"snapshot keeps tombstones", func(t *testing.T, ec engineCase, dir string, e Engine) Engine {
+			// Enough keys to go through several memtables and tables.
+			for i := 0; i < 60; i++ {
+				mustPut(t, e, rec(fmt.Sprintf("k%02d", i), "value", int64(100+i), VClock{"n1": uint64(i + 1)}))
+			}
+			for i := 0; i < 60; i += 3 {
+				mustPut(t, e, tomb(fmt.Sprintf("k%02d", i), int64(200+i), VClock{"n1": uint64(i + 100)}))
+			}
+			for round := 0; round < 2; round++ {
+				if err := e.Snapshot(); err != nil {
+					t.Fatalf("Snapshot: %v", err)
+				}
+				e = reopen(t, ec, e, dir)
+			}
+			for i := 0; i < 60; i++ {
+				want := fmt.Sprintf("value@%d", 100+i)
+				if i%3 == 0 {
+					want = fmt.Sprintf("del@%d", 200+i)
+				}
+				expect(t, e, fmt.Sprintf("k%02d", i), want)
+			}
+			// A stale copy still loses against the compacted tombstone.
+			mustPut(t, e, rec("k00", "value", 100, VClock{"n1": 1}))
+			expect(t, e, "k00", "del@200")
+			return e
+		}},
+		{"purge", func(t *testing.T, ec engineCase, dir string, e Engine) Engine {
+			mustPut(t, e, rec("a", "1", 10, VClock{"n1": 1}))
+			mustPut(t, e, tomb("a", 20, VClock{"n1": 2}))
+			mustPut(t, e, tomb("b", 90, VClock{"n1": 3}))
+			mustPut(t, e, rec("c", "3", 5, VClock{"n1": 4}))
+			n, err := e.Purge(TombstonesBefore(50))
+			if err != nil || n != 1 {
+				t.Fatalf("Purge = %d, %v; want 1", n, err)
+			}
+			e = reopen(t, ec, e, dir)
+			expect(t, e, "a", "")
+			expect(t, e, "b", "del@90")
+			expect(t, e, "c", "3@5")
+			return e
+		}},
+		{"scan order", func(t *testing.T, _ engineCase, _ string, e Engine) Engine {
+			for i, k := range []string{"d", "a", "c", "e", "b"} {
+				mustPut(t, e, rec(k, k, int64(i+1), VClock{"n1": uint64(i + 1)}))
+			}
+			var got []string
+			err := e.Scan("b", func(key string, _ []Record) bool {
+				got = append(got, key)
+				return len(got) < 3
+			})
+			if err != nil || fmt.Sprint(got) != "[b c d]" {
+				t.Fatalf("Scan = %v, %v; want [b c d]", got, err)
+			}
+			return e
+		}},
+		{"write after close fails", func(t *testing.T, ec engineCase, dir string, e Engine) Engine {
+			if err := e.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := e.PutMerge(rec("k", "a", 10, VClock{"n1": 1})); err == nil {
+				t.Fatalf("PutMerge on a closed engine succeeded")
+			}
+			e, err := ec.open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(t, e, "k", "")
+			return e
+		}},
+	}
+
+	for _, ec := range engines {
+		for _, tt := range tests {
+			t.Run(ec.name+"/"+tt.name, func(t *testing.T) {
+				dir := t.TempDir()
+				e, err := ec.open(dir)
+				if err != nil {
+					t.Fatalf("open: %v", err)
+				}
+				e = tt.run(t, ec, dir, e)
+				if err := e.Close(); err != nil {
+					t.Fatalf("Close: %v", err)
+				}
+			})
+		}
+	}
+}
+
+// TestLSMRecoversTablesAndWAL reopens an engine whose keys are split over
+// SSTables and an unflushed WAL, the newer versions only in the WAL.
+func TestLSMRecoversTablesAndWAL(t *testing.T) {
+	dir := t.TempDir()
+	e, err := OpenLSM(dir, LSMConfig{MemtableBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		mustPut(t, e, rec(fmt.Sprintf("k%02d", i), "old", 10, VClock{"n1": 1}))
+	}
+	if err := e.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, e, rec("k01", "new", 20, VClock{"n1": 2}))
+	mustPut(t, e, tomb("k02", 20, VClock{"n1": 2}))
+	mustPut(t, e, rec("k99", "wal", 20, VClock{"n1": 1}))
+	if tables := e.Stats()["tables"].([]map[string]any); len(tables) != 1 {
+		t.Fatalf("tables before close = %d, want 1", len(tables))
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = OpenLSM(dir, LSMConfig{MemtableBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	expect(t, e, "k00", "old@10")
+	expect(t, e, "k01", "new@20")
+	expect(t, e, "k02", "del@20")
+	expect(t, e, "k99", "wal@20")
+	n := 0
+	if err := e.Scan("", func(string, []Record) bool { n++; return true }); err != nil || n != 21 {
+		t.Fatalf("Scan visited %d keys (%v), want 21", n, err)
+	}
+}
+
+// TestLSMMemtableSize checks that rewriting a key counts its size once.
+func TestLSMMemtableSize(t *testing.T) {
+	e, err := OpenLSM(t.TempDir(), LSMConfig{MemtableBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	value := string(bytes.Repeat([]byte("x"), 1000))
+	for i := 1; i <= 100; i++ {
+		mustPut(t, e, rec("k", value, int64(i), VClock{"n1": uint64(i)}))
+	}
+	if got := e.Stats()["memtable_bytes"].(int); got > 2000 {
+		t.Fatalf("memtable_bytes = %d after rewriting one 1KB key, want about 1KB", got)
+	}
+}
+
+// TestPartitionedRemoveWaitsForScan drops a partition in the middle of a
+// scan: Remove must not hand its engine over to be closed until the scan is
+// done with it.
+func TestPartitionedRemoveWaitsForScan(t *testing.T) {
+	open := func() Engine {
+		dir := t.TempDir()
+		e, err := OpenMem(filepath.Join(dir, "kv.wal"), filepath.Join(dir, "kv.snap.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	p := NewPartitioned(open(), func(key string) string {
+		if name, _, ok := strings.Cut(key, "/"); ok {
+			return name
+		}
+		return ""
+	})
+	defer p.Close()
+	if err := p.Add("a", open()); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a/1", "a/2", "k"} {
+		mustPut(t, p, rec(k, "v", 10, nil))
+	}
+
+	removed, closed := make(chan struct{}), make(chan error, 1)
+	var keys []string
+	err := p.Scan("", func(key string, _ []Record) bool {
+		if len(keys) == 0 {
+			go func() {
+				e, _ := p.Remove("a")
+				close(removed)
+				closed <- e.Close()
+			}()
+			select {
+			case <-removed:
+				t.Error("Remove returned during Scan")
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(keys, " "); got != "a/1 a/2 k" {
+		t.Fatalf("Scan visited %q, want all three keys", got)
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	expect(t, p, "a/1", "")
+	expect(t, p, "k", "v@10")
+}
@@ -0,0 +1,85 @@
+package store
+
+// keyIndex keeps a store's keys in order so Scan can start anywhere without
+// sorting every key first. It is a skip list; callers hold the store lock.
+type keyIndex struct {
+	head  skipNode
+	level int
+	n     int
+	seed  uint64
+}
+
+const maxSkipLevel = 24
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{head: skipNode{next: make([]*skipNode, maxSkipLevel)}, level: 1, seed: 0x9e3779b97f4a7c15}
+}
+
+// randomLevel draws a level with P(level > k) = 4^-k (xorshift, no locking).
+func (x *keyIndex) randomLevel() int {
+	x.seed ^= x.seed << 13
+	x.seed ^= x.seed >> 7
+	x.seed ^= x.seed << 17
+	lvl := 1
+	for r := x.seed; lvl < maxSkipLevel && r&3 == 0; r >>= 2 {
+		lvl++
+	}
+	return lvl
+}
+
+// path fills prev with the last node before key on every level.
+func (x *keyIndex) path(key string, prev []*skipNode) *skipNode {
+	n := &x.head
+	for l := x.level - 1; l >= 0; l-- {
+		for n.next[l] != nil && n.next[l].key < key {
+			n = n.next[l]
+		}
+		if prev != nil {
+			prev[l] = n
+		}
+	}
+	return n.next[0]
+}
+
+func (x *keyIndex) insert(key string) {
+	var prev [maxSkipLevel]*skipNode
+	if n := x.path(key, prev[:]); n != nil && n.key == key {
+		return
+	}
+	lvl := x.randomLevel()
+	for ; x.level < lvl; x.level++ {
+		prev[x.level] = &x.head
+	}
+	n := &skipNode{key: key, next: make([]*skipNode, lvl)}
+	for l := 0; l < lvl; l++ {
+		n.next[l] = prev[l].next[l]
+		prev[l].next[l] = n
+	}
+	x.n++
+}
+
+func (x *keyIndex) remove(key string) {
+	var prev [maxSkipLevel]*skipNode
+	n := x.path(key, prev[:])
+	if n == nil || n.key != key {
+		return
+	}
+	for l := 0; l < len(n.next); l++ {
+		prev[l].next[l] = n.next[l]
+	}
+	x.n--
+}
+
+// ascend visits keys >= start in order until fn returns false.
+func (x *keyIndex) ascend(start string, fn func(key string) bool) {
+	for n := x.path(start, nil); n != nil; n = n.next[0] {
+		if !fn(n.key) {
+			return
+		}
+	}
+}
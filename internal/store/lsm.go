@@ -0,0 +1,738 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LSMConfig tunes the LSM engine. Zero values pick the defaults.
+type LSMConfig struct {
+	MemtableBytes int // flush the memtable to an SSTable past this size (default 4 MiB)
+	BlockBytes    int // target SSTable data block size (default 4 KiB)
+	CompactMin    int // merge this many similarly sized adjacent tables at once (default 4)
+}
+
+func (c *LSMConfig) defaults() {
+	if c.MemtableBytes <= 0 {
+		c.MemtableBytes = 4 << 20
+	}
+	if c.BlockBytes <= 0 {
+		c.BlockBytes = 4 << 10
+	}
+	if c.CompactMin < 2 {
+		c.CompactMin = 4
+	}
+}
+
+// LSMStore is a log-structured merge engine. Writes go to the WAL and an
+// in-memory memtable; a full memtable is frozen and flushed by a background
+// worker into an immutable SSTable, and runs of similarly sized tables are
+// merged (size-tiered compaction).
+//
+// Every write reads through to the key's current siblings before merging, so
+// the newest memtable or table holding a key has its complete sibling set and
+// lookups stop there. Tombstones are kept through compaction like any other
+// sibling until Purge drops them.
+//
+// Directory layout: NNNNNN.wal (one per memtable), NNNNNN.sst, MANIFEST (the
+// live tables, newest first).
+type LSMStore struct {
+	mu      sync.RWMutex
+	dir     string
+	cfg     LSMConfig
+	mem     map[string][]Record
+	memSize int
+	wal     *WAL
+	imm     map[string][]Record // frozen memtable being flushed
+	immWAL  *WAL
+	tables  []*sstable // newest first
+	nextID  uint64
+	observe func(key string, before, after []Record)
+
+	flushes     int
+	compactions int
+	lastErr     string
+
+	workMu sync.Mutex // serialises flushes, compactions and Snapshot
+	kick   chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+type lsmManifest struct {
+	NextID uint64   `json:"next_id"`
+	Tables []uint64 `json:"tables"` // newest first
+}
+
+func (s *LSMStore) path(id uint64, ext string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%06d%s", id, ext))
+}
+
+func manifestPath(dir string) string { return filepath.Join(dir, "MANIFEST") }
+
+// OpenLSM opens (or creates) the engine in dir. WALs left by a previous run
+// are replayed and flushed to a table before new writes are accepted.
+func OpenLSM(dir string, cfg LSMConfig) (*LSMStore, error) {
+	if dir == "" {
+		return nil, errors.New("lsm engine dir is empty")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	cfg.defaults()
+	s := &LSMStore{
+		dir:  dir,
+		cfg:  cfg,
+		mem:  make(map[string][]Record),
+		kick: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		_ = s.closeFiles()
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.worker()
+	s.signal() // tables from the last run may be due for compaction
+	return s, nil
+}
+
+func (s *LSMStore) recover() error {
+	var man lsmManifest
+	if b, err := os.ReadFile(manifestPath(s.dir)); err == nil {
+		if err := json.Unmarshal(b, &man); err != nil {
+			return fmt.Errorf("read manifest: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.nextID = man.NextID
+
+	live := make(map[uint64]bool, len(man.Tables))
+	for _, id := range man.Tables {
+		t, err := openTable(s.path(id, ".sst"), id)
+		if err != nil {
+			return err
+		}
+		s.tables = append(s.tables, t)
+		live[id] = true
+	}
+
+	// Tables missing from the manifest were never installed (crash during a
+	// flush or compaction); their data is still in a WAL or in live tables.
+	ents, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var wals []uint64
+	for _, e := range ents {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+		switch ext {
+		case ".wal":
+			wals = append(wals, id)
+		case ".sst":
+			if !live[id] {
+				_ = os.Remove(filepath.Join(s.dir, name))
+			}
+		}
+	}
+	sort.Slice(wals, func(i, j int) bool { return wals[i] < wals[j] })
+
+	for _, id := range wals {
+		w := &WAL{path: s.path(id, ".wal")}
+		err := w.Replay(func(rec Record) {
+			before, _, _ := s.lookupLocked(rec.Key)
+			if sibs, changed := MergeSiblings(before, rec); changed {
+				s.mem[rec.Key] = sibs
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("replay %s: %w", w.path, err)
+		}
+	}
+	if len(s.mem) > 0 {
+		t, err := s.writeTable(s.allocID(), memIter(s.mem, ""))
+		if err != nil {
+			return err
+		}
+		s.tables = append([]*sstable{t}, s.tables...)
+		s.mem = make(map[string][]Record)
+	}
+	if err := s.saveManifestLocked(); err != nil {
+		return err
+	}
+	for _, id := range wals {
+		_ = os.Remove(s.path(id, ".wal"))
+	}
+
+	w, err := OpenWAL(s.path(s.allocID(), ".wal"))
+	if err != nil {
+		return err
+	}
+	s.wal = w
+	return nil
+}
+
+func (s *LSMStore) allocID() uint64 {
+	id := s.nextID
+	s.nextID++
+	return id
+}
+
+func (s *LSMStore) saveManifestLocked() error {
+	man := lsmManifest{NextID: s.nextID, Tables: make([]uint64, 0, len(s.tables))}
+	for _, t := range s.tables {
+		man.Tables = append(man.Tables, t.id)
+	}
+	b, err := json.Marshal(man)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(manifestPath(s.dir), b)
+}
+
+// lookupLocked returns the key's siblings from the newest source holding it.
+func (s *LSMStore) lookupLocked(key string) ([]Record, bool, error) {
+	if sibs, ok := s.mem[key]; ok {
+		return sibs, true, nil
+	}
+	if sibs, ok := s.imm[key]; ok {
+		return sibs, true, nil
+	}
+	for _, t := range s.tables {
+		sibs, ok, err := t.get(key)
+		if err != nil || ok {
+			return sibs, ok, err
+		}
+	}
+	return nil, false, nil
+}
+
+func (s *LSMStore) Observe(fn func(key string, before, after []Record)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observe = fn
+}
+
+func (s *LSMStore) Get(key string) ([]Record, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sibs, ok, err := s.lookupLocked(key)
+	if err != nil || !ok {
+		return nil, false
+	}
+	return append([]Record(nil), sibs...), true
+}
+
+// PutMerge merges rec with the key's current siblings, logs rec to the WAL
+// and installs the result in the memtable.
+func (s *LSMStore) PutMerge(rec Record) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before, _, err := s.lookupLocked(rec.Key)
+	if err != nil {
+		s.lastErr = err.Error()
+		return nil, err
+	}
+	sibs, changed := MergeSiblings(before, rec)
+	if !changed {
+		return before, nil
+	}
+	if err := s.wal.Append(rec); err != nil {
+		s.lastErr = err.Error()
+		return before, err
+	}
+
+	// The memtable holds one sibling set per key, so only the growth counts.
+	if old, ok := s.mem[rec.Key]; ok {
+		s.memSize -= recordsSize(rec.Key, old)
+	}
+	s.mem[rec.Key] = sibs
+	s.memSize += recordsSize(rec.Key, sibs)
+	if s.observe != nil {
+		s.observe(rec.Key, before, sibs)
+	}
+	if s.memSize >= s.cfg.MemtableBytes && s.imm == nil {
+		if err := s.rotateLocked(); err != nil {
+			s.lastErr = err.Error()
+		} else {
+			s.signal()
+		}
+	}
+	return sibs, nil
+}
+
+func recordsSize(key string, sibs []Record) int {
+	n := len(key)
+	for _, r := range sibs {
+		n += len(r.Value) + len(r.WriterID) + 16*len(r.Clock) + 32
+	}
+	return n
+}
+
+// rotateLocked freezes the memtable and starts a fresh one with its own WAL.
+func (s *LSMStore) rotateLocked() error {
+	w, err := OpenWAL(s.path(s.allocID(), ".wal"))
+	if err != nil {
+		return err
+	}
+	s.imm, s.immWAL = s.mem, s.wal
+	s.mem, s.wal, s.memSize = make(map[string][]Record), w, 0
+	return nil
+}
+
+func (s *LSMStore) signal() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (s *LSMStore) worker() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.kick:
+		}
+		s.workMu.Lock()
+		err := s.flushImm()
+		for merged := true; err == nil && merged; {
+			merged, _, err = s.compact(false, nil)
+		}
+		s.workMu.Unlock()
+		if err != nil {
+			s.mu.Lock()
+			s.lastErr = err.Error()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// flushImm writes the frozen memtable to a table. Caller holds workMu.
+func (s *LSMStore) flushImm() error {
+	s.mu.Lock()
+	imm := s.imm
+	if imm == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	id := s.allocID()
+	s.mu.Unlock()
+
+	// imm is read-only from here on, so it can be written without the lock.
+	t, err := s.writeTable(id, memIter(imm, ""))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.tables = append([]*sstable{t}, s.tables...)
+	if err := s.saveManifestLocked(); err != nil {
+		s.tables = s.tables[1:]
+		s.mu.Unlock()
+		_ = t.close()
+		_ = os.Remove(t.path)
+		return err
+	}
+	old := s.immWAL
+	s.imm, s.immWAL = nil, nil
+	s.flushes++
+	s.mu.Unlock()
+
+	_ = old.Close()
+	_ = os.Remove(old.Path())
+	return nil
+}
+
+// compact merges one run of adjacent, similarly sized tables (all tables if
+// full is set). Only adjacent tables are merged so a newer table is never
+// shadowed by an older key moved in front of it. A full compaction may also
+// drop keys: with every table in the run nothing older can resurface. It
+// reports whether a run was merged and how many keys were dropped. Caller
+// holds workMu.
+func (s *LSMStore) compact(full bool, drop func(key string, meta []Meta) bool) (bool, int, error) {
+	s.mu.RLock()
+	run := pickRun(s.tables, s.cfg.CompactMin, full)
+	s.mu.RUnlock()
+	if len(run) == 0 || (len(run) < 2 && drop == nil) {
+		return false, 0, nil
+	}
+
+	s.mu.Lock()
+	id := s.allocID()
+	s.mu.Unlock()
+
+	srcs := make([]entryIter, 0, len(run))
+	for _, t := range run {
+		srcs = append(srcs, t.iter(""))
+	}
+	fold := &foldIter{m: newMergeIter(srcs), drop: drop}
+	t, err := s.writeTable(id, fold)
+	if err != nil {
+		return false, 0, err
+	}
+
+	// Tables only change under workMu, so the run is still in place.
+	s.mu.Lock()
+	prev := s.tables
+	at := 0
+	for at < len(prev) && prev[at] != run[0] {
+		at++
+	}
+	next := make([]*sstable, 0, len(prev)-len(run)+1)
+	next = append(next, prev[:at]...)
+	next = append(next, t)
+	next = append(next, prev[at+len(run):]...)
+	s.tables = next
+	if err := s.saveManifestLocked(); err != nil {
+		s.tables = prev
+		s.mu.Unlock()
+		_ = t.close()
+		_ = os.Remove(t.path)
+		return false, 0, err
+	}
+	s.compactions++
+	for _, e := range fold.dropped {
+		// A write that landed in the memtable meanwhile is newer and stays.
+		_, inMem := s.mem[e.key]
+		_, inImm := s.imm[e.key]
+		if !inMem && !inImm && s.observe != nil {
+			s.observe(e.key, e.sibs, nil)
+		}
+	}
+	s.mu.Unlock()
+
+	// Readers hold s.mu, so nobody is still using the old tables.
+	for _, old := range run {
+		_ = old.close()
+		_ = os.Remove(old.path)
+	}
+	return true, len(fold.dropped), nil
+}
+
+// pickRun finds the first run of at least n adjacent tables whose sizes are
+// within 4x of each other. Once 4n tables pile up without such a run, all of
+// them are merged to bound read amplification.
+func pickRun(tables []*sstable, n int, full bool) []*sstable {
+	if full || len(tables) >= 4*n {
+		return append([]*sstable(nil), tables...)
+	}
+	for i := 0; i+n <= len(tables); i++ {
+		lo, hi := tables[i].size, tables[i].size
+		j := i
+		for ; j < len(tables); j++ {
+			sz := tables[j].size
+			if sz < lo {
+				lo = sz
+			}
+			if sz > hi {
+				hi = sz
+			}
+			if hi > 4*lo {
+				break
+			}
+		}
+		if j-i >= n {
+			return append([]*sstable(nil), tables[i:j]...)
+		}
+	}
+	return nil
+}
+
+// writeTable writes every entry of it to a new table file and opens it.
+func (s *LSMStore) writeTable(id uint64, it entryIter) (*sstable, error) {
+	path := s.path(id, ".sst")
+	tw, err := newTableWriter(path, s.cfg.BlockBytes)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		e, ok, err := it.next()
+		if err == nil && ok {
+			err = tw.add(e.key, e.sibs)
+		}
+		if err != nil {
+			tw.abort()
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+	}
+	if err := tw.finish(); err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return openTable(path, id)
+}
+
+func (s *LSMStore) KeysMeta() map[string][]Meta {
+	out := make(map[string][]Meta)
+	_ = s.Scan("", func(key string, sibs []Record) bool {
+		out[key] = MetaOf(sibs)
+		return true
+	})
+	return out
+}
+
+// Scan merges the memtables and all tables in key order; for each key the
+// newest source wins.
+func (s *LSMStore) Scan(start string, fn func(key string, sibs []Record) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	srcs := []entryIter{memIter(s.mem, start)}
+	if s.imm != nil {
+		srcs = append(srcs, memIter(s.imm, start))
+	}
+	for _, t := range s.tables {
+		srcs = append(srcs, t.iter(start))
+	}
+
+	m := newMergeIter(srcs)
+	for {
+		key, sets, ok, err := m.next()
+		if err != nil || !ok {
+			return err
+		}
+		if !fn(key, sets[0]) {
+			return nil
+		}
+	}
+}
+
+// Snapshot flushes the memtable and merges every table into one.
+func (s *LSMStore) Snapshot() error {
+	defer snapshotDuration.Since(time.Now(), "lsm")
+	s.workMu.Lock()
+	defer s.workMu.Unlock()
+
+	if err := s.flushAll(); err != nil {
+		return err
+	}
+	_, _, err := s.compact(true, nil)
+	return err
+}
+
+// Purge flushes the memtable and runs a full compaction that leaves matching
+// keys out of the new table.
+func (s *LSMStore) Purge(drop func(key string, meta []Meta) bool) (int, error) {
+	s.workMu.Lock()
+	defer s.workMu.Unlock()
+
+	if err := s.flushAll(); err != nil {
+		return 0, err
+	}
+	_, n, err := s.compact(true, drop)
+	return n, err
+}
+
+// flushAll moves every memtable into tables. Caller holds workMu.
+func (s *LSMStore) flushAll() error {
+	if err := s.flushImm(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	var err error
+	if len(s.mem) > 0 {
+		err = s.rotateLocked()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.flushImm()
+}
+
+func (s *LSMStore) Stats() map[string]any {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var bytes int64
+	tables := make([]map[string]any, 0, len(s.tables))
+	for _, t := range s.tables {
+		bytes += t.size
+		tables = append(tables, map[string]any{"id": t.id, "bytes": t.size, "keys": t.keys})
+	}
+	walOps, walBytes := s.wal.Stats()
+	return map[string]any{
+		"engine":         "lsm",
+		"dir":            s.dir,
+		"memtable_keys":  len(s.mem),
+		"memtable_bytes": s.memSize,
+		"flushing":       s.imm != nil,
+		"tables":         tables,
+		"table_bytes":    bytes,
+		"wal_ops":        walOps,
+		"wal_bytes":      walBytes,
+		"flushes":        s.flushes,
+		"compactions":    s.compactions,
+		"last_error":     s.lastErr,
+	}
+}
+
+// Close stops the background worker. Unflushed memtables stay in their WALs
+// and are recovered on the next open.
+func (s *LSMStore) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+	s.wg.Wait()
+
+	s.workMu.Lock()
+	defer s.workMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFiles()
+}
+
+func (s *LSMStore) closeFiles() error {
+	var err error
+	for _, w := range []*WAL{s.wal, s.immWAL} {
+		if w != nil {
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	for _, t := range s.tables {
+		if cerr := t.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// entryIter yields table entries in ascending key order.
+type entryIter interface {
+	next() (tableEntry, bool, error)
+}
+
+type sliceIter struct {
+	m    map[string][]Record
+	keys []string
+}
+
+func memIter(m map[string][]Record, start string) *sliceIter {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k >= start {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return &sliceIter{m: m, keys: keys}
+}
+
+func (it *sliceIter) next() (tableEntry, bool, error) {
+	if len(it.keys) == 0 {
+		return tableEntry{}, false, nil
+	}
+	k := it.keys[0]
+	it.keys = it.keys[1:]
+	return tableEntry{key: k, sibs: it.m[k]}, true, nil
+}
+
+// mergeIter walks several sources (newest first) in key order and returns,
+// per key, the sibling sets of every source holding it, newest first.
+type mergeIter struct {
+	srcs  []entryIter
+	heads []tableEntry
+	live  []bool
+	err   error
+}
+
+func newMergeIter(srcs []entryIter) *mergeIter {
+	m := &mergeIter{srcs: srcs, heads: make([]tableEntry, len(srcs)), live: make([]bool, len(srcs))}
+	for i := range srcs {
+		m.advance(i)
+	}
+	return m
+}
+
+func (m *mergeIter) advance(i int) {
+	e, ok, err := m.srcs[i].next()
+	if err != nil && m.err == nil {
+		m.err = err
+	}
+	m.heads[i], m.live[i] = e, ok && err == nil
+}
+
+func (m *mergeIter) next() (string, [][]Record, bool, error) {
+	if m.err != nil {
+		return "", nil, false, m.err
+	}
+	lo := -1
+	for i, ok := range m.live {
+		if ok && (lo < 0 || m.heads[i].key < m.heads[lo].key) {
+			lo = i
+		}
+	}
+	if lo < 0 {
+		return "", nil, false, nil
+	}
+
+	key := m.heads[lo].key
+	var sets [][]Record
+	for i, ok := range m.live {
+		if ok && m.heads[i].key == key {
+			sets = append(sets, m.heads[i].sibs)
+			m.advance(i)
+		}
+	}
+	return key, sets, true, m.err
+}
+
+// foldIter merges every version of a key with MergeSiblings, so compaction
+// output never depends on which table a sibling came from. Keys matching drop
+// are left out and remembered.
+type foldIter struct {
+	m       *mergeIter
+	drop    func(key string, meta []Meta) bool
+	dropped []tableEntry
+}
+
+func (f *foldIter) next() (tableEntry, bool, error) {
+	for {
+		key, sets, ok, err := f.m.next()
+		if err != nil || !ok {
+			return tableEntry{}, false, err
+		}
+		var out []Record
+		for _, set := range sets {
+			for _, r := range set {
+				out, _ = MergeSiblings(out, r)
+			}
+		}
+		e := tableEntry{key: key, sibs: out}
+		if f.drop != nil && f.drop(key, MetaOf(out)) {
+			f.dropped = append(f.dropped, e)
+			continue
+		}
+		return e, true, nil
+	}
+}
@@ -0,0 +1,10 @@
+package store
+
+import "mini-dynamo/internal/metrics"
+
+var (
+	fsyncDuration = metrics.NewHistogram("minidynamo_store_fsync_duration_seconds",
+		"Latency of storage engine log fsyncs, by log: wal (mem and lsm write-ahead logs) or data (disk engine data log).", metrics.DefBuckets, "log")
+	snapshotDuration = metrics.NewHistogram("minidynamo_store_snapshot_duration_seconds",
+		"Duration of engine snapshots and compactions, by engine.", []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300}, "engine")
+)
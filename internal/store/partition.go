@@ -0,0 +1,203 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Partitioned spreads keys over separate engines by partition, so a whole
+// partition can be dropped by closing its engine and deleting its files.
+// part names the partition of a key, "" being the base engine. Every
+// partition's keys must sort before the base engine's and partitions must
+// sort among themselves by name, so that Scan can visit them one after the
+// other. Keys of partitions that are not open are not found, and writing
+// them fails.
+type Partitioned struct {
+	base Engine
+	part func(key string) string
+
+	mu      sync.RWMutex
+	parts   map[string]Engine
+	names   []string // sorted
+	observe func(key string, before, after []Record)
+}
+
+var _ Engine = (*Partitioned)(nil)
+
+// ErrPartitionNotOpen is the error of writes to a partition that is not open,
+// such as a keyspace this node has not created yet.
+var ErrPartitionNotOpen = errors.New("partition not open")
+
+func NewPartitioned(base Engine, part func(key string) string) *Partitioned {
+	return &Partitioned{base: base, part: part, parts: make(map[string]Engine)}
+}
+
+// Add opens partition name on e.
+func (p *Partitioned) Add(name string, e Engine) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.parts[name]; ok || name == "" {
+		return fmt.Errorf("partition %q already open", name)
+	}
+	if p.observe != nil {
+		e.Observe(p.observe)
+	}
+	p.parts[name] = e
+	i := sort.SearchStrings(p.names, name)
+	p.names = append(p.names, "")
+	copy(p.names[i+1:], p.names[i:])
+	p.names[i] = name
+	return nil
+}
+
+// Remove takes partition name out and returns its engine for the caller to
+// close and delete.
+func (p *Partitioned) Remove(name string) (Engine, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.parts[name]
+	if !ok {
+		return nil, false
+	}
+	delete(p.parts, name)
+	i := sort.SearchStrings(p.names, name)
+	p.names = append(p.names[:i], p.names[i+1:]...)
+	return e, true
+}
+
+// engine returns the engine holding key, if its partition is open. The
+// caller holds p.mu for reading, so Remove waits for the call it makes.
+func (p *Partitioned) engine(key string) (Engine, bool) {
+	name := p.part(key)
+	if name == "" {
+		return p.base, true
+	}
+	e, ok := p.parts[name]
+	return e, ok
+}
+
+// all returns every engine in key order: partitions by name, then base.
+// Like engine, it needs p.mu held for as long as the engines are used.
+func (p *Partitioned) all() []Engine {
+	out := make([]Engine, 0, len(p.names)+1)
+	for _, name := range p.names {
+		out = append(out, p.parts[name])
+	}
+	return append(out, p.base)
+}
+
+func (p *Partitioned) Get(key string) ([]Record, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	e, ok := p.engine(key)
+	if !ok {
+		return nil, false
+	}
+	return e.Get(key)
+}
+
+func (p *Partitioned) PutMerge(rec Record) ([]Record, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	e, ok := p.engine(rec.Key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrPartitionNotOpen, p.part(rec.Key))
+	}
+	return e.PutMerge(rec)
+}
+
+func (p *Partitioned) KeysMeta() map[string][]Meta {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	engines := p.all()
+	out := engines[len(engines)-1].KeysMeta()
+	for _, e := range engines[:len(engines)-1] {
+		for k, m := range e.KeysMeta() {
+			out[k] = m
+		}
+	}
+	return out
+}
+
+// Scan visits each engine in turn; each only has keys after the previous
+// one's. Like every call that uses an engine, it holds p.mu for reading, so
+// Remove waits for it to finish; fn must not call back into p.
+func (p *Partitioned) Scan(start string, fn func(key string, sibs []Record) bool) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	more := true
+	for _, e := range p.all() {
+		err := e.Scan(start, func(key string, sibs []Record) bool {
+			more = fn(key, sibs)
+			return more
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Partitioned) Observe(fn func(key string, before, after []Record)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.observe = fn
+	for _, e := range p.all() {
+		e.Observe(fn)
+	}
+}
+
+func (p *Partitioned) Snapshot() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var first error
+	for _, e := range p.all() {
+		if err := e.Snapshot(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (p *Partitioned) Purge(drop func(key string, meta []Meta) bool) (int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	total := 0
+	for _, e := range p.all() {
+		n, err := e.Purge(drop)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Stats is the base engine's, plus each partition's under "partitions".
+func (p *Partitioned) Stats() map[string]any {
+	out := p.base.Stats()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.parts) > 0 {
+		parts := make(map[string]any, len(p.parts))
+		for name, e := range p.parts {
+			parts[name] = e.Stats()
+		}
+		out["partitions"] = parts
+	}
+	return out
+}
+
+func (p *Partitioned) Close() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var first error
+	for _, e := range p.all() {
+		if err := e.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -7,7 +7,7 @@ import (
 	"path/filepath"
 )
 
-func LoadSnapshot(path string) (map[string]Record, error) {
+func LoadSnapshot(path string) (map[string][]Record, error) {
 	if path == "" {
 		return nil, nil
 	}
@@ -18,10 +18,20 @@ func LoadSnapshot(path string) (map[string]Record, error) {
 		}
 		return nil, err
 	}
-	var m map[string]Record
-	if err := json.Unmarshal(b, &m); err != nil {
+	var m map[string][]Record
+	if err := json.Unmarshal(b, &m); err == nil {
+		return m, nil
+	}
+
+	// Snapshots written before siblings existed hold a single record per key.
+	var legacy map[string]Record
+	if err := json.Unmarshal(b, &legacy); err != nil {
 		return nil, err
 	}
+	m = make(map[string][]Record, len(legacy))
+	for k, r := range legacy {
+		m[k] = []Record{r}
+	}
 	return m, nil
 }
 
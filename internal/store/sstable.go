@@ -0,0 +1,389 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+)
+
+// SSTable file layout (all integers big endian unless noted):
+//
+//	data blocks   entries of [uvarint keyLen][key][uvarint valLen][json []Record]
+//	index         per block: [uvarint lastKeyLen][lastKey][uvarint off][uvarint len][crc32 u32]
+//	bloom         [k u32][keys u32][bit array]
+//	footer        [indexOff u64][indexLen u64][bloomOff u64][bloomLen u64][magic u64]
+//
+// Keys are strictly ascending. Tables are immutable once written.
+const (
+	sstMagic      = 0x6d696e6964796e01 // "minidyn" + format version
+	sstFooterSize = 40
+	bloomBitsKey  = 10
+	bloomHashes   = 7
+)
+
+var errCorruptTable = errors.New("corrupt sstable")
+
+type blockHandle struct {
+	last string
+	off  int64
+	n    int64
+	crc  uint32
+}
+
+// sstable is an open, immutable table file with its index and bloom filter in memory.
+type sstable struct {
+	id    uint64
+	path  string
+	f     *os.File
+	size  int64
+	keys  int
+	index []blockHandle
+	bloom bloom
+}
+
+func openTable(path string, id uint64) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTable(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	t.id, t.path = id, path
+	return t, nil
+}
+
+func readTable(f *os.File) (*sstable, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := st.Size()
+	if size < sstFooterSize {
+		return nil, errCorruptTable
+	}
+
+	var foot [sstFooterSize]byte
+	if _, err := f.ReadAt(foot[:], size-sstFooterSize); err != nil {
+		return nil, err
+	}
+	indexOff := int64(binary.BigEndian.Uint64(foot[0:]))
+	indexLen := int64(binary.BigEndian.Uint64(foot[8:]))
+	bloomOff := int64(binary.BigEndian.Uint64(foot[16:]))
+	bloomLen := int64(binary.BigEndian.Uint64(foot[24:]))
+	if binary.BigEndian.Uint64(foot[32:]) != sstMagic ||
+		indexOff+indexLen > size || bloomOff+bloomLen > size-sstFooterSize {
+		return nil, errCorruptTable
+	}
+
+	raw := make([]byte, indexLen)
+	if _, err := f.ReadAt(raw, indexOff); err != nil {
+		return nil, err
+	}
+	t := &sstable{f: f, size: size}
+	r := bytes.NewReader(raw)
+	for r.Len() > 0 {
+		last, err := readBytes(r)
+		if err != nil {
+			return nil, errCorruptTable
+		}
+		off, err1 := binary.ReadUvarint(r)
+		n, err2 := binary.ReadUvarint(r)
+		var crc uint32
+		err3 := binary.Read(r, binary.BigEndian, &crc)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, errCorruptTable
+		}
+		t.index = append(t.index, blockHandle{last: string(last), off: int64(off), n: int64(n), crc: crc})
+	}
+
+	braw := make([]byte, bloomLen)
+	if _, err := f.ReadAt(braw, bloomOff); err != nil {
+		return nil, err
+	}
+	if t.bloom, err = decodeBloom(braw); err != nil {
+		return nil, err
+	}
+	t.keys = int(t.bloom.keys)
+	return t, nil
+}
+
+func (t *sstable) close() error { return t.f.Close() }
+
+// readBlock loads and verifies one data block.
+func (t *sstable) readBlock(i int) ([]tableEntry, error) {
+	h := t.index[i]
+	b := make([]byte, h.n)
+	if _, err := t.f.ReadAt(b, h.off); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(b) != h.crc {
+		return nil, fmt.Errorf("%s block %d: %w", t.path, i, errCorruptTable)
+	}
+
+	var out []tableEntry
+	r := bytes.NewReader(b)
+	for r.Len() > 0 {
+		k, err := readBytes(r)
+		if err != nil {
+			return nil, errCorruptTable
+		}
+		v, err := readBytes(r)
+		if err != nil {
+			return nil, errCorruptTable
+		}
+		var sibs []Record
+		if err := json.Unmarshal(v, &sibs); err != nil {
+			return nil, errCorruptTable
+		}
+		out = append(out, tableEntry{key: string(k), sibs: sibs})
+	}
+	return out, nil
+}
+
+// get looks key up through the bloom filter and block index.
+func (t *sstable) get(key string) ([]Record, bool, error) {
+	if !t.bloom.mayContain(key) {
+		return nil, false, nil
+	}
+	i := t.seek(key)
+	if i == len(t.index) {
+		return nil, false, nil
+	}
+	entries, err := t.readBlock(i)
+	if err != nil {
+		return nil, false, err
+	}
+	j := sort.Search(len(entries), func(j int) bool { return entries[j].key >= key })
+	if j < len(entries) && entries[j].key == key {
+		return entries[j].sibs, true, nil
+	}
+	return nil, false, nil
+}
+
+// seek returns the first block whose last key is >= key.
+func (t *sstable) seek(key string) int {
+	return sort.Search(len(t.index), func(i int) bool { return t.index[i].last >= key })
+}
+
+type tableEntry struct {
+	key  string
+	sibs []Record
+}
+
+// tableIter walks a table in key order starting at the first key >= start.
+type tableIter struct {
+	t     *sstable
+	block int
+	buf   []tableEntry
+	start string
+}
+
+func (t *sstable) iter(start string) *tableIter {
+	return &tableIter{t: t, block: t.seek(start), start: start}
+}
+
+func (it *tableIter) next() (tableEntry, bool, error) {
+	for len(it.buf) == 0 {
+		if it.block >= len(it.t.index) {
+			return tableEntry{}, false, nil
+		}
+		entries, err := it.t.readBlock(it.block)
+		if err != nil {
+			return tableEntry{}, false, err
+		}
+		it.block++
+		for len(entries) > 0 && entries[0].key < it.start {
+			entries = entries[1:]
+		}
+		it.buf = entries
+	}
+	e := it.buf[0]
+	it.buf = it.buf[1:]
+	return e, true, nil
+}
+
+// tableWriter streams ascending entries into a new table file.
+type tableWriter struct {
+	f         *os.File
+	w         *bufio.Writer
+	off       int64
+	blockSize int
+	block     bytes.Buffer
+	last      string
+	index     []blockHandle
+	keys      []string
+}
+
+func newTableWriter(path string, blockSize int) (*tableWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{f: f, w: bufio.NewWriter(f), blockSize: blockSize}, nil
+}
+
+func (tw *tableWriter) add(key string, sibs []Record) error {
+	v, err := json.Marshal(sibs)
+	if err != nil {
+		return err
+	}
+	writeBytes(&tw.block, []byte(key))
+	writeBytes(&tw.block, v)
+	tw.last = key
+	tw.keys = append(tw.keys, key)
+	if tw.block.Len() >= tw.blockSize {
+		return tw.flushBlock()
+	}
+	return nil
+}
+
+func (tw *tableWriter) flushBlock() error {
+	if tw.block.Len() == 0 {
+		return nil
+	}
+	b := tw.block.Bytes()
+	if _, err := tw.w.Write(b); err != nil {
+		return err
+	}
+	tw.index = append(tw.index, blockHandle{last: tw.last, off: tw.off, n: int64(len(b)), crc: crc32.ChecksumIEEE(b)})
+	tw.off += int64(len(b))
+	tw.block.Reset()
+	return nil
+}
+
+// finish writes the index, bloom filter and footer, then fsyncs and closes the file.
+func (tw *tableWriter) finish() error {
+	err := tw.flushBlock()
+	if err == nil {
+		var idx bytes.Buffer
+		for _, h := range tw.index {
+			writeBytes(&idx, []byte(h.last))
+			var tmp [binary.MaxVarintLen64]byte
+			idx.Write(tmp[:binary.PutUvarint(tmp[:], uint64(h.off))])
+			idx.Write(tmp[:binary.PutUvarint(tmp[:], uint64(h.n))])
+			_ = binary.Write(&idx, binary.BigEndian, h.crc)
+		}
+		bl := newBloom(tw.keys).encode()
+
+		var foot [sstFooterSize]byte
+		binary.BigEndian.PutUint64(foot[0:], uint64(tw.off))
+		binary.BigEndian.PutUint64(foot[8:], uint64(idx.Len()))
+		binary.BigEndian.PutUint64(foot[16:], uint64(tw.off)+uint64(idx.Len()))
+		binary.BigEndian.PutUint64(foot[24:], uint64(len(bl)))
+		binary.BigEndian.PutUint64(foot[32:], sstMagic)
+
+		for _, part := range [][]byte{idx.Bytes(), bl, foot[:]} {
+			if _, err = tw.w.Write(part); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = tw.w.Flush()
+	}
+	if err == nil {
+		err = tw.f.Sync()
+	}
+	if cerr := tw.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (tw *tableWriter) abort() {
+	_ = tw.f.Close()
+	_ = os.Remove(tw.f.Name())
+}
+
+func writeBytes(b *bytes.Buffer, p []byte) {
+	var tmp [binary.MaxVarintLen64]byte
+	b.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(p)))])
+	b.Write(p)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	p := make([]byte, n)
+	_, err = io.ReadFull(r, p)
+	return p, err
+}
+
+// bloom is a classic bloom filter using double hashing over FNV-1a.
+type bloom struct {
+	k    uint32
+	keys uint32
+	bits []byte
+}
+
+func newBloom(keys []string) bloom {
+	m := len(keys) * bloomBitsKey
+	if m < 64 {
+		m = 64
+	}
+	b := bloom{k: bloomHashes, keys: uint32(len(keys)), bits: make([]byte, (m+7)/8)}
+	for _, k := range keys {
+		h1, h2 := bloomHash(k)
+		for i := uint32(0); i < b.k; i++ {
+			bit := (h1 + i*h2) % uint32(len(b.bits)*8)
+			b.bits[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return b
+}
+
+func (b bloom) mayContain(key string) bool {
+	if len(b.bits) == 0 {
+		return true
+	}
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % uint32(len(b.bits)*8)
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bloom) encode() []byte {
+	out := make([]byte, 8+len(b.bits))
+	binary.BigEndian.PutUint32(out[0:], b.k)
+	binary.BigEndian.PutUint32(out[4:], b.keys)
+	copy(out[8:], b.bits)
+	return out
+}
+
+func decodeBloom(p []byte) (bloom, error) {
+	if len(p) < 8 {
+		return bloom{}, errCorruptTable
+	}
+	return bloom{
+		k:    binary.BigEndian.Uint32(p[0:]),
+		keys: binary.BigEndian.Uint32(p[4:]),
+		bits: append([]byte(nil), p[8:]...),
+	}, nil
+}
+
+func bloomHash(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	v := h.Sum64()
+	return uint32(v), uint32(v>>32) | 1
+}
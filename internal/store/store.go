@@ -1,9 +1,9 @@
 package store
 
 import (
-	"bytes"
 	"encoding/json"
 	"sync"
+	"time"
 )
 
 type Record struct {
@@ -12,22 +12,64 @@ type Record struct {
 	Ts       int64  `json:"ts"`
 	WriterID string `json:"writer_id"`
 	Deleted  bool   `json:"deleted,omitempty"` // tombstone
+	Clock    VClock `json:"clock,omitempty"`
+
+	// ExpiresAt is the unix-nanosecond expiry of a TTL write (0 = never).
+	ExpiresAt int64 `json:"expires_at,omitempty"`
 }
 
+// Meta describes one sibling version of a key for anti-entropy comparisons.
 type Meta struct {
-	Ts       int64  `json:"ts"`
-	WriterID string `json:"writer_id"`
-	Deleted  bool   `json:"deleted,omitempty"`
+	Ts        int64  `json:"ts"`
+	WriterID  string `json:"writer_id"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Clock     VClock `json:"clock,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
 }
 
+// MemStore keeps, per key, the set of causally concurrent siblings in memory.
+// Durability comes from an optional KV WAL plus periodic snapshots.
 type MemStore struct {
-	mu  sync.RWMutex
-	m   map[string]Record
-	wal *WAL
+	mu       sync.RWMutex
+	m        map[string][]Record
+	keys     *keyIndex // keys of m in order, for Scan
+	wal      *WAL
+	snapPath string
+	observe  func(key string, before, after []Record)
 }
 
 func NewMem() *MemStore {
-	return &MemStore{m: make(map[string]Record)}
+	return &MemStore{m: make(map[string][]Record), keys: newKeyIndex()}
+}
+
+// OpenMem recovers a MemStore from its snapshot (if any) and WAL, then keeps
+// appending to the WAL. Snapshot() writes snapPath and truncates the WAL.
+func OpenMem(walPath, snapPath string) (*MemStore, error) {
+	s := NewMem()
+	s.snapPath = snapPath
+
+	snap, err := LoadSnapshot(snapPath)
+	if err != nil {
+		return nil, err
+	}
+	if snap != nil {
+		s.LoadAll(snap)
+	}
+
+	wal, err := OpenWAL(walPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replay WAL into store (no WAL writes during replay).
+	if err := wal.Replay(func(rec Record) { s.ApplyMerge(rec) }); err != nil {
+		_ = wal.Close()
+		return nil, err
+	}
+
+	// Attach WAL so future writes are durable.
+	s.AttachWAL(wal)
+	return s, nil
 }
 
 func (s *MemStore) AttachWAL(w *WAL) {
@@ -36,98 +78,114 @@ func (s *MemStore) AttachWAL(w *WAL) {
 	s.wal = w
 }
 
-func (s *MemStore) Get(key string) (Record, bool) {
+// Observe registers fn to be called (under the store lock) whenever a key's
+// siblings change. Used to keep derived indexes such as Merkle trees current.
+func (s *MemStore) Observe(fn func(key string, before, after []Record)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observe = fn
+}
+
+// Scan visits keys >= start in ascending order under the read lock.
+func (s *MemStore) Scan(start string, fn func(key string, sibs []Record) bool) error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	rec, ok := s.m[key]
-	return rec, ok
+
+	s.keys.ascend(start, func(k string) bool {
+		return fn(k, s.m[k])
+	})
+	return nil
 }
 
-// KeysMeta returns a snapshot of key->metadata for anti-entropy comparisons.
-func (s *MemStore) KeysMeta() map[string]Meta {
+func (s *MemStore) Get(key string) ([]Record, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	sibs, ok := s.m[key]
+	if !ok {
+		return nil, false
+	}
+	out := make([]Record, len(sibs))
+	copy(out, sibs)
+	return out, true
+}
 
-	out := make(map[string]Meta, len(s.m))
-	for k, r := range s.m {
-		out[k] = Meta{Ts: r.Ts, WriterID: r.WriterID, Deleted: r.Deleted}
+// KeysMeta returns a snapshot of key->sibling metadata for anti-entropy comparisons.
+func (s *MemStore) KeysMeta() map[string][]Meta {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make(map[string][]Meta, len(s.m))
+	for k, sibs := range s.m {
+		out[k] = MetaOf(sibs)
 	}
 	return out
 }
 
-func (s *MemStore) DumpAll() map[string]Record {
+func (s *MemStore) DumpAll() map[string][]Record {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	out := make(map[string]Record, len(s.m))
-	for k, r := range s.m {
-		out[k] = r
+	out := make(map[string][]Record, len(s.m))
+	for k, sibs := range s.m {
+		out[k] = append([]Record(nil), sibs...)
 	}
 	return out
 }
 
-func (s *MemStore) LoadAll(m map[string]Record) {
+func (s *MemStore) LoadAll(m map[string][]Record) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.m = make(map[string]Record, len(m))
-	for k, r := range m {
-		s.m[k] = r
+	s.m = make(map[string][]Record, len(m))
+	s.keys = newKeyIndex()
+	for k, sibs := range m {
+		s.m[k] = append([]Record(nil), sibs...)
+		s.keys.insert(k)
 	}
 }
 
-// ApplyLWW applies a record with LWW merge WITHOUT writing to the WAL.
+// ApplyMerge applies a record with causal merge WITHOUT writing to the WAL.
 // Use this during snapshot/WAL replay on startup.
-func (s *MemStore) ApplyLWW(rec Record) Record {
+func (s *MemStore) ApplyMerge(rec Record) []Record {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	cur, ok := s.m[rec.Key]
-	if !ok {
-		s.m[rec.Key] = rec
-		return rec
+	before := s.m[rec.Key]
+	sibs, changed := MergeSiblings(before, rec)
+	s.m[rec.Key] = sibs
+	s.keys.insert(rec.Key)
+	if changed && s.observe != nil {
+		s.observe(rec.Key, before, sibs)
 	}
-	winner := Newer(cur, rec)
-	s.m[rec.Key] = winner
-	return winner
+	return sibs
 }
 
-func (s *MemStore) Put(rec Record) {
+// PutMerge folds rec into the key's siblings and persists it to WAL (if attached).
+// Concurrent versions are kept side by side; dominated ones are dropped.
+func (s *MemStore) PutMerge(rec Record) ([]Record, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.m[rec.Key] = rec
-}
 
-// PutLWW merges under Last-Write-Wins and persists the winner to WAL (if attached).
-func (s *MemStore) PutLWW(rec Record) Record {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	cur, ok := s.m[rec.Key]
-	if !ok {
-		// persist
-		if s.wal != nil {
-			_ = s.wal.Append(rec)
-		}
-		s.m[rec.Key] = rec
-		return rec
-	}
-
-	winner := Newer(cur, rec)
+	before := s.m[rec.Key]
+	sibs, changed := MergeSiblings(before, rec)
 
 	// If nothing changes, do nothing (don’t bloat WAL).
-	if winner.Ts == cur.Ts &&
-		winner.WriterID == cur.WriterID &&
-		winner.Deleted == cur.Deleted &&
-		bytes.Equal(winner.Value, cur.Value) {
-		return cur
+	if !changed {
+		return s.m[rec.Key], nil
 	}
 
+	// The merge is order-independent, so logging the incoming record is enough for replay.
 	if s.wal != nil {
-		_ = s.wal.Append(winner)
+		if err := s.wal.Append(rec); err != nil {
+			return before, err
+		}
 	}
-	s.m[rec.Key] = winner
-	return winner
+	s.m[rec.Key] = sibs
+	s.keys.insert(rec.Key)
+	if s.observe != nil {
+		s.observe(rec.Key, before, sibs)
+	}
+	return sibs, nil
 }
 
 // SnapshotAndResetWAL blocks writers, writes a full snapshot, then truncates the WAL.
@@ -148,3 +206,66 @@ func (s *MemStore) SnapshotAndResetWAL(snapPath string) error {
 	}
 	return nil
 }
+
+// Snapshot writes a full snapshot and truncates the WAL. Without a snapshot
+// path (NewMem) there is nothing to compact.
+func (s *MemStore) Snapshot() error {
+	if s.snapPath == "" {
+		return nil
+	}
+	defer snapshotDuration.Since(time.Now(), "mem")
+	return s.SnapshotAndResetWAL(s.snapPath)
+}
+
+// Purge drops matching keys, then rewrites the snapshot and truncates the WAL
+// so replay cannot bring them back.
+func (s *MemStore) Purge(drop func(key string, meta []Meta) bool) (int, error) {
+	s.mu.Lock()
+	n := 0
+	for k, sibs := range s.m {
+		if !drop(k, MetaOf(sibs)) {
+			continue
+		}
+		delete(s.m, k)
+		s.keys.remove(k)
+		n++
+		if s.observe != nil {
+			s.observe(k, sibs, nil)
+		}
+	}
+	s.mu.Unlock()
+
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.Snapshot()
+}
+
+func (s *MemStore) Stats() map[string]any {
+	s.mu.RLock()
+	keys := len(s.m)
+	wal := s.wal
+	s.mu.RUnlock()
+
+	out := map[string]any{
+		"engine":      "mem",
+		"keys":        keys,
+		"kv_snapshot": s.snapPath,
+	}
+	if wal != nil {
+		ops, bytes := wal.Stats()
+		out["kv_wal"] = wal.Path()
+		out["wal_ops"] = ops
+		out["wal_bytes"] = bytes
+	}
+	return out
+}
+
+func (s *MemStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Close()
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"math"
+	"time"
+)
+
+// Expired reports whether r carries an expiry that has passed at now (unix ns).
+func (r Record) Expired(now int64) bool {
+	return r.ExpiresAt != 0 && now >= r.ExpiresAt
+}
+
+// ExpiryTombstone is the tombstone that replaces an expired record. It keeps
+// the record's clock and is stamped at the expiry time, so it wins the LWW
+// tie-break against the record, and every replica that sweeps the record
+// independently produces the exact same version.
+func ExpiryTombstone(r Record) Record {
+	return Record{
+		Key:      r.Key,
+		Ts:       r.ExpiresAt,
+		WriterID: r.WriterID,
+		Deleted:  true,
+		Clock:    r.Clock.Clone(),
+	}
+}
+
+// ExpiryFor converts a TTL into an absolute expiry for a record written at ts.
+// An expiry past the end of int64 time is clamped rather than wrapped.
+func ExpiryFor(ts int64, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	if int64(ttl) > math.MaxInt64-ts {
+		return math.MaxInt64
+	}
+	return ts + int64(ttl)
+}
@@ -0,0 +1,181 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VClock is a vector clock: node ID -> counter of writes coordinated by that node.
+type VClock map[string]uint64
+
+// Ordering is the causal relationship between two vector clocks.
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+func (vc VClock) Clone() VClock {
+	out := make(VClock, len(vc))
+	for k, v := range vc {
+		out[k] = v
+	}
+	return out
+}
+
+// Merge returns the pointwise maximum of vc and other.
+func (vc VClock) Merge(other VClock) VClock {
+	out := vc.Clone()
+	for k, v := range other {
+		if v > out[k] {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// Compare reports how vc relates to other (vc is Before other, After other, ...).
+func (vc VClock) Compare(other VClock) Ordering {
+	less, greater := false, false
+	for k, v := range vc {
+		if ov := other[k]; v > ov {
+			greater = true
+		} else if v < ov {
+			less = true
+		}
+	}
+	for k, ov := range other {
+		if _, ok := vc[k]; !ok && ov > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	default:
+		return Equal
+	}
+}
+
+// MergeSiblings folds rec into a set of concurrent siblings.
+// Siblings dominated by rec are dropped; rec is dropped if an existing sibling
+// descends from it. Equal clocks (including legacy records without a clock)
+// fall back to LWW so the result stays deterministic.
+func MergeSiblings(sibs []Record, rec Record) (out []Record, changed bool) {
+	out = make([]Record, 0, len(sibs)+1)
+	obsolete := false
+
+	for _, s := range sibs {
+		switch rec.Clock.Compare(s.Clock) {
+		case After:
+			changed = true
+		case Before:
+			obsolete = true
+			out = append(out, s)
+		case Equal:
+			obsolete = true
+			w := Newer(s, rec)
+			if !sameRecord(w, s) {
+				changed = true
+			}
+			out = append(out, w)
+		default:
+			out = append(out, s)
+		}
+	}
+
+	if !obsolete {
+		out = append(out, rec)
+		changed = true
+	}
+
+	sortSiblings(out)
+	return out, changed
+}
+
+// ContextOf returns the causal context covering every sibling.
+func ContextOf(sibs []Record) VClock {
+	out := VClock{}
+	for _, s := range sibs {
+		out = out.Merge(s.Clock)
+	}
+	return out
+}
+
+// Live returns the siblings that are neither tombstones nor expired.
+func Live(sibs []Record) []Record {
+	now := time.Now().UnixNano()
+	out := make([]Record, 0, len(sibs))
+	for _, s := range sibs {
+		if !s.Deleted && !s.Expired(now) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// VersionTag identifies the live siblings of a key by (Ts, WriterID); the
+// HTTP layer exposes it as an ETag. It is empty when nothing is live.
+func VersionTag(sibs []Record) string {
+	live := Live(sibs)
+	parts := make([]string, 0, len(live))
+	for _, r := range live {
+		parts = append(parts, strconv.FormatInt(r.Ts, 10)+"-"+r.WriterID)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ".")
+}
+
+// EncodeContext turns a clock into an opaque token for clients.
+func EncodeContext(vc VClock) string {
+	if len(vc) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(vc)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeContext parses a token produced by EncodeContext. Empty means no context.
+func DecodeContext(tok string) (VClock, error) {
+	if tok == "" {
+		return VClock{}, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(tok)
+	if err != nil {
+		return nil, err
+	}
+	var vc VClock
+	if err := json.Unmarshal(b, &vc); err != nil {
+		return nil, err
+	}
+	if vc == nil {
+		vc = VClock{}
+	}
+	return vc, nil
+}
+
+func sameRecord(a, b Record) bool {
+	return a.Ts == b.Ts && a.WriterID == b.WriterID && a.Deleted == b.Deleted
+}
+
+// sortSiblings orders siblings oldest-first by (Ts, WriterID) for stable output.
+func sortSiblings(sibs []Record) {
+	sort.Slice(sibs, func(i, j int) bool {
+		if sibs[i].Ts != sibs[j].Ts {
+			return sibs[i].Ts < sibs[j].Ts
+		}
+		return sibs[i].WriterID < sibs[j].WriterID
+	})
+}
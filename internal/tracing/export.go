@@ -0,0 +1,192 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FileExporter appends spans to a file, one JSON object per line.
+type FileExporter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// fileSpan is the line format of FileExporter.
+type fileSpan struct {
+	Service    string  `json:"service"`
+	TraceID    string  `json:"trace_id"`
+	SpanID     string  `json:"span_id"`
+	ParentID   string  `json:"parent_id,omitempty"`
+	Name       string  `json:"name"`
+	Kind       string  `json:"kind"`
+	Start      string  `json:"start"`
+	DurationMs float64 `json:"duration_ms"`
+	Attrs      []Attr  `json:"attrs,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func (e *FileExporter) Export(service string, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, d := range spans {
+		fs := fileSpan{
+			Service:    service,
+			TraceID:    d.TraceID.String(),
+			SpanID:     d.SpanID.String(),
+			Name:       d.Name,
+			Kind:       d.Kind.String(),
+			Start:      d.Start.UTC().Format(time.RFC3339Nano),
+			DurationMs: float64(d.End.Sub(d.Start).Microseconds()) / 1000,
+			Attrs:      d.Attrs,
+			Error:      d.Err,
+		}
+		if d.Parent != (SpanID{}) {
+			fs.ParentID = d.Parent.String()
+		}
+		if err := enc.Encode(fs); err != nil {
+			return err
+		}
+	}
+	return e.w.Flush()
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector over OTLP/HTTP
+// with the JSON encoding.
+type OTLPExporter struct {
+	url  string
+	http *http.Client
+}
+
+// NewOTLPExporter exports to endpoint, a collector's OTLP/HTTP base URL
+// such as http://localhost:4318; /v1/traces is added unless it has a path.
+func NewOTLPExporter(endpoint string) (*OTLPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("bad OTLP endpoint %q (want http(s)://host:port)", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return &OTLPExporter{url: u.String(), http: &http.Client{Timeout: 5 * time.Second}}, nil
+}
+
+// OTLP/JSON messages (opentelemetry-proto, trace/v1). IDs are hex strings
+// and 64-bit integers decimal strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 2 = error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func otlpAttrs(attrs []Attr) []otlpKeyValue {
+	out := make([]otlpKeyValue, len(attrs))
+	for i, a := range attrs {
+		out[i] = otlpKeyValue{Key: a.Key, Value: otlpValue{StringValue: a.Value}}
+	}
+	return out
+}
+
+func (e *OTLPExporter) Export(service string, spans []SpanData) error {
+	out := make([]otlpSpan, len(spans))
+	for i, d := range spans {
+		out[i] = otlpSpan{
+			TraceID:           d.TraceID.String(),
+			SpanID:            d.SpanID.String(),
+			Name:              d.Name,
+			Kind:              int(d.Kind),
+			StartTimeUnixNano: strconv.FormatInt(d.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(d.End.UnixNano(), 10),
+			Attributes:        otlpAttrs(d.Attrs),
+		}
+		if d.Parent != (SpanID{}) {
+			out[i].ParentSpanID = d.Parent.String()
+		}
+		if d.Err != "" {
+			out[i].Status = otlpStatus{Code: 2, Message: d.Err}
+		}
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttrs([]Attr{
+			{Key: "service.name", Value: "mini-dynamo"},
+			{Key: "service.instance.id", Value: service},
+		})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "mini-dynamo"}, Spans: out}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", e.url, resp.Status)
+	}
+	return nil
+}
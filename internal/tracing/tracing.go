@@ -0,0 +1,348 @@
+package tracing
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Distributed tracing with W3C trace context. A span covers one operation;
+// its context travels to other nodes in the traceparent header, so the spans
+// of one client request on every node it touches share a trace ID. Finished
+// spans are handed to an Exporter in batches. Without a tracer (SetDefault)
+// spans are not recorded, but incoming trace context is still passed on.
+
+// Header is the W3C trace context header.
+const Header = "traceparent"
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Valid reports whether sc has a trace and span ID.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent reads a traceparent header value (version 00, or a later
+// version's leading fields).
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.Valid()
+}
+
+type ctxKey struct{}
+
+// ContextWith returns ctx carrying sc as the current span context.
+func ContextWith(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, ctxKey{}, sc)
+}
+
+// FromContext returns the current span context of ctx, if any.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(ctxKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Detach returns a background context carrying ctx's span context, for work
+// that outlives the request but belongs to its trace.
+func Detach(ctx context.Context) context.Context {
+	if sc, ok := FromContext(ctx); ok {
+		return ContextWith(context.Background(), sc)
+	}
+	return context.Background()
+}
+
+// Inject sets the traceparent header of an outgoing request from ctx.
+func Inject(ctx context.Context, h http.Header) {
+	if sc, ok := FromContext(ctx); ok {
+		h.Set(Header, sc.Traceparent())
+	}
+}
+
+// Kind is the role of a span in a call, as in OTLP.
+type Kind int
+
+const (
+	Internal Kind = 1
+	Server   Kind = 2
+	Client   Kind = 3
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Server:
+		return "server"
+	case Client:
+		return "client"
+	default:
+		return "internal"
+	}
+}
+
+// Attr is a span attribute.
+type Attr struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// SpanData is a finished span as exporters see it.
+type SpanData struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Parent  SpanID // zero for a root span
+	Name    string
+	Kind    Kind
+	Start   time.Time
+	End     time.Time
+	Attrs   []Attr
+	Err     string // empty if the span succeeded
+}
+
+// Span is an operation being timed. A nil *Span (an unsampled span, or no
+// tracer) ignores every call.
+type Span struct {
+	t    *Tracer
+	mu   sync.Mutex
+	data SpanData
+	done bool
+}
+
+// SetAttr records a key/value attribute on s.
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Attrs = append(s.data.Attrs, Attr{Key: key, Value: value})
+	s.mu.Unlock()
+}
+
+// End finishes s, failed if err is not nil, and queues it for export.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	s.data.End = time.Now()
+	if err != nil {
+		s.data.Err = err.Error()
+	}
+	d := s.data
+	s.mu.Unlock()
+	s.t.queue(d)
+}
+
+// Tracer samples and records spans and exports them in the background.
+type Tracer struct {
+	service string
+	sample  float64
+	exp     Exporter
+	spans   chan SpanData
+	dropped atomic.Int64
+}
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(service string, spans []SpanData) error
+}
+
+// Export batching: at most exportBatch spans per call, at least every
+// exportEvery; spans past queueLen waiting ones are dropped.
+const (
+	exportBatch = 512
+	exportEvery = time.Second
+	queueLen    = 8192
+)
+
+// New returns a tracer for the node service that records a fraction sample
+// (0..1) of the traces it starts; traces started elsewhere keep the
+// caller's decision.
+func New(service string, sample float64, exp Exporter) *Tracer {
+	t := &Tracer{service: service, sample: sample, exp: exp, spans: make(chan SpanData, queueLen)}
+	go t.run()
+	return t
+}
+
+func (t *Tracer) queue(d SpanData) {
+	select {
+	case t.spans <- d:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *Tracer) run() {
+	tick := time.NewTicker(exportEvery)
+	defer tick.Stop()
+	batch := make([]SpanData, 0, exportBatch)
+	failing := false
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := t.exp.Export(t.service, batch)
+		switch {
+		case err != nil && !failing:
+			log.Printf("tracing: export %d spans: %v (logged once until it recovers)", len(batch), err)
+		case err == nil && failing:
+			log.Printf("tracing: export recovered")
+		}
+		failing = err != nil
+		if n := t.dropped.Swap(0); n > 0 {
+			log.Printf("tracing: dropped %d spans (export queue full)", n)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case d := <-t.spans:
+			if batch = append(batch, d); len(batch) == exportBatch {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+var current atomic.Pointer[Tracer]
+
+// SetDefault makes t the tracer of Start.
+func SetDefault(t *Tracer) { current.Store(t) }
+
+// Start begins a span named name as a child of ctx's span, or a new trace.
+// It returns ctx carrying the new span's context, and the span, which is nil
+// if it is not recorded.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	t := current.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	parent, ok := FromContext(ctx)
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+	if !ok {
+		sc.TraceID = newTraceID()
+		sc.Sampled = rand.Float64() < t.sample
+	}
+	sc.SpanID = newSpanID()
+	ctx = ContextWith(ctx, sc)
+	if !sc.Sampled {
+		return ctx, nil
+	}
+	return ctx, &Span{t: t, data: SpanData{
+		TraceID: sc.TraceID,
+		SpanID:  sc.SpanID,
+		Parent:  parent.SpanID,
+		Name:    name,
+		Kind:    kind,
+		Start:   time.Now(),
+	}}
+}
+
+func newTraceID() (id TraceID) {
+	_, _ = crand.Read(id[:])
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	_, _ = crand.Read(id[:])
+	return id
+}
+
+// HTTPServer wraps next in a server span per request, named by name. With
+// root false only requests that carry a traceparent are traced, so internal
+// traffic is traced only as part of a client request.
+func HTTPServer(name func(r *http.Request) string, root bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		sc, ok := ParseTraceparent(r.Header.Get(Header))
+		if ok {
+			ctx = ContextWith(ctx, sc)
+		} else if !root {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, sp := Start(ctx, name(r), Server)
+		if sp == nil {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		sp.SetAttr("http.method", r.Method)
+		sp.SetAttr("http.target", r.URL.RequestURI())
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		sp.SetAttr("http.status_code", strconv.Itoa(sw.status))
+		var err error
+		if sw.status >= 500 {
+			err = httpError(sw.status)
+		}
+		sp.End(err)
+	})
+}
+
+type httpError int
+
+func (e httpError) Error() string { return http.StatusText(int(e)) }
+
+// statusWriter remembers the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,150 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Default batch limits of a Client (see Client.BatchRecords and BatchBytes).
+const (
+	DefaultBatchRecords = 256
+	DefaultBatchBytes   = 1 << 20
+)
+
+func (c *Client) batchLimits() (records, bytes int) {
+	records, bytes = c.BatchRecords, c.BatchBytes
+	if records <= 0 {
+		records = DefaultBatchRecords
+	}
+	if bytes <= 0 {
+		bytes = DefaultBatchBytes
+	}
+	return records, bytes
+}
+
+// PutBatch writes puts to the node at base (scheme and address) through
+// /internal/put_batch, in as many requests as the batch limits need. It
+// returns one error per put, nil for those the node applied. A request that
+// fails fails its puts and every later one; the node is not tried again.
+func (c *Client) PutBatch(ctx context.Context, base string, puts []PutRequest) []error {
+	errs := make([]error, len(puts))
+	maxRecords, maxBytes := c.batchLimits()
+
+	// Encode each put once; requests are cut by the encoded size.
+	bin := c.speaksBinary(base)
+	var (
+		chunk [][]byte
+		idx   []int // index in puts of each chunk entry
+		size  int
+	)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		var resp PutBatchResponse
+		err := c.post(ctx, base+"/internal/put_batch", putBatchBody(chunk, bin), contentType(bin), &resp)
+		if err == nil && len(resp.Errors) != len(chunk) {
+			err = fmt.Errorf("put_batch: %d results for %d records", len(resp.Errors), len(chunk))
+		}
+		if err != nil {
+			return err
+		}
+		for i, e := range resp.Errors {
+			if e != "" {
+				errs[idx[i]] = errors.New(e)
+			}
+		}
+		chunk, idx, size = chunk[:0], idx[:0], 0
+		return nil
+	}
+	for i, p := range puts {
+		var b []byte
+		if bin {
+			e := &encoder{}
+			p.encode(e)
+			b = e.b
+		} else {
+			var err error
+			if b, err = json.Marshal(p); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+		if len(chunk) > 0 && (len(chunk) == maxRecords || size+len(b) > maxBytes) {
+			if err := flush(); err != nil {
+				return failFrom(errs, idx[0], err)
+			}
+		}
+		chunk, idx = append(chunk, b), append(idx, i)
+		size += len(b)
+	}
+	if err := flush(); err != nil {
+		return failFrom(errs, idx[0], err)
+	}
+	return errs
+}
+
+// putBatchBody assembles a PutBatchRequest from puts encoded one by one.
+func putBatchBody(puts [][]byte, bin bool) []byte {
+	if bin {
+		e := &encoder{b: []byte{ProtoVersion}}
+		e.uvarint(uint64(len(puts)))
+		for _, p := range puts {
+			e.b = append(e.b, p...)
+		}
+		return e.b
+	}
+	raw := make([]json.RawMessage, len(puts))
+	for i, p := range puts {
+		raw[i] = p
+	}
+	b, _ := json.Marshal(struct {
+		Puts []json.RawMessage `json:"puts"`
+	}{raw})
+	return b
+}
+
+func contentType(bin bool) string {
+	if bin {
+		return binaryType
+	}
+	return jsonType
+}
+
+// failFrom sets every error from i on that is still nil to err.
+func failFrom(errs []error, i int, err error) []error {
+	for ; i < len(errs); i++ {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// GetBatch reads keys from the node at base through /internal/get_batch, in
+// as many requests as the batch limits need (the byte limit counts keys).
+// Results are aligned with keys; any failed request fails the whole call.
+func (c *Client) GetBatch(ctx context.Context, base string, keys []string) ([]GetResponse, error) {
+	maxRecords, maxBytes := c.batchLimits()
+	out := make([]GetResponse, 0, len(keys))
+	for len(out) < len(keys) {
+		start, size := len(out), 0
+		end := start
+		for end < len(keys) && end-start < maxRecords && (end == start || size+len(keys[end]) <= maxBytes) {
+			size += len(keys[end])
+			end++
+		}
+
+		var resp GetBatchResponse
+		if err := c.Post(ctx, base+"/internal/get_batch", &GetBatchRequest{Keys: keys[start:end]}, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Results) != end-start {
+			return nil, fmt.Errorf("get_batch: %d results for %d keys", len(resp.Results), end-start)
+		}
+		out = append(out, resp.Results...)
+	}
+	return out, nil
+}
@@ -0,0 +1,394 @@
+package transport
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mini-dynamo/internal/ring"
+	"mini-dynamo/internal/store"
+)
+
+// The binary protocol carries the hot internal messages (replica puts and
+// gets, their batches and anti-entropy key metadata) without JSON: values
+// travel as raw bytes instead of base64, and numbers as varints. A body is
+// a version byte followed by the message; strings and byte slices are
+// length-prefixed, lists are count-prefixed.
+//
+// Nodes advertise the highest protocol they speak in ProtoHeader on every
+// internal response. A client uses binary for a peer only once it has seen
+// that peer advertise it, and goes back to JSON as soon as a response lacks
+// it, so mixed-version clusters keep working during rolling upgrades.
+const (
+	ProtoVersion = 1
+	ProtoHeader  = "X-Proto"
+
+	binaryType = "application/x-mini-dynamo"
+	jsonType   = "application/json"
+)
+
+// binaryMessage is implemented by the messages the binary protocol carries.
+type binaryMessage interface {
+	encode(e *encoder)
+	decode(d *decoder)
+}
+
+// Advertise wraps the internal API so every response carries ProtoHeader.
+func Advertise(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ProtoHeader, strconv.Itoa(ProtoVersion))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Decode reads an internal request body in the codec of its Content-Type.
+// An empty body leaves v untouched and returns io.EOF.
+func Decode(r *http.Request, v any) error {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), binaryType) {
+		return json.NewDecoder(r.Body).Decode(v)
+	}
+	m, ok := v.(binaryMessage)
+	if !ok {
+		return fmt.Errorf("%T has no binary encoding", v)
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return io.EOF
+	}
+	return unmarshalBinary(b, m)
+}
+
+// Encode writes an internal response in binary if the request accepts it
+// and v has a binary encoding, otherwise as JSON.
+func Encode(w http.ResponseWriter, r *http.Request, v any) {
+	if m, ok := v.(binaryMessage); ok && strings.Contains(r.Header.Get("Accept"), binaryType) {
+		w.Header().Set("Content-Type", binaryType)
+		_, _ = w.Write(marshalBinary(m))
+		return
+	}
+	w.Header().Set("Content-Type", jsonType)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func marshalBinary(m binaryMessage) []byte {
+	e := &encoder{b: []byte{ProtoVersion}}
+	m.encode(e)
+	return e.b
+}
+
+func unmarshalBinary(b []byte, m binaryMessage) error {
+	if b[0] != ProtoVersion {
+		return fmt.Errorf("unsupported binary protocol version %d", b[0])
+	}
+	d := &decoder{b: b[1:]}
+	m.decode(d)
+	if d.err == nil && len(d.b) > 0 {
+		d.err = fmt.Errorf("%d trailing bytes", len(d.b))
+	}
+	return d.err
+}
+
+type encoder struct{ b []byte }
+
+func (e *encoder) uvarint(v uint64) { e.b = binary.AppendUvarint(e.b, v) }
+func (e *encoder) varint(v int64)   { e.b = binary.AppendVarint(e.b, v) }
+func (e *encoder) str(s string)     { e.uvarint(uint64(len(s))); e.b = append(e.b, s...) }
+func (e *encoder) bytes(p []byte)   { e.uvarint(uint64(len(p))); e.b = append(e.b, p...) }
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.b = append(e.b, 1)
+	} else {
+		e.b = append(e.b, 0)
+	}
+}
+
+// clock writes entries in node order so equal clocks encode equally.
+func (e *encoder) clock(c store.VClock) {
+	ids := make([]string, 0, len(c))
+	for id := range c {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	e.uvarint(uint64(len(ids)))
+	for _, id := range ids {
+		e.str(id)
+		e.uvarint(c[id])
+	}
+}
+
+func (e *encoder) record(r store.Record) {
+	e.str(r.Key)
+	e.bytes(r.Value)
+	e.varint(r.Ts)
+	e.str(r.WriterID)
+	e.bool(r.Deleted)
+	e.clock(r.Clock)
+	e.varint(r.ExpiresAt)
+}
+
+func (e *encoder) records(rs []store.Record) {
+	e.uvarint(uint64(len(rs)))
+	for _, r := range rs {
+		e.record(r)
+	}
+}
+
+var errShort = errors.New("binary message truncated")
+
+// decoder reads what encoder wrote. The first error sticks; later reads
+// return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.b = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail(errShort)
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail(errShort)
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// count reads a length or element count; every element takes at least one
+// byte, so anything beyond the remaining bytes is corrupt.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.fail(errShort)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) raw() []byte {
+	n := d.count()
+	p := d.b[:n:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *decoder) str() string { return string(d.raw()) }
+
+func (d *decoder) bytes() []byte {
+	p := d.raw()
+	if len(p) == 0 {
+		return nil
+	}
+	return append([]byte(nil), p...)
+}
+
+func (d *decoder) bool() bool {
+	if len(d.b) == 0 {
+		d.fail(errShort)
+		return false
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v != 0
+}
+
+func (d *decoder) clock() store.VClock {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	c := make(store.VClock, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		id := d.str()
+		c[id] = d.uvarint()
+	}
+	return c
+}
+
+func (d *decoder) record() store.Record {
+	var r store.Record
+	r.Key = d.str()
+	r.Value = d.bytes()
+	r.Ts = d.varint()
+	r.WriterID = d.str()
+	r.Deleted = d.bool()
+	r.Clock = d.clock()
+	r.ExpiresAt = d.varint()
+	return r
+}
+
+func (d *decoder) records() []store.Record {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	rs := make([]store.Record, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		rs = append(rs, d.record())
+	}
+	return rs
+}
+
+func (m *PutRequest) encode(e *encoder) { e.record(m.Record); e.str(m.HintFor) }
+func (m *PutRequest) decode(d *decoder) { m.Record = d.record(); m.HintFor = d.str() }
+
+func (m *PutResponse) encode(e *encoder) { e.bool(m.OK) }
+func (m *PutResponse) decode(d *decoder) { m.OK = d.bool() }
+
+func (m *GetRequest) encode(e *encoder) { e.str(m.Key) }
+func (m *GetRequest) decode(d *decoder) { m.Key = d.str() }
+
+func (m *GetResponse) encode(e *encoder) { e.bool(m.Found); e.records(m.Siblings) }
+func (m *GetResponse) decode(d *decoder) { m.Found = d.bool(); m.Siblings = d.records() }
+
+func (m *GetBatchRequest) encode(e *encoder) {
+	e.uvarint(uint64(len(m.Keys)))
+	for _, k := range m.Keys {
+		e.str(k)
+	}
+}
+
+func (m *GetBatchRequest) decode(d *decoder) {
+	m.Keys = make([]string, d.count())
+	for i := range m.Keys {
+		m.Keys[i] = d.str()
+	}
+}
+
+func (m *GetBatchResponse) encode(e *encoder) {
+	e.uvarint(uint64(len(m.Results)))
+	for i := range m.Results {
+		m.Results[i].encode(e)
+	}
+}
+
+func (m *GetBatchResponse) decode(d *decoder) {
+	m.Results = make([]GetResponse, d.count())
+	for i := range m.Results {
+		m.Results[i].decode(d)
+	}
+}
+
+func (m *PutBatchRequest) encode(e *encoder) {
+	e.uvarint(uint64(len(m.Puts)))
+	for i := range m.Puts {
+		m.Puts[i].encode(e)
+	}
+}
+
+func (m *PutBatchRequest) decode(d *decoder) {
+	m.Puts = make([]PutRequest, d.count())
+	for i := range m.Puts {
+		m.Puts[i].decode(d)
+	}
+}
+
+func (m *PutBatchResponse) encode(e *encoder) {
+	e.uvarint(uint64(len(m.Errors)))
+	for _, s := range m.Errors {
+		e.str(s)
+	}
+}
+
+func (m *PutBatchResponse) decode(d *decoder) {
+	m.Errors = make([]string, d.count())
+	for i := range m.Errors {
+		m.Errors[i] = d.str()
+	}
+}
+
+func (m *KeysRequest) encode(e *encoder) {
+	e.uvarint(uint64(len(m.Leaves)))
+	for _, q := range m.Leaves {
+		e.uvarint(q.Range.Start)
+		e.uvarint(q.Range.End)
+		e.uvarint(uint64(len(q.Nodes)))
+		for _, n := range q.Nodes {
+			e.uvarint(uint64(n))
+		}
+	}
+	// Keyspaces follow the leaves only when there are any, so nodes that
+	// predate keyspaces still decode the message.
+	named := false
+	for _, q := range m.Leaves {
+		named = named || q.Keyspace != ""
+	}
+	if named {
+		for _, q := range m.Leaves {
+			e.str(q.Keyspace)
+		}
+	}
+}
+
+func (m *KeysRequest) decode(d *decoder) {
+	n := d.count()
+	if n == 0 {
+		return
+	}
+	m.Leaves = make([]TreeQuery, n)
+	for i := range m.Leaves {
+		m.Leaves[i].Range = ring.Range{Start: d.uvarint(), End: d.uvarint()}
+		m.Leaves[i].Nodes = make([]int, d.count())
+		for j := range m.Leaves[i].Nodes {
+			m.Leaves[i].Nodes[j] = int(d.uvarint())
+		}
+	}
+	if len(d.b) > 0 {
+		for i := range m.Leaves {
+			m.Leaves[i].Keyspace = d.str()
+		}
+	}
+}
+
+func (m *KeysResponse) encode(e *encoder) {
+	e.uvarint(uint64(len(m.Keys)))
+	for k, ms := range m.Keys {
+		e.str(k)
+		e.uvarint(uint64(len(ms)))
+		for _, x := range ms {
+			e.varint(x.Ts)
+			e.str(x.WriterID)
+			e.bool(x.Deleted)
+			e.clock(x.Clock)
+			e.varint(x.ExpiresAt)
+		}
+	}
+}
+
+func (m *KeysResponse) decode(d *decoder) {
+	n := d.count()
+	m.Keys = make(map[string][]store.Meta, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.str()
+		ms := make([]store.Meta, d.count())
+		for j := range ms {
+			ms[j] = store.Meta{Ts: d.varint(), WriterID: d.str(), Deleted: d.bool(), Clock: d.clock(), ExpiresAt: d.varint()}
+		}
+		m.Keys[k] = ms
+	}
+}
@@ -5,31 +5,109 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"mini-dynamo/internal/hlc"
+	"mini-dynamo/internal/tracing"
 )
 
 type Client struct {
 	http *http.Client
+
+	// Clock, if set, stamps every request and observes every response, so
+	// the node's hybrid logical clock advances with internal traffic.
+	Clock *hlc.Clock
+
+	// BatchRecords and BatchBytes cap each request of PutBatch and GetBatch
+	// (0 = DefaultBatchRecords, DefaultBatchBytes). Larger batches are split.
+	BatchRecords int
+	BatchBytes   int
+
+	// JSONOnly turns the binary protocol off for requests from this client.
+	JSONOnly bool
+
+	// Secret, if set, is sent in SecretHeader on every request (see
+	// RequireSecret).
+	Secret string
+
+	proto sync.Map // host -> protocol version it last advertised
+	tls   bool     // see UseTLS
 }
 
 func NewClient(timeout time.Duration) *Client {
+	// Keep enough idle connections per peer for coordinator fan-out, so
+	// internal requests reuse persistent connections.
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.MaxIdleConnsPerHost = 64
 	return &Client{
-		http: &http.Client{Timeout: timeout},
+		http: &http.Client{Timeout: timeout, Transport: tr},
 	}
 }
 
+// PostJSON sends req as JSON and decodes a JSON response into resp.
 func (c *Client) PostJSON(ctx context.Context, url string, req any, resp any) error {
 	b, err := json.Marshal(req)
 	if err != nil {
 		return err
 	}
+	return c.post(ctx, url, b, jsonType, resp)
+}
+
+// Post is PostJSON that uses the binary protocol when req and resp have a
+// binary encoding and the peer has advertised it.
+func (c *Client) Post(ctx context.Context, url string, req binaryMessage, resp binaryMessage) error {
+	if !c.speaksBinary(url) {
+		return c.PostJSON(ctx, url, req, resp)
+	}
+	return c.post(ctx, url, marshalBinary(req), binaryType, resp)
+}
+
+// speaksBinary reports whether the peer at url last advertised the binary
+// protocol.
+func (c *Client) speaksBinary(url string) bool {
+	if c.JSONOnly {
+		return false
+	}
+	v, ok := c.proto.Load(hostOf(url))
+	return ok && v.(int) >= ProtoVersion
+}
+
+func hostOf(url string) string {
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	}
+	if i := strings.IndexByte(url, '/'); i >= 0 {
+		url = url[:i]
+	}
+	return url
+}
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+// post sends body of contentType and decodes the response, in whichever
+// codec the peer answered with, into resp.
+func (c *Client) post(ctx context.Context, url string, body []byte, contentType string, resp any) error {
+	if c.tls && strings.HasPrefix(url, "http://") {
+		url = "https://" + strings.TrimPrefix(url, "http://")
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Content-Type", contentType)
+	if _, ok := resp.(binaryMessage); ok && !c.JSONOnly {
+		httpReq.Header.Set("Accept", binaryType+", "+jsonType)
+	}
+	if c.Secret != "" {
+		httpReq.Header.Set(SecretHeader, c.Secret)
+	}
+	if c.Clock != nil {
+		httpReq.Header.Set(hlc.Header, strconv.FormatInt(c.Clock.Now(), 10))
+	}
+	tracing.Inject(ctx, httpReq.Header)
 
 	r, err := c.http.Do(httpReq)
 	if err != nil {
@@ -37,12 +115,53 @@ func (c *Client) PostJSON(ctx context.Context, url string, req any, resp any) er
 	}
 	defer r.Body.Close()
 
+	v, _ := strconv.Atoi(r.Header.Get(ProtoHeader))
+	c.proto.Store(hostOf(url), v)
+
 	if r.StatusCode < 200 || r.StatusCode >= 300 {
 		return fmt.Errorf("POST %s: status %d", url, r.StatusCode)
 	}
+	if err := observe(c.Clock, r.Header); err != nil {
+		return fmt.Errorf("POST %s: %w", url, err)
+	}
 
 	if resp == nil {
 		return nil
 	}
+	if m, ok := resp.(binaryMessage); ok && strings.HasPrefix(r.Header.Get("Content-Type"), binaryType) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		if len(b) == 0 {
+			return fmt.Errorf("POST %s: empty binary response", url)
+		}
+		return unmarshalBinary(b, m)
+	}
 	return json.NewDecoder(r.Body).Decode(resp)
 }
+
+func observe(clk *hlc.Clock, h http.Header) error {
+	if clk == nil {
+		return nil
+	}
+	ts, err := strconv.ParseInt(h.Get(hlc.Header), 10, 64)
+	if err != nil {
+		return nil // peer without a clock
+	}
+	return clk.Observe(ts)
+}
+
+// Clocked wraps the internal API: it observes the caller's clock on each
+// request (refusing it with 409 Conflict if it is too far ahead) and stamps
+// each response with this node's.
+func Clocked(clk *hlc.Clock, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := observe(clk, r.Header); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set(hlc.Header, strconv.FormatInt(clk.Now(), 10))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,6 +1,11 @@
 package transport
 
-import "mini-dynamo/internal/store"
+import (
+	"mini-dynamo/internal/keyspace"
+	"mini-dynamo/internal/paxos"
+	"mini-dynamo/internal/ring"
+	"mini-dynamo/internal/store"
+)
 
 // GET
 type GetRequest struct {
@@ -8,8 +13,8 @@ type GetRequest struct {
 }
 
 type GetResponse struct {
-	Found  bool         `json:"found"`
-	Record store.Record `json:"record,omitempty"`
+	Found    bool           `json:"found"`
+	Siblings []store.Record `json:"siblings,omitempty"`
 }
 
 // PUT
@@ -22,9 +27,149 @@ type PutResponse struct {
 	OK bool `json:"ok"`
 }
 
+// SCAN (ordered range/prefix scans)
+// A replica answers with its first Limit keys that start with Prefix, from
+// Start (inclusive) or after After (exclusive) when set, tombstones included.
+type ScanRequest struct {
+	Prefix string `json:"prefix,omitempty"`
+	Start  string `json:"start,omitempty"`
+	After  string `json:"after,omitempty"`
+	Limit  int    `json:"limit"`
+}
+
+type ScanItem struct {
+	Key      string         `json:"key"`
+	Siblings []store.Record `json:"siblings"`
+}
+
+type ScanResponse struct {
+	Items []ScanItem `json:"items"`
+	More  bool       `json:"more,omitempty"` // stopped at Limit; later keys may match
+}
+
+// BATCH (multi-key replica reads and writes)
+type GetBatchRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type GetBatchResponse struct {
+	Results []GetResponse `json:"results"` // aligned with GetBatchRequest.Keys
+}
+
+type PutBatchRequest struct {
+	Puts []PutRequest `json:"puts"`
+}
+
+// PutBatchResponse has one error per put, aligned with PutBatchRequest.Puts;
+// empty means the replica applied it.
+type PutBatchResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// PAXOS (serial operations)
+type PaxosRequest struct {
+	Phase  string        `json:"phase"` // "prepare" | "propose" | "commit"
+	Key    string        `json:"key"`
+	Ballot paxos.Ballot  `json:"ballot"`
+	Record *store.Record `json:"record,omitempty"` // propose/commit
+}
+
+// PaxosResponse carries the acceptor's state for the key; a prepare also
+// returns the replica's current siblings.
+type PaxosResponse struct {
+	OK       bool           `json:"ok"`
+	State    paxos.State    `json:"state"`
+	Siblings []store.Record `json:"siblings,omitempty"`
+}
+
 // KEYS (anti-entropy)
-type KeysRequest struct{}
+// An empty request returns metadata for every key; otherwise only keys that
+// fall in the listed Merkle leaves are returned.
+type KeysRequest struct {
+	Leaves []TreeQuery `json:"leaves,omitempty"`
+}
 
 type KeysResponse struct {
-	Keys map[string]store.Meta `json:"keys"`
+	Keys map[string][]store.Meta `json:"keys"`
+}
+
+// TREE (Merkle anti-entropy)
+type TreeQuery struct {
+	Keyspace string     `json:"keyspace,omitempty"` // "" is the default keyspace
+	Range    ring.Range `json:"range"`
+	Nodes    []int      `json:"nodes"`
+}
+
+type TreeRequest struct {
+	Level   int         `json:"level"`
+	Queries []TreeQuery `json:"queries"`
+}
+
+type TreeResponse struct {
+	Depth  int        `json:"depth"`
+	Hashes [][]uint64 `json:"hashes"` // aligned with TreeRequest.Queries
+}
+
+// GOSSIP (membership)
+type MemberDigest struct {
+	ID         string `json:"id"`
+	Addr       string `json:"addr"`
+	Generation int64  `json:"generation"`
+	Heartbeat  uint64 `json:"heartbeat"`
+}
+
+type GossipRequest struct {
+	From      string            `json:"from"`
+	Members   []MemberDigest    `json:"members"`
+	Layout    *ring.Layout      `json:"layout,omitempty"`    // sender's committed ring
+	Keyspaces *keyspace.Catalog `json:"keyspaces,omitempty"` // sender's keyspace catalog
+}
+
+type GossipResponse struct {
+	Members   []MemberDigest    `json:"members"`
+	Layout    *ring.Layout      `json:"layout,omitempty"`
+	Keyspaces *keyspace.Catalog `json:"keyspaces,omitempty"`
+}
+
+// RING (join / decommission)
+type RingRequest struct {
+	Op      string      `json:"op"` // "prepare" | "commit" | "abort"
+	Current ring.Layout `json:"current"`
+	Next    ring.Layout `json:"next"`
+}
+
+type RingResponse struct {
+	OK      bool        `json:"ok"`
+	Current ring.Layout `json:"current"`
+}
+
+// KEYSPACES (catalog changes from the admin API)
+type KeyspacesRequest struct {
+	Catalog keyspace.Catalog `json:"catalog"`
+}
+
+type KeyspacesResponse struct {
+	Current keyspace.Catalog `json:"current"` // the node's catalog after the request
+}
+
+// StreamRequest asks an old owner for the keys For gains under the pending layout.
+type StreamRequest struct {
+	Version uint64 `json:"version"`
+	For     string `json:"for"`
+	After   string `json:"after,omitempty"` // pagination cursor (last key returned)
+	Limit   int    `json:"limit,omitempty"`
+}
+
+type StreamResponse struct {
+	Records []store.Record `json:"records"`
+	Next    string         `json:"next,omitempty"` // empty when done
+}
+
+// TransitionRequest drives one step of a layout change on a node.
+type TransitionRequest struct {
+	Version uint64 `json:"version"`
+}
+
+type TransitionResponse struct {
+	Moved int `json:"moved"`
 }
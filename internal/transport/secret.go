@@ -0,0 +1,27 @@
+package transport
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+)
+
+// SecretHeader carries the cluster's shared secret on internal requests.
+const SecretHeader = "X-Cluster-Secret"
+
+// RequireSecret admits only requests carrying secret in SecretHeader.
+func RequireSecret(secret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(secret)) != 1 {
+			deny(w, r, http.StatusUnauthorized, "missing or wrong cluster secret")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deny refuses an internal request and writes it to the audit log.
+func deny(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	log.Printf("audit: denied %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, reason)
+	http.Error(w, reason, status)
+}
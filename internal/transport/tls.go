@@ -0,0 +1,271 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certs is a node's TLS identity: its certificate and key, and the CA that
+// signs every node's (and client's) certificate. A node certificate names
+// its node ID as the Common Name or a DNS name. The files are re-read when
+// they change, so certificates can be rotated without a restart.
+type Certs struct {
+	cert, key, ca string
+
+	mu      sync.Mutex
+	checked time.Time
+	mods    [3]time.Time // cert, key, ca modification times
+	pair    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+// reloadEvery bounds how often Certs looks at its files.
+const reloadEvery = time.Second
+
+// LoadCerts reads the certificate, key and CA bundle at the given paths.
+func LoadCerts(cert, key, ca string) (*Certs, error) {
+	c := &Certs{cert: cert, key: key, ca: ca}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Certs) load() error {
+	var mods [3]time.Time
+	for i, p := range []string{c.cert, c.key, c.ca} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		mods[i] = fi.ModTime()
+	}
+	if c.pair != nil && mods == c.mods {
+		return nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		return err
+	}
+	pem, err := os.ReadFile(c.ca)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%s: no CA certificates", c.ca)
+	}
+	if c.pair != nil {
+		log.Printf("tls: reloaded %s, %s and %s", c.cert, c.key, c.ca)
+	}
+	c.pair, c.pool, c.mods = &pair, pool, mods
+	return nil
+}
+
+// current returns the certificate and CA pool, reloading changed files.
+// A failed reload keeps the previous ones.
+func (c *Certs) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.checked) >= reloadEvery {
+		c.checked = now
+		if err := c.load(); err != nil {
+			log.Printf("tls: reload: %v (keeping the previous certificates)", err)
+		}
+	}
+	return c.pair, c.pool
+}
+
+// verify checks a peer's chain against the current CA for usage.
+func (c *Certs) verify(certs []*x509.Certificate, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate")
+	}
+	_, pool := c.current()
+	inter := x509.NewCertPool()
+	for _, ic := range certs[1:] {
+		inter.AddCert(ic)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: pool, Intermediates: inter, KeyUsages: []x509.ExtKeyUsage{usage}})
+	return err
+}
+
+// ServerConfig serves the node's certificate. Client certificates are
+// optional at the handshake, so clients without one can still use the
+// client API, but any that is presented must verify against the CA;
+// RequireNode then demands one from internal callers.
+func (c *Certs) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequestClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			pair, _ := c.current()
+			return pair, nil
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return nil
+			}
+			return c.verify(cs.PeerCertificates, x509.ExtKeyUsageClientAuth)
+		},
+	}
+}
+
+// certIDs lists the identities a certificate names: its Common Name and DNS
+// names.
+func certIDs(cert *x509.Certificate) []string {
+	return append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+}
+
+// RequireNode admits only callers presenting a CA-signed certificate that
+// names a node, and calling from that node's host: addrOf returns the
+// address of a node of the ring. No certificate gets 401, any other
+// identity or a call from another host 403.
+func RequireNode(addrOf func(id string) (string, bool), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			deny(w, r, http.StatusUnauthorized, "client certificate required")
+			return
+		}
+		cert := r.TLS.PeerCertificates[0]
+		named := false
+		for _, id := range certIDs(cert) {
+			addr, ok := addrOf(id)
+			if id == "" || !ok {
+				continue
+			}
+			named = true
+			if fromHost(r, addr) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		reason := fmt.Sprintf("certificate %q does not name a cluster node", cert.Subject.CommonName)
+		if named {
+			reason = fmt.Sprintf("certificate %q names a node at another address", cert.Subject.CommonName)
+		}
+		deny(w, r, http.StatusForbidden, reason)
+	})
+}
+
+// fromHost reports whether r comes from the host of addr (host:port, with
+// or without a scheme), resolving host names.
+func fromHost(r *http.Request, addr string) bool {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	rip := net.ParseIP(remote)
+	if rip == nil {
+		return false
+	}
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	for _, ip := range hostIPs.lookup(r.Context(), host) {
+		if ip.Equal(rip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostIPs caches the addresses of node host names for a while, so
+// RequireNode does not resolve them on every request.
+var hostIPs = &ipCache{m: make(map[string]cachedIPs)}
+
+const ipCacheFor = 30 * time.Second
+
+type ipCache struct {
+	mu sync.Mutex
+	m  map[string]cachedIPs
+}
+
+type cachedIPs struct {
+	ips []net.IP
+	at  time.Time
+}
+
+func (c *ipCache) lookup(ctx context.Context, host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	c.mu.Lock()
+	e, ok := c.m[host]
+	c.mu.Unlock()
+	if ok && time.Since(e.at) < ipCacheFor {
+		return e.ips
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	c.mu.Lock()
+	c.m[host] = cachedIPs{ips: ips, at: time.Now()}
+	c.mu.Unlock()
+	return ips
+}
+
+// UseTLS makes c talk https to its peers with the node's certificate.
+// nodeAt maps a peer address (host:port) to the node ID its certificate
+// must name; connections to addresses it does not know are refused.
+// Internal URLs built with http:// are sent as https://.
+func (c *Client) UseTLS(certs *Certs, nodeAt func(addr string) (string, bool)) {
+	tr := c.http.Transport.(*http.Transport)
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		raw, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			// The chain and the node identity are checked below instead of
+			// against a host name: nodes are addressed by IP and port.
+			InsecureSkipVerify: true,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				pair, _ := certs.current()
+				return pair, nil
+			},
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				if err := certs.verify(cs.PeerCertificates, x509.ExtKeyUsageServerAuth); err != nil {
+					return fmt.Errorf("peer %s: %w", addr, err)
+				}
+				id, ok := nodeAt(addr)
+				if !ok {
+					return fmt.Errorf("peer %s is not a node of the ring", addr)
+				}
+				for _, name := range certIDs(cs.PeerCertificates[0]) {
+					if name == id {
+						return nil
+					}
+				}
+				return fmt.Errorf("peer %s: certificate does not name node %q", addr, id)
+			},
+		}
+		conn := tls.Client(raw, cfg)
+		if err := conn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	c.tls = true
+}
@@ -0,0 +1,249 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA signs node certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate naming node id, and its key, under dir and
+// returns a Certs loaded from them.
+func (ca *testCA) issue(t *testing.T, dir, id string) *Certs {
+	t.Helper()
+	certPath, keyPath, caPath := ca.write(t, dir, id)
+	c, err := LoadCerts(certPath, keyPath, caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (ca *testCA) write(t *testing.T, dir, id string) (certPath, keyPath, caPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath, caPath = filepath.Join(dir, "node.pem"), filepath.Join(dir, "node.key"), filepath.Join(dir, "ca.pem")
+	for path, b := range map[string][]byte{
+		certPath: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPath:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}),
+		caPath:   ca.pem,
+	} {
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certPath, keyPath, caPath
+}
+
+// serveNode starts an /internal/ server with the certificate of node id.
+// addrs maps node IDs to the addresses RequireNode expects them at.
+func serveNode(t *testing.T, ca *testCA, id string, addrs map[string]string) *httptest.Server {
+	t.Helper()
+	certs := ca.issue(t, t.TempDir(), id)
+	h := RequireNode(func(id string) (string, bool) {
+		a, ok := addrs[id]
+		return a, ok
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{}"))
+	}))
+	// Not StartTLS: it installs httptest's own certificate, which wins over
+	// GetCertificate for clients that send no server name.
+	srv := httptest.NewUnstartedServer(h)
+	srv.Listener = tls.NewListener(srv.Listener, certs.ServerConfig())
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // refused handshakes
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// nodeClient returns a client with the certificate of node id that expects
+// the nodes of peers (address -> ID).
+func nodeClient(t *testing.T, ca *testCA, id string, peers map[string]string) *Client {
+	t.Helper()
+	c := NewClient(5 * time.Second)
+	c.UseTLS(ca.issue(t, t.TempDir(), id), func(addr string) (string, bool) {
+		id, ok := peers[addr]
+		return id, ok
+	})
+	return c
+}
+
+func hostPort(srv *httptest.Server) string { return srv.Listener.Addr().String() }
+
+func TestTLSHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	srv := serveNode(t, ca, "n1", map[string]string{"n2": "127.0.0.1:9002"})
+	addr := hostPort(srv)
+
+	tests := []struct {
+		name    string
+		client  string            // node ID of the caller's certificate
+		peers   map[string]string // the caller's view of the ring
+		wantErr string
+	}{
+		{"ok", "n2", map[string]string{addr: "n1"}, ""},
+		{"peer names another node", "n2", map[string]string{addr: "n3"}, `does not name node "n3"`},
+		{"peer not in ring", "n2", map[string]string{}, "not a node of the ring"},
+		{"caller not in ring", "n4", map[string]string{addr: "n1"}, "status 403"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := nodeClient(t, ca, tt.client, tt.peers)
+			err := c.PostJSON(context.Background(), "http://"+addr+"/internal/test", struct{}{}, nil)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("PostJSON: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("PostJSON error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSForeignCA(t *testing.T) {
+	srv := serveNode(t, newTestCA(t), "n1", map[string]string{"n2": "127.0.0.1:9002"})
+	addr := hostPort(srv)
+	c := nodeClient(t, newTestCA(t), "n2", map[string]string{addr: "n1"})
+	if err := c.PostJSON(context.Background(), "http://"+addr+"/internal/test", struct{}{}, nil); err == nil {
+		t.Fatal("a peer signed by another CA was accepted")
+	}
+}
+
+func TestRequireNodeBindsAddress(t *testing.T) {
+	ca := newTestCA(t)
+	srv := serveNode(t, ca, "n1", map[string]string{
+		"n2": "127.0.0.1:9002",
+		"n3": "192.0.2.3:9003", // not where the test calls from
+	})
+	addr := hostPort(srv)
+
+	if err := nodeClient(t, ca, "n3", map[string]string{addr: "n1"}).
+		PostJSON(context.Background(), "http://"+addr+"/internal/test", struct{}{}, nil); err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Fatalf("n3's certificate from another host: err = %v, want 403", err)
+	}
+
+	// Without a client certificate.
+	plain := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := plain.Post("https://"+addr+"/internal/test", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("no client certificate: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestCertsReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certs := ca.issue(t, dir, "n1")
+	if pair, _ := certs.current(); leafCN(t, pair) != "n1" {
+		t.Fatalf("loaded %q, want n1", leafCN(t, pair))
+	}
+
+	// Rotate the files; make sure the modification times move.
+	ca.write(t, dir, "n1-rotated")
+	later := time.Now().Add(2 * time.Second)
+	for _, f := range []string{"node.pem", "node.key", "ca.pem"} {
+		if err := os.Chtimes(filepath.Join(dir, f), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certs.mu.Lock()
+	certs.checked = time.Time{}
+	certs.mu.Unlock()
+	if pair, _ := certs.current(); leafCN(t, pair) != "n1-rotated" {
+		t.Fatalf("after rotation got %q, want n1-rotated", leafCN(t, pair))
+	}
+
+	// A broken key keeps the previous certificate.
+	if err := os.WriteFile(filepath.Join(dir, "node.key"), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "node.key"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	certs.mu.Lock()
+	certs.checked = time.Time{}
+	certs.mu.Unlock()
+	if pair, _ := certs.current(); leafCN(t, pair) != "n1-rotated" {
+		t.Fatalf("after a failed reload got %q, want n1-rotated", leafCN(t, pair))
+	}
+}
+
+func leafCN(t *testing.T, pair *tls.Certificate) string {
+	t.Helper()
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
@@ -3,4 +3,12 @@ package types
 type NodeInfo struct {
 	ID   string `json:"id"`
 	Addr string `json:"addr"`
+
+	// Topology labels for replica placement; empty means unlabelled.
+	DC   string `json:"dc,omitempty"`
+	Rack string `json:"rack,omitempty"`
+
+	// Weight scales the node's share of the ring relative to other nodes,
+	// e.g. 2 for a node with twice the capacity. 0 means 1.
+	Weight float64 `json:"weight,omitempty"`
 }